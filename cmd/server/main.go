@@ -12,6 +12,7 @@ import (
 	"hls-orchestrator/internal/platform/config"
 	"hls-orchestrator/internal/platform/logger"
 	"hls-orchestrator/internal/platform/metrics"
+	"hls-orchestrator/internal/platform/redis"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -23,15 +24,136 @@ func main() {
 
 	port := config.GetEnv("PORT", "8080")
 	windowSize := config.GetEnvInt("SLIDING_WINDOW_SIZE", 6)
+	retentionSegments := config.GetEnvInt("RETENTION_SEGMENTS", 0)
+	retentionMaxAge := config.GetEnvDuration("RETENTION_MAX_AGE", time.Hour)
+	gapTimeout := config.GetEnvDuration("GAP_TIMEOUT", orchestrator.DefaultGapTimeout)
+	blockingReloadTimeout := config.GetEnvDuration("BLOCKING_RELOAD_TIMEOUT", orchestrator.DefaultBlockingReloadTimeout)
+	vodOutputDir := config.GetEnv("VOD_OUTPUT_DIR", "")
+	keyToken := config.GetEnv("KEY_TOKEN", "")
+	playerKeyToken := config.GetEnv("PLAYER_KEY_TOKEN", "")
+	maxSegmentDuration := config.GetEnvInt("MAX_SEGMENT_DURATION", 0)
+	targetDurationPolicy := orchestrator.TargetDurationPolicy(config.GetEnv("TARGET_DURATION_POLICY", string(orchestrator.TargetDurationFlag)))
+	maxBodyBytes := config.GetEnvInt("MAX_BODY_BYTES", orchestrator.DefaultMaxBodyBytes)
+	storeBackend := config.GetEnv("STORE_BACKEND", "memory")
+	storeDir := config.GetEnv("STORE_DIR", "data")
+	storeSnapshotEvery := config.GetEnvInt("STORE_SNAPSHOT_EVERY", orchestrator.DefaultSnapshotEvery)
+	redisAddr := config.GetEnv("REDIS_ADDR", "localhost:6379")
+	redisPassword := config.GetEnv("REDIS_PASSWORD", "")
+	redisDB := config.GetEnvInt("REDIS_DB", 0)
+	redisKeyPrefix := config.GetEnv("REDIS_KEY_PREFIX", orchestrator.DefaultRedisKeyPrefix)
+	watchPollInterval := config.GetEnvDuration("REDIS_WATCH_POLL_INTERVAL", 250*time.Millisecond)
+	endedStreamTTL := config.GetEnvDuration("ENDED_STREAM_TTL", time.Hour)
+	archivedStreamTTL := config.GetEnvDuration("ARCHIVED_STREAM_TTL", 0)
+	idleStreamTTL := config.GetEnvDuration("IDLE_STREAM_TTL", 24*time.Hour)
+	janitorInterval := config.GetEnvDuration("JANITOR_INTERVAL", time.Minute)
 	logLevel := config.GetEnv("LOG_LEVEL", "info")
 	logFormat := config.GetEnv("LOG_FORMAT", "json")
 
 	log := logger.New(logLevel, logFormat)
 
-	repo := orchestrator.NewInMemoryRepository()
-	svc := orchestrator.NewService(repo, windowSize)
+	switch targetDurationPolicy {
+	case orchestrator.TargetDurationFlag, orchestrator.TargetDurationReject:
+	default:
+		log.Error("unknown target duration policy", "target_duration_policy", targetDurationPolicy)
+		os.Exit(1)
+	}
+
+	if keyToken != "" && keyToken == playerKeyToken {
+		log.Error("KEY_TOKEN and PLAYER_KEY_TOKEN must differ")
+		os.Exit(1)
+	}
+
+	if vodOutputDir != "" && (retentionSegments > 0 || retentionMaxAge > 0) {
+		log.Info("VOD playlists of live and dvr streams only contain their retained segments unless the stream sets archive",
+			"retention_segments", retentionSegments,
+			"retention_max_age", retentionMaxAge,
+			"vod_output_dir", vodOutputDir)
+	}
+
+	if retentionSegments > 0 && retentionSegments < windowSize {
+		log.Warn("retention is smaller than the sliding window; playlists will be truncated",
+			"retention_segments", retentionSegments,
+			"sliding_window_size", windowSize)
+	}
+
+	var store orchestrator.Store
+	closeStore := func() error { return nil }
+	switch storeBackend {
+	case "memory":
+		store = orchestrator.NewInMemoryStore()
+	case "file":
+		fs, err := orchestrator.OpenFileStore(storeDir, storeSnapshotEvery)
+		if err != nil {
+			log.Error("open file store failed", "dir", storeDir, "error", err)
+			os.Exit(1)
+		}
+		store, closeStore = fs, fs.Close
+	case "redis":
+		client := redis.NewClient(redisAddr, redis.Options{Password: redisPassword, DB: redisDB})
+		if err := client.Ping(); err != nil {
+			log.Error("connect to redis failed", "addr", redisAddr, "error", err)
+			os.Exit(1)
+		}
+		store, closeStore = orchestrator.NewRedisStore(client, redisKeyPrefix), client.Close
+	default:
+		log.Error("unknown store backend", "store_backend", storeBackend)
+		os.Exit(1)
+	}
+
 	met := metrics.New()
-	h := orchestrator.NewHandler(svc, log, met)
+	repo := orchestrator.NewInMemoryRepositoryWithConfig(store, orchestrator.RepositoryConfig{
+		Retention: orchestrator.RetentionPolicy{
+			MaxSegments: retentionSegments,
+			MaxAge:      retentionMaxAge,
+		},
+		OnEvict:           met.AddSegmentsEvicted,
+		EndedStreamTTL:    endedStreamTTL,
+		ArchivedStreamTTL: archivedStreamTTL,
+		IdleStreamTTL:     idleStreamTTL,
+		OnPurge:           met.AddStreamsPurged,
+		OnStoreError: func(err error) {
+			log.Error("store error", "error", err)
+		},
+		WatchPollInterval:    watchPollInterval,
+		TargetDurationPolicy: targetDurationPolicy,
+		TargetDuration:       maxSegmentDuration,
+		OnTargetDurationExceeded: func(streamID orchestrator.StreamID, renditionID orchestrator.RenditionID, seg orchestrator.Segment, target int) {
+			log.Warn("segment exceeds target duration",
+				"stream_id", streamID,
+				"rendition", renditionID,
+				"sequence", seg.Sequence,
+				"duration", seg.Duration,
+				"target_duration", target,
+				"policy", targetDurationPolicy)
+			met.IncTargetDurationViolations()
+		},
+	})
+	if err := repo.Restore(); err != nil {
+		log.Error("restore state failed", "store_backend", storeBackend, "error", err)
+		os.Exit(1)
+	}
+
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	defer stopJanitor()
+	if janitorInterval > 0 {
+		go repo.RunJanitor(janitorCtx, janitorInterval)
+	}
+
+	svc := orchestrator.NewServiceWithConfig(repo, orchestrator.ServiceConfig{
+		WindowSize:            windowSize,
+		BlockingReloadTimeout: blockingReloadTimeout,
+		GapTimeout:            gapTimeout,
+		VODOutputDir:          vodOutputDir,
+		OnVODError: func(err error) {
+			log.Error("vod archive error", "error", err)
+		},
+	})
+	h := orchestrator.NewHandlerWithConfig(svc, log, met, orchestrator.HandlerConfig{
+		KeyToken:           keyToken,
+		PlayerKeyToken:     playerKeyToken,
+		MaxSegmentDuration: maxSegmentDuration,
+		MaxBodyBytes:       int64(maxBodyBytes),
+	})
 
 	r := chi.NewRouter()
 	r.Use(logger.RequestLogger(log))
@@ -39,11 +161,28 @@ func main() {
 	r.Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
 		met.Handler(func() { met.SetActiveStreams(repo.ActiveStreamCount()) }).ServeHTTP(w, r)
 	})
+	r.Post("/streams", h.CreateStream)
+	r.Get("/streams", h.ListStreams)
 	r.Route("/streams/{stream_id}", func(r chi.Router) {
+		r.Get("/", h.GetStream)
+		r.Delete("/", h.DeleteStream)
+		r.Put("/settings", h.UpdateStreamSettings)
+		r.Patch("/settings", h.PatchStreamSettings)
+		r.Post("/cues", h.RegisterCue)
+		r.Post("/keys", h.IssueKey)
+		r.Get("/keys/{first_sequence}", h.GetKey)
 		r.Post("/end", h.EndStream)
+		r.Get("/alignment", h.GetAlignment)
+		r.Get("/master.m3u8", h.GetMasterPlaylist)
 		r.Route("/renditions/{rendition}", func(r chi.Router) {
+			r.Put("/", h.RegisterRendition)
+			r.Patch("/", h.PatchRendition)
+			r.Get("/", h.GetRendition)
+			r.Post("/end", h.EndRendition)
 			r.Post("/segments", h.RegisterSegment)
+			r.Post("/segments/{sequence}/parts", h.RegisterPart)
 			r.Get("/playlist.m3u8", h.GetPlaylist)
+			r.Get("/vod.m3u8", h.GetVODPlaylist)
 		})
 	})
 
@@ -60,6 +199,12 @@ func main() {
 	log.Info("server starting",
 		"port", port,
 		"sliding_window_size", windowSize,
+		"blocking_reload_timeout", blockingReloadTimeout.String(),
+		"retention_segments", retentionSegments,
+		"retention_max_age", retentionMaxAge.String(),
+		"store_backend", storeBackend,
+		"ended_stream_ttl", endedStreamTTL.String(),
+		"idle_stream_ttl", idleStreamTTL.String(),
 		"log_level", logLevel,
 	)
 
@@ -77,5 +222,11 @@ func main() {
 		os.Exit(1)
 	}
 
+	stopJanitor()
+	if err := closeStore(); err != nil {
+		log.Error("close store failed", "error", err)
+		os.Exit(1)
+	}
+
 	log.Info("server stopped")
 }
@@ -0,0 +1,203 @@
+package orchestrator
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+)
+
+// alignmentTolerance is the largest difference, in seconds, between the
+// durations of a segment in two renditions that is not reported as a
+// misalignment (encoders round timestamps differently).
+const alignmentTolerance = 0.001
+
+// AlignmentReport describes how far the renditions of a stream are apart.
+// This matches the JSON response of the alignment endpoint.
+type AlignmentReport struct {
+	StreamID StreamID `json:"stream_id"`
+	Aligned  bool     `json:"aligned"` // whether the stream's aligned setting is on
+
+	// LiveEdge is the live edge of the most advanced rendition, and
+	// CommonEdge that of the least advanced one that has not ended. Aligned
+	// streams cap each rendition's playlist at the common edge of its media
+	// type (RenditionAlignment.CommonEdge), not at this one.
+	LiveEdge   *int64 `json:"live_edge,omitempty"`
+	CommonEdge *int64 `json:"common_edge,omitempty"`
+
+	Renditions []RenditionAlignment `json:"renditions"`
+	Mismatches []DurationMismatch   `json:"mismatches,omitempty"`
+}
+
+// RenditionAlignment is the position of one rendition in an AlignmentReport.
+type RenditionAlignment struct {
+	ID         RenditionID `json:"id"`
+	Type       MediaType   `json:"type"`
+	Ended      bool        `json:"ended"`
+	LiveEdge   *int64      `json:"live_edge,omitempty"`   // newest listed sequence number; omitted without segments
+	CommonEdge *int64      `json:"common_edge,omitempty"` // lowest live edge of the renditions of Type that have not ended
+	Lag        int64       `json:"lag"`                   // segments behind the most advanced rendition of Type
+}
+
+// DurationMismatch is a sequence number whose segments have different
+// durations in different renditions of the same media type.
+type DurationMismatch struct {
+	Sequence  int64                   `json:"sequence"`
+	Type      MediaType               `json:"type"`
+	Durations map[RenditionID]float64 `json:"durations"`
+}
+
+// alignmentType returns the media type a rendition of type t is aligned
+// with. Renditions of different types, such as audio and video, are never
+// aligned with each other: their segments need not share sequence numbers
+// or durations.
+func alignmentType(t MediaType) MediaType {
+	if t == "" {
+		return MediaTypeVideo
+	}
+	return t
+}
+
+// mismatchKey identifies the segments compared for duration mismatches.
+type mismatchKey struct {
+	typ MediaType
+	seq int64
+}
+
+// GetAlignment reports the live edge of every rendition of a stream and the
+// sequence numbers whose retained segments differ in duration between
+// renditions of the same media type. The ok return is false if the stream
+// does not exist.
+func (s *Service) GetAlignment(streamID StreamID) (AlignmentReport, bool) {
+	renditions, ok := s.repo.ListRenditions(streamID)
+	if !ok {
+		return AlignmentReport{}, false
+	}
+	settings, _ := s.repo.GetStreamSettings(streamID)
+	report := AlignmentReport{StreamID: streamID, Aligned: settings.Aligned, Renditions: []RenditionAlignment{}}
+
+	durations := make(map[mismatchKey]map[RenditionID]float64)
+	liveEdges := make(map[MediaType]int64)
+	commonEdges := make(map[MediaType]*int64)
+	for _, r := range renditions {
+		ra := RenditionAlignment{ID: r.ID, Type: alignmentType(r.Info.Type), Ended: r.Ended}
+		snap, _ := s.repo.GetRendition(streamID, r.ID)
+		if edge, ok := s.liveEdge(snap); ok {
+			ra.LiveEdge = &edge
+			if report.LiveEdge == nil || edge > *report.LiveEdge {
+				report.LiveEdge = &edge
+			}
+			if !r.Ended && (report.CommonEdge == nil || edge < *report.CommonEdge) {
+				report.CommonEdge = &edge
+			}
+			if live, ok := liveEdges[ra.Type]; !ok || edge > live {
+				liveEdges[ra.Type] = edge
+			}
+			if common := commonEdges[ra.Type]; !r.Ended && (common == nil || edge < *common) {
+				commonEdges[ra.Type] = &edge
+			}
+		}
+		for _, seg := range snap.Segments {
+			key := mismatchKey{ra.Type, seg.Sequence}
+			if durations[key] == nil {
+				durations[key] = make(map[RenditionID]float64)
+			}
+			durations[key][r.ID] = seg.Duration
+		}
+		report.Renditions = append(report.Renditions, ra)
+	}
+	for i, ra := range report.Renditions {
+		report.Renditions[i].CommonEdge = commonEdges[ra.Type]
+		if ra.LiveEdge != nil {
+			report.Renditions[i].Lag = liveEdges[ra.Type] - *ra.LiveEdge
+		}
+	}
+
+	for key, byRendition := range durations {
+		lo, hi := math.Inf(1), math.Inf(-1)
+		for _, d := range byRendition {
+			lo, hi = math.Min(lo, d), math.Max(hi, d)
+		}
+		if hi-lo > alignmentTolerance {
+			report.Mismatches = append(report.Mismatches, DurationMismatch{Sequence: key.seq, Type: key.typ, Durations: byRendition})
+		}
+	}
+	sort.Slice(report.Mismatches, func(i, j int) bool {
+		a, b := report.Mismatches[i], report.Mismatches[j]
+		if a.Sequence != b.Sequence {
+			return a.Sequence < b.Sequence
+		}
+		return a.Type < b.Type
+	})
+	return report, true
+}
+
+// liveEdge returns the sequence number of the newest segment the playlist of
+// snap lists under the stream's playlist type and gap policy, or false if it
+// lists none. Holes that the policy skips or fills therefore do not hold the
+// edge back.
+func (s *Service) liveEdge(snap RenditionSnapshot) (int64, bool) {
+	p, _ := s.mediaPlaylist(snap, "")
+	if len(p.Segments) == 0 {
+		return 0, false
+	}
+	return p.Segments[len(p.Segments)-1].Sequence, true
+}
+
+// alignedSnapshot caps the segments of snap at the common live edge of the
+// stream's renditions if the stream is aligned and still live: the lowest
+// live edge of any rendition of the same media type that has segments and
+// has not ended.
+func (s *Service) alignedSnapshot(streamID StreamID, renditionID RenditionID, snap RenditionSnapshot) RenditionSnapshot {
+	if !snap.Settings.Aligned || snap.Ended {
+		return snap
+	}
+	renditions, _ := s.repo.ListRenditions(streamID)
+	var typ MediaType
+	for _, r := range renditions {
+		if r.ID == renditionID {
+			typ = alignmentType(r.Info.Type)
+		}
+	}
+	common := int64(math.MaxInt64)
+	for _, r := range renditions {
+		if r.Ended || alignmentType(r.Info.Type) != typ {
+			continue
+		}
+		other := snap
+		if r.ID != renditionID {
+			other, _ = s.repo.GetRendition(streamID, r.ID)
+		}
+		if edge, ok := s.liveEdge(other); ok {
+			common = min(common, edge)
+		}
+	}
+
+	n := sort.Search(len(snap.Segments), func(i int) bool { return snap.Segments[i].Sequence > common })
+	snap.Segments = snap.Segments[:n]
+	return snap
+}
+
+// watchStream is Watch for every rendition of an aligned stream, whose
+// playlists can change whenever any rendition does. The returned channel is
+// closed on the first change or when ctx is done.
+func (s *Service) watchStream(ctx context.Context, streamID StreamID, renditionID RenditionID) <-chan struct{} {
+	renditions, _ := s.repo.ListRenditions(streamID)
+	changed := make(chan struct{})
+	var once sync.Once
+	watch := func(ch <-chan struct{}) {
+		select {
+		case <-ch:
+			once.Do(func() { close(changed) })
+		case <-changed:
+		case <-ctx.Done():
+		}
+	}
+	go watch(s.repo.Watch(streamID, renditionID))
+	for _, r := range renditions {
+		if r.ID != renditionID {
+			go watch(s.repo.Watch(streamID, r.ID))
+		}
+	}
+	return changed
+}
@@ -0,0 +1,162 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// registerRange registers 2-second segments from through to of a rendition
+// of stream s1.
+func registerRange(svc *Service, renditionID RenditionID, from, to int64) {
+	for seq := from; seq <= to; seq++ {
+		_ = svc.RegisterSegment("s1", renditionID, Segment{Sequence: seq, Duration: 2.0, Path: fmt.Sprintf("/%s/%d.ts", renditionID, seq)})
+	}
+}
+
+func TestService_GetPlaylist_aligned(t *testing.T) {
+	svc := NewService(NewInMemoryRepository(), 6)
+	registerRange(svc, "720p", 1, 5)
+	registerRange(svc, "480p", 1, 3)
+
+	m3u8, _ := svc.GetPlaylist("s1", "720p")
+	if strings.Count(m3u8, "#EXTINF") != 5 {
+		t.Errorf("expected 5 segments without alignment: %s", m3u8)
+	}
+
+	_ = svc.UpdateStreamSettings("s1", StreamSettings{Aligned: true})
+	m3u8, _ = svc.GetPlaylist("s1", "720p")
+	if strings.Count(m3u8, "#EXTINF") != 3 {
+		t.Errorf("expected the live edge capped at 480p's sequence 3: %s", m3u8)
+	}
+
+	_ = svc.EndRendition("s1", "480p")
+	m3u8, _ = svc.GetPlaylist("s1", "720p")
+	if strings.Count(m3u8, "#EXTINF") != 5 {
+		t.Errorf("expected ended renditions not to hold back the live edge: %s", m3u8)
+	}
+}
+
+func TestService_WaitForPlaylist_aligned(t *testing.T) {
+	repo := NewInMemoryRepository()
+	svc := NewServiceWithConfig(repo, ServiceConfig{WindowSize: 6, BlockingReloadTimeout: 2 * time.Second})
+	_ = svc.UpdateStreamSettings("s1", StreamSettings{Aligned: true})
+	registerRange(svc, "720p", 1, 2)
+	registerRange(svc, "480p", 1, 1)
+
+	msn := int64(2)
+	done := make(chan string, 1)
+	go func() {
+		m3u8, err := svc.WaitForPlaylist(context.Background(), "s1", "720p", PlaylistRequest{MSN: &msn})
+		if err != nil {
+			t.Errorf("WaitForPlaylist: %v", err)
+		}
+		done <- m3u8
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("WaitForPlaylist returned before 480p reached segment 2")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	registerRange(svc, "480p", 2, 2)
+	select {
+	case m3u8 := <-done:
+		if strings.Count(m3u8, "#EXTINF") != 2 {
+			t.Errorf("expected segment 2 in playlist: %s", m3u8)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitForPlaylist not woken by another rendition")
+	}
+}
+
+func TestService_GetAlignment(t *testing.T) {
+	svc := NewService(NewInMemoryRepository(), 6)
+	registerRange(svc, "720p", 1, 5)
+	registerRange(svc, "480p", 1, 3)
+	_ = svc.RegisterSegment("s1", "360p", Segment{Sequence: 1, Duration: 2.0, Path: "/360p/1.ts"})
+	_ = svc.RegisterSegment("s1", "360p", Segment{Sequence: 2, Duration: 2.5, Path: "/360p/2.ts"})
+
+	if _, ok := svc.GetAlignment("missing"); ok {
+		t.Error("expected ok false for a missing stream")
+	}
+
+	report, ok := svc.GetAlignment("s1")
+	if !ok {
+		t.Fatal("GetAlignment: ok false")
+	}
+	if report.LiveEdge == nil || *report.LiveEdge != 5 || report.CommonEdge == nil || *report.CommonEdge != 2 {
+		t.Errorf("expected live edge 5 and common edge 2, got %v and %v", report.LiveEdge, report.CommonEdge)
+	}
+	lags := map[RenditionID]int64{}
+	for _, r := range report.Renditions {
+		lags[r.ID] = r.Lag
+	}
+	if lags["720p"] != 0 || lags["480p"] != 2 || lags["360p"] != 3 {
+		t.Errorf("expected lags 0, 2 and 3, got %v", lags)
+	}
+	if len(report.Mismatches) != 1 || report.Mismatches[0].Sequence != 2 || report.Mismatches[0].Durations["360p"] != 2.5 {
+		t.Errorf("expected a duration mismatch at sequence 2, got %+v", report.Mismatches)
+	}
+}
+
+func TestService_GetPlaylist_aligned_per_type(t *testing.T) {
+	svc := NewService(NewInMemoryRepository(), 6)
+	_ = svc.UpdateStreamSettings("s1", StreamSettings{Aligned: true})
+	if err := svc.RegisterRendition("s1", "en", RenditionInfo{Type: MediaTypeAudio, GroupID: "aud", Name: "English"}); err != nil {
+		t.Fatalf("RegisterRendition: %v", err)
+	}
+	registerRange(svc, "720p", 1, 5)
+	registerRange(svc, "480p", 1, 4)
+	registerRange(svc, "en", 1, 2)
+
+	m3u8, _ := svc.GetPlaylist("s1", "720p")
+	if strings.Count(m3u8, "#EXTINF") != 4 {
+		t.Errorf("expected video capped at 480p's sequence 4, not held back by audio: %s", m3u8)
+	}
+	m3u8, _ = svc.GetPlaylist("s1", "en")
+	if strings.Count(m3u8, "#EXTINF") != 2 {
+		t.Errorf("expected audio at its own edge: %s", m3u8)
+	}
+
+	report, _ := svc.GetAlignment("s1")
+	for _, r := range report.Renditions {
+		want := map[RenditionID]int64{"720p": 4, "480p": 4, "en": 2}[r.ID]
+		if r.CommonEdge == nil || *r.CommonEdge != want {
+			t.Errorf("%s: expected common edge %d, got %v", r.ID, want, r.CommonEdge)
+		}
+		if r.ID == "en" && (r.Type != MediaTypeAudio || r.Lag != 0) {
+			t.Errorf("en: expected an AUDIO rendition without lag, got %+v", r)
+		}
+	}
+}
+
+func TestService_GetPlaylist_aligned_gap_policy(t *testing.T) {
+	start := time.Now()
+	repo := NewInMemoryRepository()
+	repo.now = func() time.Time { return start }
+	svc := NewServiceWithConfig(repo, ServiceConfig{WindowSize: 6, GapTimeout: 3 * time.Second})
+	_ = svc.UpdateStreamSettings("s1", StreamSettings{Aligned: true, GapPolicy: GapPolicySkip})
+	registerRange(svc, "720p", 1, 5)
+	registerRange(svc, "480p", 1, 2)
+	registerRange(svc, "480p", 4, 5)
+
+	svc.now = func() time.Time { return start.Add(time.Second) }
+	m3u8, _ := svc.GetPlaylist("s1", "720p")
+	if strings.Count(m3u8, "#EXTINF") != 2 {
+		t.Errorf("expected the live edge held at 480p's hole before the gap timeout: %s", m3u8)
+	}
+
+	svc.now = func() time.Time { return start.Add(5 * time.Second) }
+	m3u8, _ = svc.GetPlaylist("s1", "720p")
+	if !strings.Contains(m3u8, "/720p/5.ts") {
+		t.Errorf("expected the skipped hole not to hold back the live edge: %s", m3u8)
+	}
+	report, _ := svc.GetAlignment("s1")
+	if report.CommonEdge == nil || *report.CommonEdge != 5 {
+		t.Errorf("expected common edge 5, got %v", report.CommonEdge)
+	}
+}
@@ -0,0 +1,286 @@
+package orchestrator
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CueType is the direction of an ad break signal.
+type CueType string
+
+const (
+	CueOut CueType = "out" // start of a break (leaving the network feed)
+	CueIn  CueType = "in"  // end of a break (returning to the network feed)
+)
+
+// CueFormat selects the tags a stream's media playlists use for cues.
+type CueFormat string
+
+const (
+	// CueFormatDateRange emits #EXT-X-DATERANGE with SCTE35-OUT/IN.
+	CueFormatDateRange CueFormat = "daterange"
+
+	// CueFormatLegacy emits #EXT-X-CUE-OUT / #EXT-X-CUE-IN.
+	CueFormatLegacy CueFormat = "legacy"
+
+	// CueFormatBoth emits both styles of tags.
+	CueFormatBoth CueFormat = "both"
+)
+
+// ErrInvalidSCTE35 is returned for SCTE-35 payloads that cannot be used to
+// derive a cue.
+var ErrInvalidSCTE35 = errors.New("invalid scte35 payload")
+
+// Cue is an ad break signal attached to the segment with the given media
+// sequence number in every rendition of a stream.
+// This also matches the input JSON payload for registering cues.
+type Cue struct {
+	// ID pairs an out cue with its in cue. If omitted, an out cue gets an ID
+	// from its splice event or sequence number and an in cue takes the ID of
+	// the latest unmatched out cue.
+	ID       string  `json:"id,omitempty"`
+	Type     CueType `json:"type,omitempty"`
+	Sequence int64   `json:"sequence"`
+	Duration float64 `json:"duration,omitempty"` // planned break duration in seconds (out cues)
+	SCTE35   []byte  `json:"scte35,omitempty"`   // splice_info_section, base64 in JSON
+}
+
+// normalize fills the omitted Type, Duration and ID of c from its SCTE-35
+// splice_insert command and reports the first invalid field, if any.
+func (c *Cue) normalize() error {
+	if len(c.SCTE35) > 0 && c.Type == "" {
+		si, err := parseSpliceInsert(c.SCTE35)
+		if err != nil {
+			return err
+		}
+		if si.Cancel {
+			return fmt.Errorf("%w: splice event %d is cancelled", ErrInvalidSCTE35, si.EventID)
+		}
+		c.Type = CueIn
+		if si.OutOfNetwork {
+			c.Type = CueOut
+		}
+		if c.Duration == 0 {
+			c.Duration = si.BreakDuration
+		}
+		if c.ID == "" && c.Type == CueOut {
+			c.ID = fmt.Sprintf("splice-%d", si.EventID)
+		}
+	}
+
+	switch c.Type {
+	case CueOut, CueIn:
+	case "":
+		return fmt.Errorf("type or scte35 is required")
+	default:
+		return fmt.Errorf("unknown cue type %q", c.Type)
+	}
+	if c.Sequence < 0 {
+		return fmt.Errorf("sequence must not be negative")
+	}
+	if c.Duration < 0 {
+		return fmt.Errorf("duration must not be negative")
+	}
+	return nil
+}
+
+// valid reports whether f is empty (the default) or a known cue format.
+func (f CueFormat) valid() bool {
+	switch f {
+	case "", CueFormatDateRange, CueFormatLegacy, CueFormatBoth:
+		return true
+	}
+	return false
+}
+
+// CueMarker is a Cue resolved against the wall clock of a media playlist.
+type CueMarker struct {
+	Cue
+	StartDate time.Time // start of the break: the out cue's segment
+	EndDate   time.Time // in cues only: end of the break
+}
+
+// cueMarkers resolves the cues of snap that apply to segments in window. Cues
+// on segments without a program date time are dropped.
+func cueMarkers(snap RenditionSnapshot, window []Segment) []CueMarker {
+	if len(snap.Cues) == 0 || len(window) == 0 {
+		return nil
+	}
+	pdt := func(seq int64) (time.Time, bool) {
+		for _, segs := range [][]Segment{window, snap.Segments} {
+			for _, seg := range segs {
+				if seg.Sequence == seq && seg.ProgramDateTime != nil {
+					return *seg.ProgramDateTime, true
+				}
+			}
+		}
+		return time.Time{}, false
+	}
+
+	first, last := window[0].Sequence, window[len(window)-1].Sequence
+	var markers []CueMarker
+	for _, cue := range snap.Cues {
+		if cue.Sequence < first || cue.Sequence > last {
+			continue
+		}
+		at, ok := pdt(cue.Sequence)
+		if !ok {
+			continue
+		}
+		m := CueMarker{Cue: cue, StartDate: at}
+		if cue.Type == CueIn {
+			// An in cue repeats the START-DATE of its out cue.
+			m.EndDate = at
+			if out, ok := findCue(snap.Cues, cue.ID, CueOut); ok {
+				if start, ok := pdt(out.Sequence); ok {
+					m.StartDate = start
+				} else {
+					m.StartDate = at.Add(-seconds(out.Duration))
+				}
+			}
+		}
+		markers = append(markers, m)
+	}
+	return markers
+}
+
+// findCue returns the cue of the given ID and type.
+func findCue(cues []Cue, id string, typ CueType) (Cue, bool) {
+	for _, cue := range cues {
+		if cue.ID == id && cue.Type == typ {
+			return cue, true
+		}
+	}
+	return Cue{}, false
+}
+
+// writeCues writes the tags of the markers on the segment with the given
+// sequence number.
+func writeCues(b *strings.Builder, markers []CueMarker, seq int64, format CueFormat) {
+	for _, m := range markers {
+		if m.Sequence != seq {
+			continue
+		}
+		if format != CueFormatLegacy {
+			b.WriteString("#EXT-X-DATERANGE:" + dateRangeAttributes(m) + "\n")
+		}
+		if format == CueFormatLegacy || format == CueFormatBoth {
+			switch {
+			case m.Type == CueIn:
+				b.WriteString("#EXT-X-CUE-IN\n")
+			case m.Duration > 0:
+				b.WriteString(fmt.Sprintf("#EXT-X-CUE-OUT:DURATION=%.3f\n", m.Duration))
+			default:
+				b.WriteString("#EXT-X-CUE-OUT\n")
+			}
+		}
+	}
+}
+
+// dateRangeAttributes formats the attribute list of an #EXT-X-DATERANGE tag.
+func dateRangeAttributes(m CueMarker) string {
+	attrs := []string{
+		fmt.Sprintf("ID=%q", m.ID),
+		fmt.Sprintf("START-DATE=%q", m.StartDate.UTC().Format(programDateTimeLayout)),
+	}
+	if m.Type == CueIn {
+		attrs = append(attrs,
+			fmt.Sprintf("END-DATE=%q", m.EndDate.UTC().Format(programDateTimeLayout)),
+			fmt.Sprintf("DURATION=%.3f", m.EndDate.Sub(m.StartDate).Seconds()))
+	} else if m.Duration > 0 {
+		attrs = append(attrs, fmt.Sprintf("PLANNED-DURATION=%.3f", m.Duration))
+	}
+	if len(m.SCTE35) > 0 {
+		name := "SCTE35-OUT"
+		if m.Type == CueIn {
+			name = "SCTE35-IN"
+		}
+		attrs = append(attrs, name+"=0x"+strings.ToUpper(hex.EncodeToString(m.SCTE35)))
+	}
+	return strings.Join(attrs, ",")
+}
+
+// spliceInsert holds the fields of an SCTE-35 splice_insert command that
+// drive cue output.
+type spliceInsert struct {
+	EventID       uint32
+	Cancel        bool
+	OutOfNetwork  bool
+	BreakDuration float64 // seconds; 0 if the command carries no break_duration
+}
+
+// parseSpliceInsert decodes the splice_insert command of an unencrypted
+// SCTE-35 splice_info_section (SCTE 35 section 9.7.3).
+func parseSpliceInsert(b []byte) (si spliceInsert, err error) {
+	short := fmt.Errorf("%w: truncated splice_insert", ErrInvalidSCTE35)
+	if len(b) < 14 || b[0] != 0xFC {
+		return si, fmt.Errorf("%w: not a splice_info_section", ErrInvalidSCTE35)
+	}
+	if b[4]&0x80 != 0 {
+		return si, fmt.Errorf("%w: encrypted packets are not supported", ErrInvalidSCTE35)
+	}
+	if b[13] != 0x05 {
+		return si, fmt.Errorf("%w: splice command 0x%02x is not splice_insert", ErrInvalidSCTE35, b[13])
+	}
+
+	c := b[14:]
+	if len(c) < 5 {
+		return si, short
+	}
+	si.EventID = binary.BigEndian.Uint32(c)
+	si.Cancel = c[4]&0x80 != 0
+	if si.Cancel {
+		return si, nil
+	}
+	if len(c) < 6 {
+		return si, short
+	}
+	flags := c[5]
+	si.OutOfNetwork = flags&0x80 != 0
+	programSplice := flags&0x40 != 0
+	hasDuration := flags&0x20 != 0
+	immediate := flags&0x10 != 0
+
+	p := 6
+	// splice_time() is 5 bytes with time_specified_flag set, else 1.
+	skipSpliceTime := func() bool {
+		if p >= len(c) {
+			return false
+		}
+		if c[p]&0x80 != 0 {
+			p += 5
+		} else {
+			p++
+		}
+		return true
+	}
+	if programSplice {
+		if !immediate && !skipSpliceTime() {
+			return si, short
+		}
+	} else {
+		if p >= len(c) {
+			return si, short
+		}
+		components := int(c[p])
+		p++
+		for i := 0; i < components; i++ {
+			p++ // component_tag
+			if !immediate && !skipSpliceTime() {
+				return si, short
+			}
+		}
+	}
+	if hasDuration {
+		if p+5 > len(c) {
+			return si, short
+		}
+		ticks := uint64(c[p]&0x01)<<32 | uint64(binary.BigEndian.Uint32(c[p+1:]))
+		si.BreakDuration = float64(ticks) / 90000
+	}
+	return si, nil
+}
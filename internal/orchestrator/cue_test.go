@@ -0,0 +1,110 @@
+package orchestrator
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// spliceInsertSection returns an SCTE-35 splice_info_section carrying a
+// program splice_insert with a splice time and, if duration > 0, a break
+// duration.
+func spliceInsertSection(eventID byte, out bool, duration float64) []byte {
+	flags := byte(0x4F) // program_splice_flag, event_id_compliance_flag, reserved
+	if out {
+		flags |= 0x80
+	}
+	cmd := []byte{0x00, 0x00, 0x00, eventID, 0x7F, flags, 0xFE, 0x00, 0x00, 0x00, 0x00}
+	if duration > 0 {
+		cmd[5] |= 0x20
+		ticks := uint32(duration * 90000)
+		cmd = append(cmd, 0xFE, byte(ticks>>24), byte(ticks>>16), byte(ticks>>8), byte(ticks))
+	}
+	cmd = append(cmd, 0x00, 0x01, 0x00, 0x00)
+	header := []byte{0xFC, 0x30, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xFF, 0xF0, byte(len(cmd)), 0x05}
+	return append(header, cmd...)
+}
+
+func TestParseSpliceInsert(t *testing.T) {
+	si, err := parseSpliceInsert(spliceInsertSection(42, true, 30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si.EventID != 42 || !si.OutOfNetwork || si.Cancel || si.BreakDuration != 30 {
+		t.Errorf("unexpected splice_insert: %+v", si)
+	}
+
+	si, err = parseSpliceInsert(spliceInsertSection(42, false, 0))
+	if err != nil || si.OutOfNetwork || si.BreakDuration != 0 {
+		t.Errorf("expected return to network without duration, got %+v err=%v", si, err)
+	}
+
+	timeSignal := spliceInsertSection(42, true, 0)
+	timeSignal[13] = 0x06
+	truncated := spliceInsertSection(42, true, 30)
+	for name, b := range map[string][]byte{
+		"not scte35":  []byte("hello, world, not scte35"),
+		"time_signal": timeSignal,
+		"truncated":   truncated[:len(truncated)-8],
+	} {
+		if _, err := parseSpliceInsert(b); !errors.Is(err, ErrInvalidSCTE35) {
+			t.Errorf("%s: expected ErrInvalidSCTE35, got %v", name, err)
+		}
+	}
+}
+
+func TestCue_normalize(t *testing.T) {
+	cue := Cue{Sequence: 10, SCTE35: spliceInsertSection(7, true, 30)}
+	if err := cue.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	if cue.Type != CueOut || cue.Duration != 30 || cue.ID != "splice-7" {
+		t.Errorf("expected fields derived from SCTE-35, got %+v", cue)
+	}
+
+	for _, bad := range []Cue{
+		{Sequence: 1},
+		{Sequence: 1, Type: "pause"},
+		{Sequence: -1, Type: CueOut},
+		{Sequence: 1, Type: CueOut, Duration: -5},
+		{Sequence: 1, SCTE35: []byte{0x00}},
+	} {
+		if err := bad.normalize(); err == nil {
+			t.Errorf("expected error for %+v", bad)
+		}
+	}
+}
+
+func TestService_GetPlaylist_cues(t *testing.T) {
+	repo := NewInMemoryRepository()
+	repo.now = func() time.Time { return time.Date(2026, 1, 1, 0, 0, 20, 0, time.UTC) }
+	svc := NewService(repo, 6)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts", ProgramDateTime: &start})
+	for i := int64(2); i <= 5; i++ {
+		_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: i, Duration: 2.0, Path: "/x.ts"})
+	}
+	out := Cue{Type: CueOut, Sequence: 2, Duration: 4, SCTE35: []byte{0xFC, 0x01}}
+	if err := svc.RegisterCue("s1", out); err != nil {
+		t.Fatal(err)
+	}
+	_ = svc.RegisterCue("s1", Cue{Type: CueIn, Sequence: 4})
+	_ = svc.RegisterCue("s1", out) // duplicate
+
+	m3u8, _ := svc.GetPlaylist("s1", "720p")
+	wantOut := `#EXT-X-DATERANGE:ID="cue-2",START-DATE="2026-01-01T00:00:02.000Z",PLANNED-DURATION=4.000,SCTE35-OUT=0xFC01` + "\n#EXTINF:2.0,"
+	wantIn := `#EXT-X-DATERANGE:ID="cue-2",START-DATE="2026-01-01T00:00:02.000Z",END-DATE="2026-01-01T00:00:06.000Z",DURATION=4.000` + "\n#EXTINF:2.0,"
+	if strings.Count(m3u8, "#EXT-X-DATERANGE") != 2 || !strings.Contains(m3u8, wantOut) || !strings.Contains(m3u8, wantIn) {
+		t.Errorf("expected paired DATERANGE tags: %s", m3u8)
+	}
+	if strings.Contains(m3u8, "#EXT-X-CUE") {
+		t.Errorf("expected no legacy cue tags by default: %s", m3u8)
+	}
+
+	_ = svc.UpdateStreamSettings("s1", StreamSettings{CueFormat: CueFormatLegacy})
+	m3u8, _ = svc.GetPlaylist("s1", "720p")
+	if strings.Contains(m3u8, "#EXT-X-DATERANGE") || !strings.Contains(m3u8, "#EXT-X-CUE-OUT:DURATION=4.000\n") || !strings.Contains(m3u8, "#EXT-X-CUE-IN\n") {
+		t.Errorf("expected only legacy cue tags: %s", m3u8)
+	}
+}
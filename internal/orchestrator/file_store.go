@@ -0,0 +1,234 @@
+package orchestrator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// DefaultSnapshotEvery is the default number of journaled ops between two
+// FileStore snapshots.
+const DefaultSnapshotEvery = 1000
+
+const (
+	fileStoreSnapshotName = "snapshot.gob"
+	fileStoreJournalName  = "journal.log"
+)
+
+// FileStore is a durable Store backed by a directory on local disk. Stream
+// state is kept in memory; every mutation is appended to a JSON-lines journal
+// and the state is periodically written to a snapshot, after which the journal
+// is truncated. After a restart, OpenFileStore loads the snapshot and
+// InMemoryRepository.Restore replays the journal on top of it.
+type FileStore struct {
+	*InMemoryStore
+
+	dir           string
+	snapshotEvery int
+	journal       *os.File
+
+	index         uint64 // index of the last appended op
+	snapshotIndex uint64 // index of the last op reflected in the snapshot
+	sinceSnapshot int
+	pending       []Op // journaled ops not yet replayed
+}
+
+// fileSnapshot is the on-disk snapshot format.
+type fileSnapshot struct {
+	Index   uint64
+	Streams map[StreamID]*StreamState
+}
+
+// OpenFileStore opens the file store in dir, creating the directory if
+// needed, and loads its snapshot and journal. A snapshot is written every
+// snapshotEvery journaled ops; if snapshotEvery <= 0, DefaultSnapshotEvery is
+// used. The caller must call InMemoryRepository.Restore to apply the journal.
+func OpenFileStore(dir string, snapshotEvery int) (*FileStore, error) {
+	if snapshotEvery <= 0 {
+		snapshotEvery = DefaultSnapshotEvery
+	}
+	// The journal and snapshot hold content keys, so only the owner may
+	// read them.
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create store dir: %w", err)
+	}
+
+	fs := &FileStore{
+		InMemoryStore: NewInMemoryStore(),
+		dir:           dir,
+		snapshotEvery: snapshotEvery,
+	}
+	if err := fs.loadSnapshot(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, fileStoreJournalName), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open journal: %w", err)
+	}
+	// Journals created with wider permissions are tightened too.
+	if err := f.Chmod(0o600); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("open journal: %w", err)
+	}
+	fs.journal = f
+	if err := fs.loadJournal(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+// Append implements Journal.Append.
+func (fs *FileStore) Append(op Op) error {
+	op.Index = fs.index + 1
+	line, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.journal.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := fs.journal.Sync(); err != nil {
+		return err
+	}
+	fs.index = op.Index
+	fs.sinceSnapshot++
+	return nil
+}
+
+// Replay implements Journal.Replay.
+func (fs *FileStore) Replay(apply func(op Op) error) error {
+	pending := fs.pending
+	fs.pending = nil
+	for _, op := range pending {
+		if err := apply(op); err != nil {
+			return fmt.Errorf("replay op %d: %w", op.Index, err)
+		}
+	}
+	return nil
+}
+
+// Checkpoint implements Journal.Checkpoint. It writes a snapshot once
+// snapshotEvery ops have been journaled since the previous one.
+func (fs *FileStore) Checkpoint() error {
+	if fs.sinceSnapshot < fs.snapshotEvery {
+		return nil
+	}
+	return fs.snapshot()
+}
+
+// Close writes a final snapshot and closes the journal. The store must not be
+// used afterwards, and no repository using it may be mutating concurrently.
+func (fs *FileStore) Close() error {
+	var err error
+	if fs.sinceSnapshot > 0 {
+		err = fs.snapshot()
+	}
+	if cerr := fs.journal.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// snapshot atomically replaces the snapshot file with the current state and
+// truncates the journal. A crash between the two steps is harmless: journal
+// ops already covered by the snapshot are skipped on load.
+func (fs *FileStore) snapshot() error {
+	path := filepath.Join(fs.dir, fileStoreSnapshotName)
+	tmp := path + ".tmp"
+
+	os.Remove(tmp) // a leftover file would keep its permissions
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("create snapshot: %w", err)
+	}
+	err = gob.NewEncoder(f).Encode(fileSnapshot{Index: fs.index, Streams: fs.streams})
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+
+	fs.snapshotIndex = fs.index
+	fs.sinceSnapshot = 0
+	if err := fs.journal.Truncate(0); err != nil {
+		return fmt.Errorf("truncate journal: %w", err)
+	}
+	return nil
+}
+
+// loadSnapshot reads the snapshot file, if present, into the store.
+func (fs *FileStore) loadSnapshot() error {
+	f, err := os.Open(filepath.Join(fs.dir, fileStoreSnapshotName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open snapshot: %w", err)
+	}
+	defer f.Close()
+
+	var snap fileSnapshot
+	if err := gob.NewDecoder(f).Decode(&snap); err != nil {
+		return fmt.Errorf("read snapshot: %w", err)
+	}
+	if snap.Streams != nil {
+		for _, st := range snap.Streams {
+			initStreamMaps(st)
+		}
+		fs.streams = snap.Streams
+	}
+	fs.index = snap.Index
+	fs.snapshotIndex = snap.Index
+	return nil
+}
+
+// loadJournal reads the journal into fs.pending, skipping ops already covered
+// by the snapshot. A torn final line left by a crash mid-write is truncated.
+func (fs *FileStore) loadJournal() error {
+	r := bufio.NewReader(fs.journal)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				// Incomplete last record: drop it.
+				if err := fs.journal.Truncate(offset); err != nil {
+					return fmt.Errorf("truncate journal: %w", err)
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read journal: %w", err)
+		}
+
+		var op Op
+		if err := json.Unmarshal(line, &op); err != nil {
+			return fmt.Errorf("read journal at offset %d: %w", offset, err)
+		}
+		offset += int64(len(line))
+
+		if op.Index <= fs.snapshotIndex {
+			continue
+		}
+		fs.pending = append(fs.pending, op)
+		fs.index = op.Index
+		fs.sinceSnapshot++
+	}
+}
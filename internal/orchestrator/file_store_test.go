@@ -0,0 +1,193 @@
+package orchestrator
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openFileRepo opens a file store in dir and restores a repository from it.
+func openFileRepo(t *testing.T, dir string, snapshotEvery int) (*FileStore, *InMemoryRepository) {
+	t.Helper()
+	fs, err := OpenFileStore(dir, snapshotEvery)
+	if err != nil {
+		t.Fatalf("OpenFileStore: %v", err)
+	}
+	repo := NewInMemoryRepositoryWithStore(fs)
+	if err := repo.Restore(); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	return fs, repo
+}
+
+func TestFileStore_recovers_from_journal(t *testing.T) {
+	dir := t.TempDir()
+	_, repo := openFileRepo(t, dir, 100)
+
+	_ = repo.RegisterRendition("s1", "720p", RenditionInfo{Bandwidth: 2800000})
+	_ = repo.UpdateStreamSettings("s1", StreamSettings{GapPolicy: GapPolicySkip, GapTimeout: 4})
+	_ = repo.RegisterPart("s1", "720p", PartialSegment{Sequence: 1, Index: 0, Duration: 1.0, URI: "/1.0.ts"})
+	_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+	_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: 2, Duration: 2.0, Path: "/2.ts"})
+	_ = repo.RegisterSegment("s2", "480p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+	_ = repo.EndStream("s2")
+	before, _ := repo.GetRendition("s1", "720p")
+
+	// Simulate a crash: reopen without closing (no final snapshot).
+	_, recovered := openFileRepo(t, dir, 100)
+
+	after, ok := recovered.GetRendition("s1", "720p")
+	if !ok || len(after.Segments) != 2 {
+		t.Fatalf("expected 2 recovered segments, got ok=%v %v", ok, after.Segments)
+	}
+	if len(after.Segments[0].Parts) != 1 {
+		t.Errorf("expected recovered part folded into segment 1, got %v", after.Segments[0].Parts)
+	}
+	if after.Settings.GapPolicy != GapPolicySkip || after.Settings.GapTimeout != 4 {
+		t.Errorf("expected recovered stream settings, got %+v", after.Settings)
+	}
+	if !after.Segments[1].ReceivedAt.Equal(before.Segments[1].ReceivedAt) {
+		t.Errorf("expected ReceivedAt preserved, got %v want %v", after.Segments[1].ReceivedAt, before.Segments[1].ReceivedAt)
+	}
+	renditions, _ := recovered.ListRenditions("s1")
+	if len(renditions) != 1 || renditions[0].Info.Bandwidth != 2800000 {
+		t.Errorf("expected recovered rendition info, got %v", renditions)
+	}
+	if _, ended, _ := recovered.GetRenditionSnapshot("s2", "480p"); !ended {
+		t.Error("expected s2 to stay ended after recovery")
+	}
+}
+
+func TestFileStore_snapshot_truncates_journal(t *testing.T) {
+	dir := t.TempDir()
+	_, repo := openFileRepo(t, dir, 3)
+
+	for i := int64(1); i <= 4; i++ {
+		_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: i, Duration: 2.0, Path: "/x.ts"})
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, fileStoreSnapshotName)); err != nil {
+		t.Fatalf("expected snapshot after 3 ops: %v", err)
+	}
+	journal, _ := os.ReadFile(filepath.Join(dir, fileStoreJournalName))
+	if n := bytes.Count(journal, []byte("\n")); n != 1 {
+		t.Errorf("expected 1 op journaled since the snapshot, got %d", n)
+	}
+
+	_, recovered := openFileRepo(t, dir, 3)
+	segs, _, _ := recovered.GetRenditionSnapshot("s1", "720p")
+	if len(segs) != 4 {
+		t.Errorf("expected 4 segments from snapshot plus journal, got %d", len(segs))
+	}
+
+	// Further writes continue the op index after recovery.
+	_ = recovered.RegisterSegment("s1", "720p", Segment{Sequence: 5, Duration: 2.0, Path: "/x.ts"})
+	_, again := openFileRepo(t, dir, 3)
+	segs, _, _ = again.GetRenditionSnapshot("s1", "720p")
+	if len(segs) != 5 {
+		t.Errorf("expected 5 segments after second recovery, got %d", len(segs))
+	}
+}
+
+func TestFileStore_close_writes_snapshot(t *testing.T) {
+	dir := t.TempDir()
+	fs, repo := openFileRepo(t, dir, 100)
+	_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	journal, _ := os.ReadFile(filepath.Join(dir, fileStoreJournalName))
+	if len(journal) != 0 {
+		t.Errorf("expected empty journal after Close, got %q", journal)
+	}
+	// The files hold content keys.
+	for _, name := range []string{fileStoreJournalName, fileStoreSnapshotName} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Stat %s: %v", name, err)
+		}
+		if fi.Mode().Perm() != 0o600 {
+			t.Errorf("expected %s to be private, got %v", name, fi.Mode().Perm())
+		}
+	}
+	_, recovered := openFileRepo(t, dir, 100)
+	if segs, _, ok := recovered.GetRenditionSnapshot("s1", "720p"); !ok || len(segs) != 1 {
+		t.Errorf("expected segment from snapshot, got ok=%v len=%d", ok, len(segs))
+	}
+	// State loaded from a snapshot must be writable.
+	if err := recovered.RegisterPart("s1", "720p", PartialSegment{Sequence: 2, Index: 0, Duration: 1.0, URI: "/2.0.ts"}); err != nil {
+		t.Errorf("RegisterPart after snapshot load: %v", err)
+	}
+}
+
+func TestFileStore_torn_journal_tail(t *testing.T) {
+	dir := t.TempDir()
+	_, repo := openFileRepo(t, dir, 100)
+	_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+
+	// Simulate a crash in the middle of writing the next record.
+	f, _ := os.OpenFile(filepath.Join(dir, fileStoreJournalName), os.O_APPEND|os.O_WRONLY, 0o644)
+	f.WriteString(`{"index":2,"kind":"register_seg`)
+	f.Close()
+
+	_, recovered := openFileRepo(t, dir, 100)
+	if segs, _, _ := recovered.GetRenditionSnapshot("s1", "720p"); len(segs) != 1 {
+		t.Errorf("expected 1 segment, got %d", len(segs))
+	}
+	_ = recovered.RegisterSegment("s1", "720p", Segment{Sequence: 2, Duration: 2.0, Path: "/2.ts"})
+
+	_, again := openFileRepo(t, dir, 100)
+	if segs, _, _ := again.GetRenditionSnapshot("s1", "720p"); len(segs) != 2 {
+		t.Errorf("expected torn record dropped and new one kept, got %d segments", len(segs))
+	}
+}
+
+func TestFileStore_recovers_keys(t *testing.T) {
+	dir := t.TempDir()
+	_, repo := openFileRepo(t, dir, 100)
+	svc := NewService(repo, 6)
+	_ = svc.UpdateStreamSettings("s1", StreamSettings{Encryption: EncryptionAES128})
+	key, _ := svc.IssueKey("s1", 0)
+
+	_, recovered := openFileRepo(t, dir, 100)
+	if got, ok := recovered.GetKey("s1", 0); !ok || !sameKey(got, key) {
+		t.Errorf("expected the key recovered from the journal, got ok=%v %+v", ok, got)
+	}
+}
+
+func TestFileStore_restore_does_not_replay_hooks(t *testing.T) {
+	dir := t.TempDir()
+	var evicted, exceeded int
+	cfg := RepositoryConfig{
+		Retention:                RetentionPolicy{MaxSegments: 2},
+		TargetDuration:           2,
+		OnEvict:                  func(n int) { evicted += n },
+		OnTargetDurationExceeded: func(StreamID, RenditionID, Segment, int) { exceeded++ },
+	}
+	open := func() *InMemoryRepository {
+		fs, err := OpenFileStore(dir, 100)
+		if err != nil {
+			t.Fatalf("OpenFileStore: %v", err)
+		}
+		repo := NewInMemoryRepositoryWithConfig(fs, cfg)
+		if err := repo.Restore(); err != nil {
+			t.Fatalf("Restore: %v", err)
+		}
+		return repo
+	}
+
+	repo := open()
+	for seq := int64(1); seq <= 4; seq++ {
+		_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: seq, Duration: 3.0, Path: "/x.ts"})
+	}
+	if evicted != 2 || exceeded != 4 {
+		t.Fatalf("expected 2 evictions and 4 violations, got %d and %d", evicted, exceeded)
+	}
+
+	open()
+	if evicted != 2 || exceeded != 4 {
+		t.Errorf("expected hooks not to fire on restore, got %d evictions and %d violations", evicted, exceeded)
+	}
+}
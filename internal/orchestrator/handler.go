@@ -1,9 +1,14 @@
 package orchestrator
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"hls-orchestrator/internal/platform/metrics"
 
@@ -17,16 +22,48 @@ type Handler struct {
 	svc     *Service
 	log     *slog.Logger
 	metrics *metrics.Metrics
+	cfg     HandlerConfig
+}
+
+// HandlerConfig holds Handler settings.
+type HandlerConfig struct {
+	// KeyToken is the bearer token the packager uses to issue and import
+	// keys. If empty, issuing and importing keys is disabled.
+	KeyToken string
+
+	// PlayerKeyToken is the bearer token players use to fetch keys. It must
+	// differ from KeyToken so that viewers cannot import keys. If empty,
+	// fetching keys is disabled.
+	PlayerKeyToken string
+
+	// MaxSegmentDuration is the target duration, in seconds, that registered
+	// segments must not exceed (after rounding). 0 disables the check.
+	MaxSegmentDuration int
+
+	// MaxBodyBytes limits the size of segment registration and stream
+	// creation bodies. It defaults to DefaultMaxBodyBytes.
+	MaxBodyBytes int64
 }
 
 // NewHandler returns a Handler that uses the given Service, Logger, and optional Metrics.
 // Metrics may be nil to disable metric recording (e.g. in tests).
 func NewHandler(svc *Service, log *slog.Logger, m *metrics.Metrics) *Handler {
-	return &Handler{svc: svc, log: log, metrics: m}
+	return NewHandlerWithConfig(svc, log, m, HandlerConfig{})
+}
+
+// NewHandlerWithConfig returns a Handler like NewHandler with the given settings.
+func NewHandlerWithConfig(svc *Service, log *slog.Logger, m *metrics.Metrics, cfg HandlerConfig) *Handler {
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	return &Handler{svc: svc, log: log, metrics: m, cfg: cfg}
 }
 
 // RegisterSegment handles POST /streams/{stream_id}/renditions/{rendition}/segments.
 // Body: { "sequence": 42, "duration": 2.0, "path": "/segments/42.ts" }.
+// Invalid requests get an application/problem+json body listing the invalid
+// fields. Re-registering a segment with the same payload returns 200; with a
+// different payload it returns 409 unless the stream lets the last writer win.
 func (h *Handler) RegisterSegment(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -37,34 +74,96 @@ func (h *Handler) RegisterSegment(w http.ResponseWriter, r *http.Request) {
 	renditionID := RenditionID(chi.URLParam(r, "rendition"))
 
 	if streamID == "" || renditionID == "" {
-		w.WriteHeader(http.StatusBadRequest)
+		writeProblem(w, http.StatusBadRequest, "stream_id and rendition are required")
 		return
 	}
 
 	var seg Segment
-	if err := json.NewDecoder(r.Body).Decode(&seg); err != nil {
-		h.log.Debug("invalid segment body", slog.String("error", err.Error()))
-		w.WriteHeader(http.StatusBadRequest)
+	if status, problem := decodeStrict(w, r, h.cfg.MaxBodyBytes, &seg, "sequence", "duration", "path"); problem != nil {
+		h.log.Debug("invalid segment body", slog.String("error", problem.Detail))
+		writeProblem(w, status, problem.Detail, problem.Errors...)
+		return
+	}
+	if errs := seg.validate(h.cfg.MaxSegmentDuration); len(errs) > 0 {
+		h.log.Debug("invalid segment body",
+			slog.String("stream_id", string(streamID)),
+			slog.String("rendition", string(renditionID)),
+			slog.Any("errors", errs))
+		writeProblem(w, http.StatusBadRequest, "segment has invalid fields", errs...)
 		return
 	}
 
-	if err := h.svc.RegisterSegment(streamID, renditionID, seg); err != nil {
+	outcome, err := h.svc.PutSegment(streamID, renditionID, seg)
+	if conflict, ok := err.(*SegmentConflictError); ok {
+		h.log.Warn("segment rejected conflicting duplicate",
+			slog.String("stream_id", string(streamID)),
+			slog.String("rendition", string(renditionID)),
+			slog.Int64("sequence", seg.Sequence),
+			slog.Any("existing", conflict.Existing),
+			slog.Any("received", conflict.Received))
+		if h.metrics != nil {
+			h.metrics.IncSegmentConflicts()
+		}
+		writeProblem(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
 		switch err {
+		case ErrByteRangeOverlap:
+			h.log.Info("segment rejected byte range overlap",
+				slog.String("stream_id", string(streamID)),
+				slog.String("rendition", string(renditionID)),
+				slog.Int64("sequence", seg.Sequence),
+				slog.String("path", seg.Path))
+			writeProblem(w, http.StatusConflict, err.Error(),
+				FieldError{Field: "byte_range_offset", Message: "overlaps another segment of the same path"})
+			return
+		case ErrTargetDurationExceeded:
+			h.log.Info("segment rejected target duration exceeded",
+				slog.String("stream_id", string(streamID)),
+				slog.String("rendition", string(renditionID)),
+				slog.Int64("sequence", seg.Sequence),
+				slog.Float64("duration", seg.Duration))
+			writeProblem(w, http.StatusBadRequest, err.Error(),
+				FieldError{Field: "duration", Message: "exceeds the target duration of the rendition"})
+			return
 		case ErrStreamEnded, ErrRenditionEnded:
 			h.log.Info("segment rejected stream or rendition ended",
 				slog.String("stream_id", string(streamID)),
 				slog.String("rendition", string(renditionID)),
 				slog.Int64("sequence", seg.Sequence),
 				slog.String("error", err.Error()))
-			w.WriteHeader(http.StatusConflict)
+			writeProblem(w, http.StatusConflict, err.Error())
 			return
 		default:
 			h.log.Error("register segment failed", slog.String("error", err.Error()))
-			w.WriteHeader(http.StatusInternalServerError)
+			writeProblem(w, http.StatusInternalServerError, "")
 			return
 		}
 	}
 
+	switch outcome {
+	case SegmentUnchanged:
+		h.log.Debug("segment already registered",
+			slog.String("stream_id", string(streamID)),
+			slog.String("rendition", string(renditionID)),
+			slog.Int64("sequence", seg.Sequence))
+		w.WriteHeader(http.StatusOK)
+		return
+	case SegmentReplaced:
+		h.log.Warn("segment replaced conflicting duplicate",
+			slog.String("stream_id", string(streamID)),
+			slog.String("rendition", string(renditionID)),
+			slog.Int64("sequence", seg.Sequence),
+			slog.Any("received", seg))
+		w.WriteHeader(http.StatusOK)
+		if h.metrics != nil {
+			h.metrics.IncSegmentConflicts()
+			h.metrics.IncSegmentsRegistered()
+		}
+		return
+	}
+
 	h.log.Debug("segment registered",
 		slog.String("stream_id", string(streamID)),
 		slog.String("rendition", string(renditionID)),
@@ -75,7 +174,86 @@ func (h *Handler) RegisterSegment(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// RegisterPart handles POST /streams/{stream_id}/renditions/{rendition}/segments/{sequence}/parts.
+// Body: { "index": 0, "duration": 0.333, "uri": "/segments/42.0.ts", "independent": true }.
+func (h *Handler) RegisterPart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamID := StreamID(chi.URLParam(r, "stream_id"))
+	renditionID := RenditionID(chi.URLParam(r, "rendition"))
+	sequence, err := strconv.ParseInt(chi.URLParam(r, "sequence"), 10, 64)
+
+	if streamID == "" || renditionID == "" {
+		writeProblem(w, http.StatusBadRequest, "stream_id and rendition are required")
+		return
+	}
+	if err != nil || sequence < 0 {
+		writeProblem(w, http.StatusBadRequest, "sequence must be a non-negative number")
+		return
+	}
+
+	var part PartialSegment
+	if status, problem := decodeStrict(w, r, h.cfg.MaxBodyBytes, &part, "index", "duration", "uri"); problem != nil {
+		h.log.Debug("invalid part body", slog.String("error", problem.Detail))
+		writeProblem(w, status, problem.Detail, problem.Errors...)
+		return
+	}
+	part.Sequence = sequence
+	if errs := part.validate(); len(errs) > 0 {
+		h.log.Debug("invalid part body",
+			slog.String("stream_id", string(streamID)),
+			slog.String("rendition", string(renditionID)),
+			slog.Any("errors", errs))
+		writeProblem(w, http.StatusBadRequest, "part has invalid fields", errs...)
+		return
+	}
+
+	if err := h.svc.RegisterPart(streamID, renditionID, part); err != nil {
+		switch err {
+		case ErrStreamEnded, ErrRenditionEnded, ErrSegmentComplete:
+			h.log.Info("part rejected",
+				slog.String("stream_id", string(streamID)),
+				slog.String("rendition", string(renditionID)),
+				slog.Int64("sequence", part.Sequence),
+				slog.Int("index", part.Index),
+				slog.String("error", err.Error()))
+			writeProblem(w, http.StatusConflict, err.Error())
+			return
+		case ErrPartTargetExceeded:
+			h.log.Info("part rejected part target exceeded",
+				slog.String("stream_id", string(streamID)),
+				slog.String("rendition", string(renditionID)),
+				slog.Int64("sequence", part.Sequence),
+				slog.Int("index", part.Index),
+				slog.Float64("duration", part.Duration))
+			writeProblem(w, http.StatusBadRequest, err.Error(),
+				FieldError{Field: "duration", Message: "exceeds the part target of the rendition"})
+			return
+		default:
+			h.log.Error("register part failed", slog.String("error", err.Error()))
+			writeProblem(w, http.StatusInternalServerError, "")
+			return
+		}
+	}
+
+	h.log.Debug("part registered",
+		slog.String("stream_id", string(streamID)),
+		slog.String("rendition", string(renditionID)),
+		slog.Int64("sequence", part.Sequence),
+		slog.Int("index", part.Index))
+	w.WriteHeader(http.StatusCreated)
+	if h.metrics != nil {
+		h.metrics.IncPartsRegistered()
+	}
+}
+
 // GetPlaylist handles GET /streams/{stream_id}/renditions/{rendition}/playlist.m3u8.
+// The optional _HLS_msn and _HLS_part query parameters request a blocking
+// playlist reload; 503 is returned if they are not satisfied in time. The
+// optional token query parameter is passed on to the key URIs.
 func (h *Handler) GetPlaylist(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -90,17 +268,347 @@ func (h *Handler) GetPlaylist(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	m3u8, ok := h.svc.GetPlaylist(streamID, renditionID)
+	req, err := parsePlaylistRequest(r)
+	if err != nil {
+		h.log.Debug("invalid playlist query", slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	m3u8, err := h.svc.WaitForPlaylist(r.Context(), streamID, renditionID, req)
+	if err != nil {
+		if h.storeUnavailable(w, err) {
+			return
+		}
+		switch err {
+		case ErrPlaylistNotFound:
+			w.WriteHeader(http.StatusNotFound)
+		case ErrInvalidDirective, ErrEventOverride:
+			w.WriteHeader(http.StatusBadRequest)
+		case ErrPlaylistTimeout:
+			h.log.Info("blocking playlist reload timed out",
+				slog.String("stream_id", string(streamID)),
+				slog.String("rendition", string(renditionID)))
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			h.log.Error("get playlist failed", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", playlistContentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(m3u8))
+}
+
+// storeUnavailable responds 503 if err is a failure to read the state store
+// and reports whether it did. Players retry a 503 but give up on a 404.
+func (h *Handler) storeUnavailable(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, ErrStoreUnavailable) {
+		return false
+	}
+	h.log.Error("state store unavailable", slog.String("error", err.Error()))
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	return true
+}
+
+// parsePlaylistRequest reads the _HLS_msn, _HLS_part, type and token query
+// parameters.
+func parsePlaylistRequest(r *http.Request) (PlaylistRequest, error) {
+	var req PlaylistRequest
+	q := r.URL.Query()
+	if v := q.Get("_HLS_msn"); v != "" {
+		msn, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || msn < 0 {
+			return req, ErrInvalidDirective
+		}
+		req.MSN = &msn
+	}
+	if v := q.Get("_HLS_part"); v != "" {
+		part, err := strconv.Atoi(v)
+		if err != nil || part < 0 {
+			return req, ErrInvalidDirective
+		}
+		req.Part = &part
+	}
+	if v := PlaylistType(q.Get("type")); v != "" {
+		if !v.valid() {
+			return req, fmt.Errorf("unknown playlist type %q", v)
+		}
+		req.Type = v
+	}
+	req.Token = q.Get("token")
+	return req, nil
+}
+
+// RegisterRendition handles PUT /streams/{stream_id}/renditions/{rendition}.
+// Body: { "bandwidth": 2800000, "resolution": "1280x720", "codecs": "avc1.4d401f,mp4a.40.2", "frame_rate": 30 }.
+// It replaces all metadata: fields omitted from the body are cleared.
+func (h *Handler) RegisterRendition(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamID := StreamID(chi.URLParam(r, "stream_id"))
+	renditionID := RenditionID(chi.URLParam(r, "rendition"))
+
+	if streamID == "" || renditionID == "" {
+		writeProblem(w, http.StatusBadRequest, "stream_id and rendition are required")
+		return
+	}
+
+	var info RenditionInfo
+	if status, problem := decodeStrict(w, r, h.cfg.MaxBodyBytes, &info); problem != nil {
+		h.log.Debug("invalid rendition body", slog.String("error", problem.Detail))
+		writeProblem(w, status, problem.Detail, problem.Errors...)
+		return
+	}
+	if err := info.validate(); err != nil {
+		h.log.Debug("invalid rendition metadata", slog.String("error", err.Error()))
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := h.svc.RegisterRendition(streamID, renditionID, info); err != nil {
+		switch err {
+		case ErrStreamEnded, ErrRenditionEnded:
+			h.log.Info("rendition rejected stream or rendition ended",
+				slog.String("stream_id", string(streamID)),
+				slog.String("rendition", string(renditionID)),
+				slog.String("error", err.Error()))
+			writeProblem(w, http.StatusConflict, err.Error())
+			return
+		case ErrTargetDurationLocked:
+			h.log.Info("rendition rejected target duration locked",
+				slog.String("stream_id", string(streamID)),
+				slog.String("rendition", string(renditionID)),
+				slog.Int("target_duration", info.TargetDuration))
+			writeProblem(w, http.StatusConflict, err.Error(),
+				FieldError{Field: "target_duration", Message: "differs from the locked target duration"})
+			return
+		case ErrPartTargetLocked:
+			h.log.Info("rendition rejected part target locked",
+				slog.String("stream_id", string(streamID)),
+				slog.String("rendition", string(renditionID)),
+				slog.Float64("part_target", info.PartTarget))
+			writeProblem(w, http.StatusConflict, err.Error(),
+				FieldError{Field: "part_target", Message: "differs from the locked part target"})
+			return
+		case ErrWindowExceedsRetention:
+			h.log.Debug("invalid rendition metadata", slog.String("error", err.Error()))
+			writeProblem(w, http.StatusBadRequest, "rendition has invalid fields",
+				FieldError{Field: "window_size", Message: "must not exceed the retention limit"})
+			return
+		default:
+			h.log.Error("register rendition failed", slog.String("error", err.Error()))
+			writeProblem(w, http.StatusInternalServerError, "")
+			return
+		}
+	}
+
+	h.log.Debug("rendition registered",
+		slog.String("stream_id", string(streamID)),
+		slog.String("rendition", string(renditionID)),
+		slog.Int64("bandwidth", info.Bandwidth))
+	w.WriteHeader(http.StatusOK)
+}
+
+// PatchRendition handles PATCH /streams/{stream_id}/renditions/{rendition}.
+// Body: { "window_size": 3 }. Unlike the PUT, which replaces all metadata, it
+// only changes the rendition's window size; 0 removes the override.
+func (h *Handler) PatchRendition(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamID := StreamID(chi.URLParam(r, "stream_id"))
+	renditionID := RenditionID(chi.URLParam(r, "rendition"))
+	if streamID == "" || renditionID == "" {
+		writeProblem(w, http.StatusBadRequest, "stream_id and rendition are required")
+		return
+	}
+	h.setWindowSize(w, r, streamID, renditionID)
+}
+
+// windowSizePatch is the body of the PATCH endpoints. Only the window size
+// can be patched; any other field is rejected as unknown.
+type windowSizePatch struct {
+	WindowSize int `json:"window_size"`
+}
+
+// setWindowSize decodes a windowSizePatch and applies it to the stream, or to
+// the rendition if renditionID is not empty.
+func (h *Handler) setWindowSize(w http.ResponseWriter, r *http.Request, streamID StreamID, renditionID RenditionID) {
+	var patch windowSizePatch
+	if status, problem := decodeStrict(w, r, h.cfg.MaxBodyBytes, &patch, "window_size"); problem != nil {
+		h.log.Debug("invalid patch body", slog.String("error", problem.Detail))
+		writeProblem(w, status, problem.Detail, problem.Errors...)
+		return
+	}
+	if patch.WindowSize < 0 {
+		writeProblem(w, http.StatusBadRequest, "patch has invalid fields",
+			FieldError{Field: "window_size", Message: "must not be negative"})
+		return
+	}
+
+	if err := h.svc.SetWindowSize(streamID, renditionID, patch.WindowSize); err != nil {
+		switch err {
+		case ErrStreamNotFound, ErrRenditionNotFound:
+			writeProblem(w, http.StatusNotFound, err.Error())
+		case ErrStreamEnded, ErrRenditionEnded:
+			h.log.Info("window size rejected stream or rendition ended",
+				slog.String("stream_id", string(streamID)),
+				slog.String("rendition", string(renditionID)),
+				slog.String("error", err.Error()))
+			writeProblem(w, http.StatusConflict, err.Error())
+		case ErrWindowExceedsRetention:
+			writeProblem(w, http.StatusBadRequest, "patch has invalid fields",
+				FieldError{Field: "window_size", Message: "must not exceed the retention limit"})
+		default:
+			h.log.Error("set window size failed", slog.String("error", err.Error()))
+			writeProblem(w, http.StatusInternalServerError, "")
+		}
+		return
+	}
+
+	h.log.Debug("window size updated",
+		slog.String("stream_id", string(streamID)),
+		slog.String("rendition", string(renditionID)),
+		slog.Int("window_size", patch.WindowSize))
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetAlignment handles GET /streams/{stream_id}/alignment, an admin endpoint
+// that reports the live edge and lag of every rendition and the sequence
+// numbers whose segment durations differ between renditions.
+func (h *Handler) GetAlignment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamID := StreamID(chi.URLParam(r, "stream_id"))
+	if streamID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	report, ok := h.svc.GetAlignment(streamID)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+// GetRendition handles GET /streams/{stream_id}/renditions/{rendition} and
+// responds with the rendition's metadata as JSON.
+func (h *Handler) GetRendition(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamID := StreamID(chi.URLParam(r, "stream_id"))
+	renditionID := RenditionID(chi.URLParam(r, "rendition"))
+
+	if streamID == "" || renditionID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	rendition, ok, err := h.svc.GetRendition(streamID, renditionID)
+	if err != nil {
+		if !h.storeUnavailable(w, err) {
+			h.log.Error("get rendition failed", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
 	if !ok {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(rendition)
+}
+
+// GetMasterPlaylist handles GET /streams/{stream_id}/master.m3u8. The optional
+// token query parameter is passed on to the media playlist URIs.
+func (h *Handler) GetMasterPlaylist(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamID := StreamID(chi.URLParam(r, "stream_id"))
+	if streamID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	m3u8, err := h.svc.GetMasterPlaylistWithToken(streamID, r.URL.Query().Get("token"))
+	if err != nil {
+		if h.storeUnavailable(w, err) {
+			return
+		}
+		switch err {
+		case ErrPlaylistNotFound:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			h.log.Error("get master playlist failed", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
 	w.Header().Set("Content-Type", playlistContentType)
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(m3u8))
 }
 
+// EndRendition handles POST /streams/{stream_id}/renditions/{rendition}/end.
+func (h *Handler) EndRendition(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamID := StreamID(chi.URLParam(r, "stream_id"))
+	renditionID := RenditionID(chi.URLParam(r, "rendition"))
+
+	if streamID == "" || renditionID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := h.svc.EndRendition(streamID, renditionID); err != nil {
+		h.log.Error("end rendition failed",
+			slog.String("stream_id", string(streamID)),
+			slog.String("rendition", string(renditionID)),
+			slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	h.log.Info("rendition ended",
+		slog.String("stream_id", string(streamID)),
+		slog.String("rendition", string(renditionID)))
+	w.WriteHeader(http.StatusOK)
+	if h.metrics != nil {
+		h.metrics.IncRenditionsEnded()
+	}
+}
+
 // EndStream handles POST /streams/{stream_id}/end.
 func (h *Handler) EndStream(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -126,3 +634,422 @@ func (h *Handler) EndStream(w http.ResponseWriter, r *http.Request) {
 		h.metrics.IncStreamsEnded()
 	}
 }
+
+// createStreamRequest is the body of POST /streams: an optional stream ID
+// and the stream's settings.
+type createStreamRequest struct {
+	ID StreamID `json:"id"`
+	StreamSettings
+}
+
+// CreateStream handles POST /streams.
+// Body: { "id": "match-42", "window_size": 3, "playlist_type": "event" }, where
+// every field is optional; an omitted id is generated. It responds with the
+// new stream as JSON, or 409 if a stream with the ID already exists.
+func (h *Handler) CreateStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req createStreamRequest
+	if status, problem := decodeStrict(w, r, h.cfg.MaxBodyBytes, &req); problem != nil {
+		h.log.Debug("invalid create stream body", slog.String("error", problem.Detail))
+		writeProblem(w, status, problem.Detail, problem.Errors...)
+		return
+	}
+	if req.ID != "" && !validStreamID(req.ID) {
+		writeProblem(w, http.StatusBadRequest, "stream has invalid fields",
+			FieldError{Field: "id", Message: "must be a single URL path segment"})
+		return
+	}
+	if err := req.StreamSettings.validate(); err != nil {
+		h.log.Debug("invalid stream settings", slog.String("error", err.Error()))
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	stream, err := h.svc.CreateStream(req.ID, req.StreamSettings)
+	if err != nil {
+		switch err {
+		case ErrStreamExists:
+			writeProblem(w, http.StatusConflict, err.Error())
+		case ErrWindowExceedsRetention:
+			writeProblem(w, http.StatusBadRequest, "stream has invalid fields",
+				FieldError{Field: "window_size", Message: "must not exceed the retention limit"})
+		default:
+			h.log.Error("create stream failed", slog.String("error", err.Error()))
+			writeProblem(w, http.StatusInternalServerError, "")
+		}
+		return
+	}
+
+	h.log.Info("stream created", slog.String("stream_id", string(stream.ID)))
+	w.Header().Set("Location", "/streams/"+string(stream.ID))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(stream)
+}
+
+// ListStreams handles GET /streams?state=live|ended&limit=50&after=<id> and
+// responds with a page of stream summaries as JSON. The next page is
+// requested with the response's "next" value as after.
+func (h *Handler) ListStreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := StreamFilter{After: StreamID(query.Get("after"))}
+	switch state := query.Get("state"); state {
+	case "":
+	case "live", "ended":
+		ended := state == "ended"
+		filter.Ended = &ended
+	default:
+		writeProblem(w, http.StatusBadRequest, "invalid query parameters",
+			FieldError{Field: "state", Message: "must be live or ended"})
+		return
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > MaxStreamPageSize {
+			writeProblem(w, http.StatusBadRequest, "invalid query parameters",
+				FieldError{Field: "limit", Message: fmt.Sprintf("must be a number from 1 to %d", MaxStreamPageSize)})
+			return
+		}
+		filter.Limit = limit
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.svc.ListStreams(filter))
+}
+
+// GetStream handles GET /streams/{stream_id} and responds with the stream's
+// summary as JSON.
+func (h *Handler) GetStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamID := StreamID(chi.URLParam(r, "stream_id"))
+	if streamID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	stream, ok := h.svc.GetStream(streamID)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(stream)
+}
+
+// DeleteStream handles DELETE /streams/{stream_id}.
+func (h *Handler) DeleteStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamID := StreamID(chi.URLParam(r, "stream_id"))
+	if streamID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := h.svc.DeleteStream(streamID); err != nil {
+		if err == ErrStreamNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		h.log.Error("delete stream failed", slog.String("stream_id", string(streamID)), slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	h.log.Info("stream deleted", slog.String("stream_id", string(streamID)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UpdateStreamSettings handles PUT /streams/{stream_id}/settings. It replaces
+// all settings: fields omitted from the body are reset to their defaults.
+func (h *Handler) UpdateStreamSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamID := StreamID(chi.URLParam(r, "stream_id"))
+	if streamID == "" {
+		writeProblem(w, http.StatusBadRequest, "stream_id is required")
+		return
+	}
+
+	var settings StreamSettings
+	if status, problem := decodeStrict(w, r, h.cfg.MaxBodyBytes, &settings); problem != nil {
+		h.log.Debug("invalid settings body", slog.String("error", problem.Detail))
+		writeProblem(w, status, problem.Detail, problem.Errors...)
+		return
+	}
+	if err := settings.validate(); err != nil {
+		h.log.Debug("invalid stream settings", slog.String("error", err.Error()))
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := h.svc.UpdateStreamSettings(streamID, settings); err != nil {
+		switch err {
+		case ErrStreamEnded:
+			h.log.Info("settings rejected stream ended",
+				slog.String("stream_id", string(streamID)),
+				slog.String("error", err.Error()))
+			writeProblem(w, http.StatusConflict, err.Error())
+			return
+		case ErrWindowExceedsRetention:
+			h.log.Debug("invalid stream settings", slog.String("error", err.Error()))
+			writeProblem(w, http.StatusBadRequest, "stream has invalid fields",
+				FieldError{Field: "window_size", Message: "must not exceed the retention limit"})
+			return
+		default:
+			h.log.Error("update stream settings failed", slog.String("error", err.Error()))
+			writeProblem(w, http.StatusInternalServerError, "")
+			return
+		}
+	}
+
+	h.log.Debug("stream settings updated",
+		slog.String("stream_id", string(streamID)),
+		slog.String("gap_policy", string(settings.GapPolicy)))
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetVODPlaylist handles GET /streams/{stream_id}/renditions/{rendition}/vod.m3u8.
+func (h *Handler) GetVODPlaylist(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamID := StreamID(chi.URLParam(r, "stream_id"))
+	renditionID := RenditionID(chi.URLParam(r, "rendition"))
+
+	if streamID == "" || renditionID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	m3u8, err := h.svc.GetVODPlaylist(streamID, renditionID)
+	if err != nil {
+		if h.storeUnavailable(w, err) {
+			return
+		}
+		switch err {
+		case ErrPlaylistNotFound:
+			w.WriteHeader(http.StatusNotFound)
+		case ErrRenditionNotEnded:
+			w.WriteHeader(http.StatusConflict)
+		default:
+			h.log.Error("get vod playlist failed", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", playlistContentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(m3u8))
+}
+
+// PatchStreamSettings handles PATCH /streams/{stream_id}/settings.
+// Body: { "window_size": 3 }. Unlike the PUT, which replaces all settings, it
+// only changes the stream's window size; 0 restores the default.
+func (h *Handler) PatchStreamSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamID := StreamID(chi.URLParam(r, "stream_id"))
+	if streamID == "" {
+		writeProblem(w, http.StatusBadRequest, "stream_id is required")
+		return
+	}
+	h.setWindowSize(w, r, streamID, "")
+}
+
+// RegisterCue handles POST /streams/{stream_id}/cues.
+func (h *Handler) RegisterCue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamID := StreamID(chi.URLParam(r, "stream_id"))
+	if streamID == "" {
+		writeProblem(w, http.StatusBadRequest, "stream_id is required")
+		return
+	}
+
+	var cue Cue
+	if status, problem := decodeStrict(w, r, h.cfg.MaxBodyBytes, &cue, "sequence"); problem != nil {
+		h.log.Debug("invalid cue body", slog.String("error", problem.Detail))
+		writeProblem(w, status, problem.Detail, problem.Errors...)
+		return
+	}
+	if err := cue.normalize(); err != nil {
+		h.log.Debug("invalid cue", slog.String("error", err.Error()))
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := h.svc.RegisterCue(streamID, cue); err != nil {
+		switch err {
+		case ErrStreamEnded:
+			h.log.Info("cue rejected stream ended",
+				slog.String("stream_id", string(streamID)),
+				slog.Int64("sequence", cue.Sequence),
+				slog.String("error", err.Error()))
+			writeProblem(w, http.StatusConflict, err.Error())
+			return
+		default:
+			h.log.Error("register cue failed", slog.String("error", err.Error()))
+			writeProblem(w, http.StatusInternalServerError, "")
+			return
+		}
+	}
+
+	h.log.Info("cue registered",
+		slog.String("stream_id", string(streamID)),
+		slog.String("type", string(cue.Type)),
+		slog.Int64("sequence", cue.Sequence))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// IssueKey handles POST /streams/{stream_id}/keys. With a key in the body it
+// imports that key for the given sequence; otherwise it returns the key of the
+// rotation period containing the sequence, generating it if needed.
+func (h *Handler) IssueKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorizeKeyRequest(w, r, h.cfg.KeyToken, false) {
+		return
+	}
+
+	streamID := StreamID(chi.URLParam(r, "stream_id"))
+	if streamID == "" {
+		writeProblem(w, http.StatusBadRequest, "stream_id is required")
+		return
+	}
+
+	var req ContentKey
+	if status, problem := decodeStrict(w, r, h.cfg.MaxBodyBytes, &req, "sequence"); problem != nil {
+		h.log.Debug("invalid key body", slog.String("error", problem.Detail))
+		writeProblem(w, status, problem.Detail, problem.Errors...)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		h.log.Debug("invalid key request",
+			slog.String("stream_id", string(streamID)),
+			slog.Int64("sequence", req.FirstSequence),
+			slog.Any("errors", errs))
+		writeProblem(w, http.StatusBadRequest, "key request has invalid fields", errs...)
+		return
+	}
+
+	key, status := req, http.StatusCreated
+	var err error
+	if len(req.Key) > 0 {
+		err = h.svc.ImportKey(streamID, req)
+	} else {
+		key, err = h.svc.IssueKey(streamID, req.FirstSequence)
+		status = http.StatusOK
+	}
+	if err != nil {
+		switch err {
+		case ErrEncryptionDisabled, ErrKeyExists, ErrStreamEnded:
+			h.log.Info("key request rejected",
+				slog.String("stream_id", string(streamID)),
+				slog.Int64("sequence", req.FirstSequence),
+				slog.String("error", err.Error()))
+			writeProblem(w, http.StatusConflict, err.Error())
+			return
+		default:
+			h.log.Error("issue key failed", slog.String("error", err.Error()))
+			writeProblem(w, http.StatusInternalServerError, "")
+			return
+		}
+	}
+
+	h.log.Info("key issued",
+		slog.String("stream_id", string(streamID)),
+		slog.Int64("first_sequence", key.FirstSequence))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(key)
+}
+
+// GetKey handles GET /streams/{stream_id}/keys/{first_sequence}, the key URI
+// of #EXT-X-KEY. It responds with the raw 16-byte key.
+func (h *Handler) GetKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorizeKeyRequest(w, r, h.cfg.PlayerKeyToken, true) {
+		return
+	}
+
+	streamID := StreamID(chi.URLParam(r, "stream_id"))
+	first, err := strconv.ParseInt(chi.URLParam(r, "first_sequence"), 10, 64)
+	if streamID == "" || err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	key, ok := h.svc.GetKey(streamID, first)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(key.Key)
+}
+
+// authorizeKeyRequest checks the bearer token of a key endpoint request
+// against want. The token is read from the Authorization header or, if
+// allowQuery is set (for players that cannot set headers), from the token
+// query parameter. It writes the error response and returns false if the
+// request is not authorized.
+func (h *Handler) authorizeKeyRequest(w http.ResponseWriter, r *http.Request, want string, allowQuery bool) bool {
+	if want == "" {
+		h.log.Warn("key endpoint disabled: no key token configured", slog.String("path", r.URL.Path))
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	var token string
+	if allowQuery {
+		token = r.URL.Query().Get("token")
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
@@ -8,7 +8,9 @@ import (
 	"net/http/httptest"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -23,11 +25,28 @@ func newTestHandler(t *testing.T) *Handler {
 
 func newTestRouter(h *Handler) *chi.Mux {
 	r := chi.NewRouter()
+	r.Post("/streams", h.CreateStream)
+	r.Get("/streams", h.ListStreams)
 	r.Route("/streams/{stream_id}", func(r chi.Router) {
+		r.Get("/", h.GetStream)
+		r.Delete("/", h.DeleteStream)
+		r.Put("/settings", h.UpdateStreamSettings)
+		r.Patch("/settings", h.PatchStreamSettings)
+		r.Post("/cues", h.RegisterCue)
+		r.Post("/keys", h.IssueKey)
+		r.Get("/keys/{first_sequence}", h.GetKey)
 		r.Post("/end", h.EndStream)
+		r.Get("/alignment", h.GetAlignment)
+		r.Get("/master.m3u8", h.GetMasterPlaylist)
 		r.Route("/renditions/{rendition}", func(r chi.Router) {
+			r.Put("/", h.RegisterRendition)
+			r.Patch("/", h.PatchRendition)
+			r.Get("/", h.GetRendition)
+			r.Post("/end", h.EndRendition)
 			r.Post("/segments", h.RegisterSegment)
+			r.Post("/segments/{sequence}/parts", h.RegisterPart)
 			r.Get("/playlist.m3u8", h.GetPlaylist)
+			r.Get("/vod.m3u8", h.GetVODPlaylist)
 		})
 	})
 	return r
@@ -64,6 +83,108 @@ func TestHandler_RegisterSegment_bad_request(t *testing.T) {
 	}
 }
 
+func TestHandler_RegisterSegment_byte_range(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+
+	post := func(body map[string]interface{}) int {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/streams/s1/renditions/720p/segments", bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := post(map[string]interface{}{"sequence": 1, "duration": 2.0, "path": "/min1.ts", "byte_range_offset": 0}); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an offset without a length, got %d", code)
+	}
+	if code := post(map[string]interface{}{"sequence": 1, "duration": 2.0, "path": "/min1.ts", "byte_range_length": 500}); code != http.StatusCreated {
+		t.Errorf("expected 201, got %d", code)
+	}
+	if code := post(map[string]interface{}{"sequence": 2, "duration": 2.0, "path": "/min1.ts", "byte_range_length": 500, "byte_range_offset": 200}); code != http.StatusConflict {
+		t.Errorf("expected 409 for an overlapping range, got %d", code)
+	}
+}
+
+func TestHandler_RegisterSegment_validation(t *testing.T) {
+	svc := NewService(NewInMemoryRepository(), 6)
+	log := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	r := newTestRouter(NewHandlerWithConfig(svc, log, nil, HandlerConfig{MaxSegmentDuration: 6, MaxBodyBytes: 256}))
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		fields []string
+	}{
+		{"missing fields", `{"sequence": 1}`, http.StatusBadRequest, []string{"duration", "path"}},
+		{"unknown field", `{"sequence": 1, "duration": 2, "path": "/1.ts", "bogus": true}`, http.StatusBadRequest, []string{"bogus"}},
+		{"wrong type", `{"sequence": "one", "duration": 2, "path": "/1.ts"}`, http.StatusBadRequest, []string{"sequence"}},
+		{"trailing data", `{"sequence": 1, "duration": 2, "path": "/1.ts"} {}`, http.StatusBadRequest, nil},
+		{"invalid values", `{"sequence": -1, "duration": 0, "path": "/1.ts\n#EXT-X-ENDLIST"}`, http.StatusBadRequest, []string{"sequence", "duration", "path"}},
+		{"longer than target", `{"sequence": 1, "duration": 6.6, "path": "/1.ts"}`, http.StatusBadRequest, []string{"duration"}},
+		{"too large", `{"sequence": 1, "duration": 2, "path": "/` + strings.Repeat("a", 256) + `.ts"}`, http.StatusRequestEntityTooLarge, nil},
+		{"valid", `{"sequence": 1, "duration": 6.4, "path": "/1.ts"}`, http.StatusCreated, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/streams/s1/renditions/720p/segments", bytes.NewReader([]byte(tt.body)))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+			if tt.status == http.StatusCreated {
+				return
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+				t.Errorf("expected problem content type, got %q", ct)
+			}
+			var problem Problem
+			if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+				t.Fatalf("decode problem: %v", err)
+			}
+			if problem.Status != tt.status {
+				t.Errorf("expected status %d in the problem, got %d", tt.status, problem.Status)
+			}
+			var fields []string
+			for _, e := range problem.Errors {
+				fields = append(fields, e.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.fields, ",") {
+				t.Errorf("expected field errors for %v, got %+v", tt.fields, problem.Errors)
+			}
+		})
+	}
+}
+
+func TestHandler_RegisterSegment_duplicates(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+
+	post := func(path string) int {
+		b, _ := json.Marshal(map[string]interface{}{"sequence": 1, "duration": 2.0, "path": path})
+		req := httptest.NewRequest(http.MethodPost, "/streams/s1/renditions/720p/segments", bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := post("/a/1.ts"); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	if code := post("/a/1.ts"); code != http.StatusOK {
+		t.Errorf("expected 200 for an identical duplicate, got %d", code)
+	}
+	if code := post("/b/1.ts"); code != http.StatusConflict {
+		t.Errorf("expected 409 for a conflicting duplicate, got %d", code)
+	}
+}
+
 func TestHandler_RegisterSegment_conflict_after_end(t *testing.T) {
 	h := newTestHandler(t)
 	r := newTestRouter(h)
@@ -155,6 +276,219 @@ func TestHandler_EndStream(t *testing.T) {
 	}
 }
 
+func TestHandler_DeleteStream(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+
+	req := httptest.NewRequest(http.MethodDelete, "/streams/s1", nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown stream, got %d", rec.Code)
+	}
+
+	b, _ := json.Marshal(map[string]interface{}{"sequence": 1, "duration": 2.0, "path": "/a.ts"})
+	req = httptest.NewRequest(http.MethodPost, "/streams/s1/renditions/720p/segments", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest(http.MethodDelete, "/streams/s1", nil)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/streams/s1/renditions/720p/playlist.m3u8", nil)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 after delete, got %d", rec.Code)
+	}
+}
+
+func TestHandler_UpdateStreamSettings(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+
+	put := func(body string) int {
+		req := httptest.NewRequest(http.MethodPut, "/streams/s1/settings", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := put(`{"gap_policy":"gap","gap_timeout":4}`); code != http.StatusOK {
+		t.Errorf("expected 200, got %d", code)
+	}
+	if code := put(`{"gap_policy":"wait"}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown gap policy, got %d", code)
+	}
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/streams/s1/end", nil))
+	if code := put(`{"gap_policy":"skip"}`); code != http.StatusConflict {
+		t.Errorf("expected 409 after end, got %d", code)
+	}
+}
+
+func TestHandler_GetPlaylist_type(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+
+	b, _ := json.Marshal(map[string]interface{}{"sequence": 1, "duration": 2.0, "path": "/a.ts"})
+	req := httptest.NewRequest(http.MethodPost, "/streams/s1/renditions/720p/segments", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest(http.MethodGet, "/streams/s1/renditions/720p/playlist.m3u8?type=event", nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an EVENT playlist of a live stream, got %d", rec.Code)
+	}
+
+	_ = h.svc.UpdateStreamSettings("s1", StreamSettings{PlaylistType: PlaylistTypeEvent})
+	req = httptest.NewRequest(http.MethodGet, "/streams/s1/renditions/720p/playlist.m3u8?type=event", nil)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !bytes.Contains(rec.Body.Bytes(), []byte("#EXT-X-PLAYLIST-TYPE:EVENT")) {
+		t.Errorf("expected 200 EVENT playlist, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/streams/s1/renditions/720p/playlist.m3u8?type=live", nil)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || bytes.Contains(rec.Body.Bytes(), []byte("PLAYLIST-TYPE")) {
+		t.Errorf("expected 200 live playlist, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/streams/s1/renditions/720p/playlist.m3u8?type=vod", nil)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown type, got %d", rec.Code)
+	}
+}
+
+func TestHandler_GetVODPlaylist(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+
+	b, _ := json.Marshal(map[string]interface{}{"sequence": 1, "duration": 2.0, "path": "/a.ts"})
+	req := httptest.NewRequest(http.MethodPost, "/streams/s1/renditions/720p/segments", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest(http.MethodGet, "/streams/s1/renditions/720p/vod.m3u8", nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 while live, got %d", rec.Code)
+	}
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/streams/s1/end", nil))
+	req = httptest.NewRequest(http.MethodGet, "/streams/s1/renditions/720p/vod.m3u8", nil)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !bytes.Contains(rec.Body.Bytes(), []byte("#EXT-X-PLAYLIST-TYPE:VOD")) {
+		t.Errorf("expected 200 VOD playlist, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != playlistContentType {
+		t.Errorf("expected Content-Type %s, got %s", playlistContentType, ct)
+	}
+}
+
+func TestHandler_RegisterCue(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+
+	post := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/streams/s1/cues", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := post(`{"type":"out","sequence":10,"duration":30}`); code != http.StatusCreated {
+		t.Errorf("expected 201, got %d", code)
+	}
+	if code := post(`{"sequence":10,"scte35":"/DAAAAAAAAAAAP/wAAY="}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a non splice_insert payload, got %d", code)
+	}
+	if code := post(`{"type":"pause","sequence":10}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown type, got %d", code)
+	}
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/streams/s1/end", nil))
+	if code := post(`{"type":"in","sequence":20}`); code != http.StatusConflict {
+		t.Errorf("expected 409 after end, got %d", code)
+	}
+}
+
+func TestHandler_keys(t *testing.T) {
+	svc := NewService(NewInMemoryRepository(), 6)
+	log := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	r := newTestRouter(NewHandlerWithConfig(svc, log, nil, HandlerConfig{KeyToken: "secret", PlayerKeyToken: "viewer"}))
+	_ = svc.UpdateStreamSettings("s1", StreamSettings{Encryption: EncryptionAES128, KeyRotation: 10})
+
+	do := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, bytes.NewReader([]byte(body)))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPost, "/streams/s1/keys", "wrong", `{"sequence":12}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with a wrong token, got %d", rec.Code)
+	}
+	rec := do(http.MethodPost, "/streams/s1/keys", "secret", `{"sequence":12}`)
+	var key ContentKey
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &key) != nil || key.FirstSequence != 10 {
+		t.Fatalf("expected 200 with the key of period 10, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/streams/s1/keys", "secret", `{"sequence":20,"key":"AAAA"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a short key, got %d", rec.Code)
+	}
+
+	if rec := do(http.MethodPost, "/streams/s1/keys", "viewer", `{"sequence":30,"key":"AAAAAAAAAAAAAAAAAAAAAA=="}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an import with the player token, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/streams/s1/keys?token=secret", "", `{"sequence":30}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a packager token in the query, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/streams/s1/keys/10", "secret", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a fetch with the packager token, got %d", rec.Code)
+	}
+
+	rec = do(http.MethodGet, "/streams/s1/keys/10?token=viewer", "", "")
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), key.Key) {
+		t.Errorf("expected the raw key, got %d: %x", rec.Code, rec.Body.Bytes())
+	}
+	if rec := do(http.MethodGet, "/streams/s1/keys/20", "viewer", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown key, got %d", rec.Code)
+	}
+
+	// Players that pass the token in the query get it on the key URIs.
+	_ = svc.RegisterRendition("s1", "720p", RenditionInfo{Bandwidth: 2800000})
+	_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: 10, Duration: 2.0, Path: "/10.ts"})
+	if rec := do(http.MethodGet, "/streams/s1/master.m3u8?token=viewer", "", ""); !strings.Contains(rec.Body.String(), "renditions/720p/playlist.m3u8?token=viewer\n") {
+		t.Errorf("expected the token on the media playlist URI, got %s", rec.Body.String())
+	}
+	if rec := do(http.MethodGet, "/streams/s1/renditions/720p/playlist.m3u8?token=viewer", "", ""); !strings.Contains(rec.Body.String(), `URI="../../keys/10?token=viewer"`) {
+		t.Errorf("expected the token on the key URI, got %s", rec.Body.String())
+	}
+
+	r = newTestRouter(NewHandler(svc, log, nil))
+	if rec := do(http.MethodGet, "/streams/s1/keys/10", "secret", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without a configured token, got %d", rec.Code)
+	}
+}
+
 func TestHandler_GetPlaylist_path_params(t *testing.T) {
 	h := newTestHandler(t)
 	r := newTestRouter(h)
@@ -176,3 +510,465 @@ func TestHandler_GetPlaylist_path_params(t *testing.T) {
 		t.Errorf("expected 200, got %d", rec2.Code)
 	}
 }
+
+func TestHandler_RegisterRendition_and_master_playlist(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+
+	b, _ := json.Marshal(map[string]interface{}{"bandwidth": 2800000, "resolution": "1280x720", "codecs": "avc1.4d401f,mp4a.40.2", "frame_rate": 30})
+	req := httptest.NewRequest(http.MethodPut, "/streams/s1/renditions/720p", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("register rendition: expected 200, got %d", rec.Code)
+	}
+
+	req2 := httptest.NewRequest(http.MethodGet, "/streams/s1/master.m3u8", nil)
+	rec2 := httptest.NewRecorder()
+	r.ServeHTTP(rec2, req2)
+	if rec2.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec2.Code)
+	}
+	if rec2.Header().Get("Content-Type") != "application/vnd.apple.mpegurl" {
+		t.Errorf("expected playlist content type, got %s", rec2.Header().Get("Content-Type"))
+	}
+	if !bytes.Contains(rec2.Body.Bytes(), []byte("BANDWIDTH=2800000,RESOLUTION=1280x720")) {
+		t.Errorf("unexpected master playlist body: %s", rec2.Body.String())
+	}
+}
+
+func TestHandler_RegisterRendition_bad_request(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+
+	b, _ := json.Marshal(map[string]interface{}{"resolution": "1280x720"})
+	req := httptest.NewRequest(http.MethodPut, "/streams/s1/renditions/720p", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without bandwidth, got %d", rec.Code)
+	}
+}
+
+func TestHandler_RegisterRendition_fmp4_requires_init_uri(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+
+	b, _ := json.Marshal(map[string]interface{}{"bandwidth": 2000000, "container": "fmp4"})
+	req := httptest.NewRequest(http.MethodPut, "/streams/s1/renditions/720p", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for fmp4 without init_uri, got %d", rec.Code)
+	}
+}
+
+func TestHandler_GetRendition(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+
+	info := map[string]interface{}{
+		"bandwidth": 2800000, "average_bandwidth": 2200000, "resolution": "1280x720",
+		"codecs": "avc1.4d401f,mp4a.40.2", "frame_rate": 30, "hdcp_level": "TYPE-0",
+		"video_range": "SDR", "audio_group": "aac",
+	}
+	b, _ := json.Marshal(info)
+	req := httptest.NewRequest(http.MethodPut, "/streams/s1/renditions/720p", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/streams/s1/renditions/720p", nil)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var got RenditionSummary
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode rendition: %v", err)
+	}
+	want := RenditionInfo{
+		Bandwidth: 2800000, AverageBandwidth: 2200000, Resolution: "1280x720",
+		Codecs: "avc1.4d401f,mp4a.40.2", FrameRate: 30, HDCPLevel: "TYPE-0",
+		VideoRange: "SDR", AudioGroup: "aac",
+	}
+	if got.ID != "720p" || got.Info != want || got.Ended {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/streams/s1/renditions/missing", nil)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing rendition, got %d", rec.Code)
+	}
+}
+
+func TestHandler_RegisterRendition_invalid_metadata(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+
+	for _, body := range []map[string]interface{}{
+		{"bandwidth": 2800000, "average_bandwidth": 3000000},
+		{"bandwidth": 2800000, "resolution": "720p"},
+		{"bandwidth": 2800000, "hdcp_level": "TYPE-2"},
+		{"bandwidth": 2800000, "video_range": "HDR10"},
+		{"bandwidth": 2800000, "audio_group": "a\"b"},
+		{"bandwidth": 2800000, "window_size": -1},
+		{"type": "AUDIO", "name": "English"},
+		{"type": "CLOSED-CAPTIONS", "group_id": "cc", "name": "English", "instream_id": "CC5"},
+		{"type": "DATA", "group_id": "d", "name": "Data"},
+	} {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPut, "/streams/s1/renditions/720p", bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %v, got %d", body, rec.Code)
+		}
+	}
+}
+
+func TestHandler_RegisterRendition_alternate_audio(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+
+	b, _ := json.Marshal(map[string]interface{}{"type": "AUDIO", "group_id": "aac", "name": "English", "language": "en", "default": true})
+	req := httptest.NewRequest(http.MethodPut, "/streams/s1/renditions/audio-en", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 for an audio rendition without bandwidth, got %d", rec.Code)
+	}
+}
+
+func TestHandler_GetMasterPlaylist_not_found(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+
+	req := httptest.NewRequest(http.MethodGet, "/streams/missing/master.m3u8", nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestHandler_RegisterPart(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+
+	b, _ := json.Marshal(map[string]interface{}{"index": 0, "duration": 0.5, "uri": "/1.0.ts", "independent": true})
+	req := httptest.NewRequest(http.MethodPost, "/streams/s1/renditions/720p/segments/1/parts", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", rec.Code)
+	}
+
+	// Completing the segment makes further parts a conflict.
+	b2, _ := json.Marshal(map[string]interface{}{"sequence": 1, "duration": 2.0, "path": "/1.ts"})
+	req2 := httptest.NewRequest(http.MethodPost, "/streams/s1/renditions/720p/segments", bytes.NewReader(b2))
+	req2.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(httptest.NewRecorder(), req2)
+
+	req3 := httptest.NewRequest(http.MethodPost, "/streams/s1/renditions/720p/segments/1/parts", bytes.NewReader(b))
+	req3.Header.Set("Content-Type", "application/json")
+	rec3 := httptest.NewRecorder()
+	r.ServeHTTP(rec3, req3)
+	if rec3.Code != http.StatusConflict {
+		t.Errorf("expected 409 for part of complete segment, got %d", rec3.Code)
+	}
+}
+
+func TestHandler_RegisterPart_bad_request(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+
+	b, _ := json.Marshal(map[string]interface{}{"index": 0, "duration": 0.5})
+	req := httptest.NewRequest(http.MethodPost, "/streams/s1/renditions/720p/segments/abc/parts", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid sequence, got %d", rec.Code)
+	}
+}
+
+func TestHandler_GetPlaylist_blocking_reload(t *testing.T) {
+	repo := NewInMemoryRepository()
+	svc := NewServiceWithConfig(repo, ServiceConfig{BlockingReloadTimeout: 20 * time.Millisecond})
+	log := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	r := newTestRouter(NewHandler(svc, log, nil))
+	_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"?_HLS_msn=1", http.StatusOK},
+		{"?_HLS_msn=2", http.StatusServiceUnavailable},
+		{"?_HLS_msn=2&_HLS_part=0", http.StatusServiceUnavailable},
+		{"?_HLS_part=0", http.StatusBadRequest},
+		{"?_HLS_msn=abc", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/streams/s1/renditions/720p/playlist.m3u8"+tt.query, nil)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.query, tt.want, rec.Code)
+		}
+	}
+}
+
+func TestHandler_EndRendition(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+
+	b, _ := json.Marshal(map[string]interface{}{"sequence": 1, "duration": 2.0, "path": "/1.ts"})
+	req := httptest.NewRequest(http.MethodPost, "/streams/s1/renditions/1080p/segments", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	reqEnd := httptest.NewRequest(http.MethodPost, "/streams/s1/renditions/1080p/end", nil)
+	recEnd := httptest.NewRecorder()
+	r.ServeHTTP(recEnd, reqEnd)
+	if recEnd.Code != http.StatusOK {
+		t.Fatalf("end rendition: expected 200, got %d", recEnd.Code)
+	}
+
+	b2, _ := json.Marshal(map[string]interface{}{"sequence": 2, "duration": 2.0, "path": "/2.ts"})
+	req2 := httptest.NewRequest(http.MethodPost, "/streams/s1/renditions/1080p/segments", bytes.NewReader(b2))
+	req2.Header.Set("Content-Type", "application/json")
+	rec2 := httptest.NewRecorder()
+	r.ServeHTTP(rec2, req2)
+	if rec2.Code != http.StatusConflict {
+		t.Errorf("expected 409 after rendition ended, got %d", rec2.Code)
+	}
+}
+
+func TestHandler_window_size_exceeds_retention(t *testing.T) {
+	repo := NewInMemoryRepositoryWithConfig(NewInMemoryStore(), RepositoryConfig{
+		Retention: RetentionPolicy{MaxSegments: 5},
+	})
+	log := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	r := newTestRouter(NewHandler(NewService(repo, 3), log, nil))
+
+	do := func(method, target, body string) int {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(method, target, bytes.NewReader([]byte(body))))
+		return rec.Code
+	}
+
+	tests := []struct {
+		method, target, fields string
+	}{
+		{http.MethodPost, "/streams", ""},
+		{http.MethodPut, "/streams/s1/settings", ""},
+		{http.MethodPut, "/streams/s1/renditions/720p", `"bandwidth": 2800000, `},
+	}
+	for _, tt := range tests {
+		if code := do(tt.method, tt.target, `{`+tt.fields+`"window_size": 6}`); code != http.StatusBadRequest {
+			t.Errorf("%s %s: expected 400 above the retention limit, got %d", tt.method, tt.target, code)
+		}
+		if code := do(tt.method, tt.target, `{`+tt.fields+`"window_size": 5}`); code >= 300 {
+			t.Errorf("%s %s: expected success at the retention limit, got %d", tt.method, tt.target, code)
+		}
+	}
+}
+
+func TestHandler_CreateStream(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+
+	create := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/streams", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := create(`{"id": "match-42", "window_size": 3, "playlist_type": "event"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if loc := rec.Header().Get("Location"); loc != "/streams/match-42" {
+		t.Errorf("expected Location /streams/match-42, got %q", loc)
+	}
+	var created StreamSummary
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatalf("decode stream: %v", err)
+	}
+	if created.ID != "match-42" || created.Settings.WindowSize != 3 || created.Settings.PlaylistType != PlaylistTypeEvent {
+		t.Errorf("unexpected stream %+v", created)
+	}
+
+	if rec := create(`{"id": "match-42"}`); rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 for an existing stream, got %d", rec.Code)
+	}
+	if rec := create(`{"id": "a/b"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid id, got %d", rec.Code)
+	}
+	if rec := create(`{"window_size": -1}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid settings, got %d", rec.Code)
+	}
+	if rec := create(`{}`); rec.Code != http.StatusCreated {
+		t.Errorf("expected 201 for a generated id, got %d", rec.Code)
+	}
+}
+
+func TestHandler_GetStream(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+
+	_ = h.svc.RegisterSegment("s1", "720p", Segment{Sequence: 7, Duration: 2.0, Path: "/7.ts"})
+
+	req := httptest.NewRequest(http.MethodGet, "/streams/s1", nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var got StreamSummary
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode stream: %v", err)
+	}
+	if got.ID != "s1" || got.LatestSequence == nil || *got.LatestSequence != 7 || len(got.Renditions) != 1 || got.Renditions[0].SegmentCount != 1 {
+		t.Errorf("unexpected stream %+v", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/streams/missing", nil)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestHandler_ListStreams(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+
+	for _, id := range []StreamID{"a", "b", "c"} {
+		_, _ = h.svc.CreateStream(id, StreamSettings{})
+	}
+	_ = h.svc.EndStream("c")
+
+	list := func(query string) (int, StreamPage) {
+		req := httptest.NewRequest(http.MethodGet, "/streams"+query, nil)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		var page StreamPage
+		_ = json.NewDecoder(rec.Body).Decode(&page)
+		return rec.Code, page
+	}
+
+	code, page := list("?state=live&limit=1")
+	if code != http.StatusOK || len(page.Streams) != 1 || page.Streams[0].ID != "a" || page.Next != "a" {
+		t.Fatalf("unexpected first page %d %+v", code, page)
+	}
+	code, page = list("?state=live&limit=1&after=" + string(page.Next))
+	if code != http.StatusOK || len(page.Streams) != 1 || page.Streams[0].ID != "b" || page.Next != "" {
+		t.Errorf("unexpected last page %d %+v", code, page)
+	}
+	if _, page = list("?state=ended"); len(page.Streams) != 1 || page.Streams[0].ID != "c" {
+		t.Errorf("expected only the ended stream, got %+v", page.Streams)
+	}
+	for _, query := range []string{"?state=paused", "?limit=0", "?limit=many"} {
+		if code, _ := list(query); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, code)
+		}
+	}
+}
+
+func TestHandler_problem_details(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+	_ = h.svc.UpdateStreamSettings("s1", StreamSettings{Encryption: EncryptionAES128})
+	_ = h.svc.RegisterPart("s1", "720p", PartialSegment{Sequence: 1, Index: 0, Duration: 0.5, URI: "/1.0.ts"})
+
+	tests := []struct {
+		name, method, target, body string
+		field                      string
+	}{
+		{"settings_unknown_field", http.MethodPut, "/streams/s1/settings", `{"window": 3}`, "window"},
+		{"settings_wrong_type", http.MethodPut, "/streams/s1/settings", `{"window_size": "3"}`, "window_size"},
+		{"rendition_unknown_field", http.MethodPut, "/streams/s1/renditions/720p", `{"bandwith": 2800000}`, "bandwith"},
+		{"part_missing_uri", http.MethodPost, "/streams/s1/renditions/720p/segments/1/parts", `{"index": 0, "duration": 1.0}`, "uri"},
+		{"part_negative_index", http.MethodPost, "/streams/s1/renditions/720p/segments/1/parts", `{"index": -1, "duration": 1.0, "uri": "/1.0.ts"}`, "index"},
+		{"part_exceeds_part_target", http.MethodPost, "/streams/s1/renditions/720p/segments/1/parts", `{"index": 1, "duration": 1.5, "uri": "/1.1.ts"}`, "duration"},
+		{"cue_missing_sequence", http.MethodPost, "/streams/s1/cues", `{"type": "out"}`, "sequence"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, bytes.NewReader([]byte(tt.body))))
+			if rec.Code != http.StatusBadRequest || rec.Header().Get("Content-Type") != problemContentType {
+				t.Fatalf("expected 400 problem, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+			}
+			var p Problem
+			if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil || len(p.Errors) != 1 || p.Errors[0].Field != tt.field {
+				t.Errorf("expected an error on %s, got %s", tt.field, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandler_patch_window_size(t *testing.T) {
+	h := newTestHandler(t)
+	r := newTestRouter(h)
+	do := func(method, target, body string) int {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(method, target, bytes.NewReader([]byte(body))))
+		return rec.Code
+	}
+
+	if code := do(http.MethodPatch, "/streams/s1/settings", `{"window_size": 3}`); code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing stream, got %d", code)
+	}
+	_ = h.svc.UpdateStreamSettings("s1", StreamSettings{Encryption: EncryptionAES128, GapPolicy: GapPolicySkip})
+	_ = h.svc.RegisterRendition("s1", "720p", RenditionInfo{Bandwidth: 2800000, Resolution: "1280x720"})
+
+	// PATCH only changes the window size.
+	if code := do(http.MethodPatch, "/streams/s1/settings", `{"window_size": 3}`); code != http.StatusOK {
+		t.Fatalf("patch settings: expected 200, got %d", code)
+	}
+	if code := do(http.MethodPatch, "/streams/s1/renditions/720p", `{"window_size": 2}`); code != http.StatusOK {
+		t.Fatalf("patch rendition: expected 200, got %d", code)
+	}
+	settings, _ := h.svc.repo.GetStreamSettings("s1")
+	if settings.WindowSize != 3 || settings.Encryption != EncryptionAES128 || settings.GapPolicy != GapPolicySkip {
+		t.Errorf("expected only window_size patched, got %+v", settings)
+	}
+	rendition, _, _ := h.svc.GetRendition("s1", "720p")
+	if rendition.Info.WindowSize != 2 || rendition.Info.Bandwidth != 2800000 || rendition.Info.Resolution != "1280x720" {
+		t.Errorf("expected only window_size patched, got %+v", rendition.Info)
+	}
+	if code := do(http.MethodPatch, "/streams/s1/settings", `{"window_size": 3, "encryption": ""}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a field other than window_size, got %d", code)
+	}
+	if code := do(http.MethodPatch, "/streams/s1/renditions/480p", `{"window_size": 2}`); code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing rendition, got %d", code)
+	}
+
+	// PUT replaces everything, so omitted settings are reset.
+	if code := do(http.MethodPut, "/streams/s1/settings", `{"window_size": 4}`); code != http.StatusOK {
+		t.Fatalf("put settings: expected 200, got %d", code)
+	}
+	settings, _ = h.svc.repo.GetStreamSettings("s1")
+	if settings.WindowSize != 4 || settings.Encryption != "" || settings.GapPolicy != "" {
+		t.Errorf("expected PUT to replace all settings, got %+v", settings)
+	}
+}
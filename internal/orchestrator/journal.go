@@ -0,0 +1,61 @@
+package orchestrator
+
+import "time"
+
+// OpKind identifies the kind of repository mutation recorded in an Op.
+type OpKind string
+
+const (
+	OpRegisterRendition OpKind = "register_rendition"
+	OpRegisterPart      OpKind = "register_part"
+	OpRegisterSegment   OpKind = "register_segment"
+	OpEndStream         OpKind = "end_stream"
+	OpEndRendition      OpKind = "end_rendition"
+	OpDeleteStream      OpKind = "delete_stream"
+	OpPurgeStream       OpKind = "purge_stream"
+	OpUpdateSettings    OpKind = "update_settings"
+	OpRegisterCue       OpKind = "register_cue"
+	OpAddKey            OpKind = "add_key"
+	OpCreateStream      OpKind = "create_stream"
+	OpSetWindowSize     OpKind = "set_window_size"
+)
+
+// Op is a single accepted repository mutation. Only the fields relevant to
+// Kind are set. Ops are what a Journal records and replays.
+type Op struct {
+	Index       uint64          `json:"index"` // assigned by the Journal
+	Kind        OpKind          `json:"kind"`
+	At          time.Time       `json:"at"`
+	StreamID    StreamID        `json:"stream_id"`
+	RenditionID RenditionID     `json:"rendition_id,omitempty"`
+	Sequence    int64           `json:"sequence,omitempty"`
+	Segment     *Segment        `json:"segment,omitempty"`
+	Part        *PartialSegment `json:"part,omitempty"`
+	Info        *RenditionInfo  `json:"info,omitempty"`
+	Settings    *StreamSettings `json:"settings,omitempty"`
+	Cue         *Cue            `json:"cue,omitempty"`
+	Key         *ContentKey     `json:"key,omitempty"`
+	WindowSize  int             `json:"window_size,omitempty"`
+}
+
+// Journal is implemented by durable Stores that record every mutation in an
+// append-only log. InMemoryRepository appends each accepted Op before applying
+// it and replays the journal in Restore.
+type Journal interface {
+	// Append durably records op, assigning its Index.
+	Append(op Op) error
+
+	// Replay calls apply for every recorded op not yet reflected in the
+	// store's state, oldest first.
+	Replay(apply func(op Op) error) error
+
+	// Checkpoint is called after an appended op has been applied to the
+	// store's state. Implementations may use it to snapshot the state and
+	// truncate the log.
+	Checkpoint() error
+}
+
+// removesStream reports whether ops of kind k delete their stream.
+func (k OpKind) removesStream() bool {
+	return k == OpDeleteStream || k == OpPurgeStream
+}
@@ -0,0 +1,153 @@
+package orchestrator
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// EncryptionMethod is the #EXT-X-KEY METHOD used to protect a stream.
+type EncryptionMethod string
+
+const (
+	EncryptionAES128    EncryptionMethod = "AES-128"
+	EncryptionSampleAES EncryptionMethod = "SAMPLE-AES"
+)
+
+// contentKeySize is the size in bytes of AES-128 keys and IVs.
+const contentKeySize = 16
+
+var (
+	// ErrEncryptionDisabled is returned when keys are requested for a stream
+	// without an encryption method.
+	ErrEncryptionDisabled = errors.New("stream is not encrypted")
+
+	// ErrKeyExists is returned when a different key already starts at the
+	// same sequence number.
+	ErrKeyExists = errors.New("a different key already starts at this sequence")
+)
+
+// ContentKey is a content encryption key of a stream. It protects the
+// segments from FirstSequence up to the FirstSequence of the next key.
+// This also matches the JSON payload for importing and issuing keys.
+type ContentKey struct {
+	FirstSequence int64            `json:"sequence"`
+	Method        EncryptionMethod `json:"method,omitempty"`
+	Key           []byte           `json:"key,omitempty"` // base64 in JSON
+	IV            []byte           `json:"iv,omitempty"`  // base64 in JSON; omitted to use the media sequence number
+}
+
+// valid reports whether m is empty (no encryption) or a known method.
+func (m EncryptionMethod) valid() bool {
+	switch m {
+	case "", EncryptionAES128, EncryptionSampleAES:
+		return true
+	}
+	return false
+}
+
+// validate reports every invalid field of a key request. Without a key it
+// asks for the key of a period, so method and iv only apply to imports.
+func (k ContentKey) validate() []FieldError {
+	var errs []FieldError
+	if k.FirstSequence < 0 {
+		errs = append(errs, FieldError{Field: "sequence", Message: "must not be negative"})
+	}
+	if !k.Method.valid() {
+		errs = append(errs, FieldError{Field: "method", Message: "must be AES-128 or SAMPLE-AES"})
+	}
+	if len(k.Key) > 0 && len(k.Key) != contentKeySize {
+		errs = append(errs, FieldError{Field: "key", Message: fmt.Sprintf("must be %d bytes", contentKeySize)})
+	}
+	if len(k.IV) > 0 && len(k.IV) != contentKeySize {
+		errs = append(errs, FieldError{Field: "iv", Message: fmt.Sprintf("must be %d bytes", contentKeySize)})
+	}
+	if len(k.Key) == 0 {
+		if k.Method != "" {
+			errs = append(errs, FieldError{Field: "method", Message: "requires key"})
+		}
+		if len(k.IV) > 0 {
+			errs = append(errs, FieldError{Field: "iv", Message: "requires key"})
+		}
+	}
+	return errs
+}
+
+// keyFor returns the key protecting segment seq: the key with the greatest
+// FirstSequence not after seq. keys must be sorted by FirstSequence.
+func keyFor(keys []ContentKey, seq int64) (ContentKey, bool) {
+	i := sort.Search(len(keys), func(i int) bool { return keys[i].FirstSequence > seq })
+	if i == 0 {
+		return ContentKey{}, false
+	}
+	return keys[i-1], true
+}
+
+// sameKey reports whether a and b carry the same key material.
+func sameKey(a, b ContentKey) bool {
+	return a.FirstSequence == b.FirstSequence && a.Method == b.Method &&
+		bytes.Equal(a.Key, b.Key) && bytes.Equal(a.IV, b.IV)
+}
+
+// IssueKey returns the key of the rotation period that contains segment seq,
+// generating a random key and IV for the period if it has none yet. Periods
+// start every KeyRotation segments, or at sequence 0 if rotation is disabled.
+// It returns ErrEncryptionDisabled if the stream has no encryption method.
+func (s *Service) IssueKey(streamID StreamID, seq int64) (ContentKey, error) {
+	settings, _ := s.repo.GetStreamSettings(streamID)
+	if settings.Encryption == "" {
+		return ContentKey{}, ErrEncryptionDisabled
+	}
+	var first int64
+	if n := int64(settings.KeyRotation); n > 0 {
+		first = seq - seq%n
+	}
+	if key, ok := s.repo.GetKey(streamID, first); ok {
+		return key, nil
+	}
+
+	key := ContentKey{
+		FirstSequence: first,
+		Method:        settings.Encryption,
+		Key:           make([]byte, contentKeySize),
+		IV:            make([]byte, contentKeySize),
+	}
+	if _, err := rand.Read(key.Key); err != nil {
+		return ContentKey{}, fmt.Errorf("generate key: %w", err)
+	}
+	if _, err := rand.Read(key.IV); err != nil {
+		return ContentKey{}, fmt.Errorf("generate iv: %w", err)
+	}
+
+	err := s.repo.AddKey(streamID, key)
+	if err == ErrKeyExists {
+		// Another request (or replica) issued the period's key first.
+		if existing, ok := s.repo.GetKey(streamID, first); ok {
+			return existing, nil
+		}
+	}
+	if err != nil {
+		return ContentKey{}, err
+	}
+	return key, nil
+}
+
+// ImportKey stores a key supplied by the caller. An omitted method defaults
+// to the stream's encryption method. Importing the same key twice is a no-op.
+func (s *Service) ImportKey(streamID StreamID, key ContentKey) error {
+	settings, _ := s.repo.GetStreamSettings(streamID)
+	if settings.Encryption == "" {
+		return ErrEncryptionDisabled
+	}
+	if key.Method == "" {
+		key.Method = settings.Encryption
+	}
+	return s.repo.AddKey(streamID, key)
+}
+
+// GetKey returns the key of a stream that starts at firstSequence.
+func (s *Service) GetKey(streamID StreamID, firstSequence int64) (ContentKey, bool) {
+	return s.repo.GetKey(streamID, firstSequence)
+}
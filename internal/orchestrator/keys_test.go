@@ -0,0 +1,89 @@
+package orchestrator
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestService_IssueKey(t *testing.T) {
+	svc := NewService(NewInMemoryRepository(), 6)
+
+	if _, err := svc.IssueKey("s1", 0); !errors.Is(err, ErrEncryptionDisabled) {
+		t.Errorf("expected ErrEncryptionDisabled, got %v", err)
+	}
+
+	_ = svc.UpdateStreamSettings("s1", StreamSettings{Encryption: EncryptionAES128, KeyRotation: 4})
+	k1, err := svc.IssueKey("s1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1.FirstSequence != 0 || k1.Method != EncryptionAES128 || len(k1.Key) != 16 || len(k1.IV) != 16 {
+		t.Errorf("unexpected first key: %+v", k1)
+	}
+	again, _ := svc.IssueKey("s1", 3)
+	if !sameKey(k1, again) {
+		t.Error("expected the same key within a rotation period")
+	}
+	k2, _ := svc.IssueKey("s1", 5)
+	if k2.FirstSequence != 4 || bytes.Equal(k1.Key, k2.Key) {
+		t.Errorf("expected a new key from sequence 4, got %+v", k2)
+	}
+	if got, ok := svc.GetKey("s1", 4); !ok || !sameKey(got, k2) {
+		t.Errorf("GetKey: expected the issued key, got ok=%v %+v", ok, got)
+	}
+}
+
+func TestService_ImportKey(t *testing.T) {
+	svc := NewService(NewInMemoryRepository(), 6)
+	_ = svc.UpdateStreamSettings("s1", StreamSettings{Encryption: EncryptionSampleAES})
+	key := ContentKey{FirstSequence: 10, Key: bytes.Repeat([]byte{1}, 16)}
+
+	if err := svc.ImportKey("s1", key); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.ImportKey("s1", key); err != nil {
+		t.Errorf("importing the same key again should be a no-op: %v", err)
+	}
+	key.Key = bytes.Repeat([]byte{2}, 16)
+	if err := svc.ImportKey("s1", key); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("expected ErrKeyExists, got %v", err)
+	}
+	if got, _ := svc.GetKey("s1", 10); got.Method != EncryptionSampleAES {
+		t.Errorf("expected the stream's method by default, got %q", got.Method)
+	}
+}
+
+func TestService_GetPlaylist_key_rotation(t *testing.T) {
+	svc := NewService(NewInMemoryRepository(), 6)
+	_ = svc.UpdateStreamSettings("s1", StreamSettings{Encryption: EncryptionAES128, KeyRotation: 3})
+	for i := int64(1); i <= 6; i++ {
+		if _, err := svc.IssueKey("s1", i); err != nil {
+			t.Fatal(err)
+		}
+		_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: i, Duration: 2.0, Path: "/x.ts"})
+	}
+
+	m3u8, _ := svc.GetPlaylist("s1", "720p")
+	if n := strings.Count(m3u8, "#EXT-X-KEY:METHOD=AES-128,"); n != 3 {
+		t.Errorf("expected keys for periods 0, 3 and 6, got %d: %s", n, m3u8)
+	}
+	if !strings.Contains(m3u8, `URI="../../keys/3",IV=0x`) {
+		t.Errorf("expected the key URI of period 3: %s", m3u8)
+	}
+	if i := strings.Index(m3u8, `URI="../../keys/3"`); i < 0 || strings.Count(m3u8[:i], "#EXTINF") != 2 {
+		t.Errorf("expected the period 3 key after segments 1 and 2: %s", m3u8)
+	}
+
+	// Replacing the settings without encryption keeps the keys of the
+	// segments that were encrypted with them.
+	_ = svc.UpdateStreamSettings("s1", StreamSettings{})
+	if m3u8, _ := svc.GetPlaylist("s1", "720p"); strings.Count(m3u8, "#EXT-X-KEY:METHOD=AES-128,") != 3 {
+		t.Errorf("expected the keys after encryption was turned off: %s", m3u8)
+	}
+	_ = svc.EndStream("s1")
+	if vod, _ := svc.GetVODPlaylist("s1", "720p"); strings.Count(vod, "#EXT-X-KEY:METHOD=AES-128,") != 3 {
+		t.Errorf("expected the keys in the VOD playlist: %s", vod)
+	}
+}
@@ -0,0 +1,161 @@
+package orchestrator
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MediaType is the kind of a rendition. VIDEO renditions are listed as
+// #EXT-X-STREAM-INF variants of the multivariant playlist; the others are
+// alternate renditions listed as #EXT-X-MEDIA entries of a group that
+// variants refer to.
+type MediaType string
+
+const (
+	MediaTypeVideo          MediaType = "VIDEO"
+	MediaTypeAudio          MediaType = "AUDIO"
+	MediaTypeSubtitles      MediaType = "SUBTITLES"
+	MediaTypeClosedCaptions MediaType = "CLOSED-CAPTIONS"
+)
+
+// valid reports whether t is empty (VIDEO) or a known media type.
+func (t MediaType) valid() bool {
+	switch t {
+	case "", MediaTypeVideo, MediaTypeAudio, MediaTypeSubtitles, MediaTypeClosedCaptions:
+		return true
+	}
+	return false
+}
+
+// isVariant reports whether renditions of type t are variants rather than
+// alternate renditions.
+func (t MediaType) isVariant() bool {
+	return t == "" || t == MediaTypeVideo
+}
+
+// validateMedia reports the first invalid alternate rendition field of info,
+// if any.
+func (info RenditionInfo) validateMedia() error {
+	if !info.Type.valid() {
+		return fmt.Errorf("unknown type %q", info.Type)
+	}
+	if info.Type.isVariant() {
+		return nil
+	}
+	if info.GroupID == "" || info.Name == "" {
+		return fmt.Errorf("group_id and name are required for %s renditions", info.Type)
+	}
+	if info.Type == MediaTypeClosedCaptions && !validInstreamID(info.InstreamID) {
+		return fmt.Errorf("instream_id must be CC1-CC4 or SERVICE1-SERVICE63 for CLOSED-CAPTIONS renditions")
+	}
+	for name, value := range map[string]string{"group_id": info.GroupID, "name": info.Name, "language": info.Language} {
+		if !validQuotedString(value) {
+			return fmt.Errorf("%s must not contain quotes or control characters", name)
+		}
+	}
+	return nil
+}
+
+// validInstreamID reports whether id is a valid INSTREAM-ID value.
+func validInstreamID(id string) bool {
+	switch id {
+	case "CC1", "CC2", "CC3", "CC4":
+		return true
+	}
+	service, ok := strings.CutPrefix(id, "SERVICE")
+	if !ok {
+		return false
+	}
+	n, err := strconv.Atoi(service)
+	return err == nil && n >= 1 && n <= 63 && service == strconv.Itoa(n)
+}
+
+// hasMedia reports whether any rendition that has not ended is an alternate
+// rendition.
+func hasMedia(renditions []RenditionSummary) bool {
+	for _, r := range renditions {
+		if !r.Info.Type.isVariant() && !r.Ended {
+			return true
+		}
+	}
+	return false
+}
+
+// writeMediaGroups writes the #EXT-X-MEDIA entries of the alternate renditions,
+// grouped by type and group ID, and returns the set of groups written.
+func writeMediaGroups(b *strings.Builder, renditions []RenditionSummary, token string) map[MediaType]map[string]bool {
+	media := make([]RenditionSummary, 0, len(renditions))
+	for _, r := range renditions {
+		if !r.Info.Type.isVariant() && !r.Ended {
+			media = append(media, r)
+		}
+	}
+	sort.SliceStable(media, func(i, j int) bool {
+		a, b := media[i].Info, media[j].Info
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.GroupID != b.GroupID {
+			return a.GroupID < b.GroupID
+		}
+		return media[i].ID < media[j].ID
+	})
+
+	groups := make(map[MediaType]map[string]bool)
+	for _, m := range media {
+		if groups[m.Info.Type] == nil {
+			groups[m.Info.Type] = make(map[string]bool)
+		}
+		groups[m.Info.Type][m.Info.GroupID] = true
+		b.WriteString("#EXT-X-MEDIA:" + mediaAttributes(m, token) + "\n")
+	}
+	return groups
+}
+
+// mediaAttributes formats the attribute list of an #EXT-X-MEDIA tag.
+func mediaAttributes(r RenditionSummary, token string) string {
+	info := r.Info
+	attrs := []string{
+		"TYPE=" + string(info.Type),
+		fmt.Sprintf("GROUP-ID=%q", info.GroupID),
+	}
+	if info.Language != "" {
+		attrs = append(attrs, fmt.Sprintf("LANGUAGE=%q", info.Language))
+	}
+	attrs = append(attrs, fmt.Sprintf("NAME=%q", info.Name))
+	if info.Default {
+		attrs = append(attrs, "DEFAULT=YES")
+	}
+	// AUTOSELECT must be YES if DEFAULT is YES.
+	if info.AutoSelect || info.Default {
+		attrs = append(attrs, "AUTOSELECT=YES")
+	}
+	if info.Type == MediaTypeClosedCaptions {
+		attrs = append(attrs, fmt.Sprintf("INSTREAM-ID=%q", info.InstreamID))
+	} else {
+		attrs = append(attrs, fmt.Sprintf("URI=%q", withToken(fmt.Sprintf(mediaPlaylistURIFormat, r.ID), token)))
+	}
+	return strings.Join(attrs, ",")
+}
+
+// groupAttributes formats the AUDIO, SUBTITLES and CLOSED-CAPTIONS attributes
+// of a variant. Groups without any alternate rendition are left out, since
+// they would make the playlist invalid.
+func groupAttributes(info RenditionInfo, groups map[MediaType]map[string]bool) []string {
+	var attrs []string
+	for _, ref := range []struct {
+		typ   MediaType
+		group string
+	}{
+		{MediaTypeAudio, info.AudioGroup},
+		{MediaTypeSubtitles, info.SubtitlesGroup},
+		{MediaTypeClosedCaptions, info.ClosedCaptionsGroup},
+	} {
+		if ref.group != "" && groups[ref.typ][ref.group] {
+			attrs = append(attrs, fmt.Sprintf("%s=%q", ref.typ, ref.group))
+		}
+	}
+	return attrs
+}
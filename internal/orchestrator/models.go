@@ -1,6 +1,14 @@
 package orchestrator
 
-import "time"
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
 
 // StreamID uniquely identifies a live stream.
 type StreamID string
@@ -15,15 +23,332 @@ type Segment struct {
 	Duration float64 `json:"duration"`
 	Path     string  `json:"path"`
 
+	// Discontinuity marks a change in encoding parameters or timestamps
+	// between the previous segment and this one (#EXT-X-DISCONTINUITY).
+	Discontinuity bool `json:"discontinuity,omitempty"`
+
+	// ProgramDateTime is the wall-clock time of the first sample of the
+	// segment (#EXT-X-PROGRAM-DATE-TIME). If omitted, it is derived when the
+	// segment is registered.
+	ProgramDateTime *time.Time `json:"program_date_time,omitempty"`
+
+	// ByteRangeLength and ByteRangeOffset address the segment as a sub-range
+	// of the resource at Path (#EXT-X-BYTERANGE). If the offset is omitted,
+	// the range starts right after the previous segment of the same resource.
+	ByteRangeLength int64  `json:"byte_range_length,omitempty"`
+	ByteRangeOffset *int64 `json:"byte_range_offset,omitempty"`
+
 	// Metadata managed by the orchestrator (not exposed in the API).
-	ReceivedAt time.Time `json:"-"` // when this segment was registered
+	ReceivedAt time.Time        `json:"-"` // when this segment was registered
+	Parts      []PartialSegment `json:"-"` // LL-HLS parts folded in when the segment was registered
+	Gap        bool             `json:"-"` // placeholder for a missing segment (#EXT-X-GAP); never stored
+	Map        *InitSection     `json:"-"` // initialization section of the rendition when registered
+}
+
+// validate reports the invalid fields of seg. Durations that round to more
+// than maxDuration seconds are rejected unless maxDuration is 0.
+func (seg Segment) validate(maxDuration int) []FieldError {
+	var errs []FieldError
+	if seg.Sequence < 0 {
+		errs = append(errs, FieldError{Field: "sequence", Message: "must not be negative"})
+	}
+	switch {
+	case math.IsNaN(seg.Duration) || math.IsInf(seg.Duration, 0) || seg.Duration <= 0:
+		errs = append(errs, FieldError{Field: "duration", Message: "must be a positive number"})
+	case maxDuration > 0 && math.Round(seg.Duration) > float64(maxDuration):
+		errs = append(errs, FieldError{Field: "duration", Message: fmt.Sprintf("must not exceed the target duration of %d seconds", maxDuration)})
+	}
+	if msg := invalidURI(seg.Path); msg != "" {
+		errs = append(errs, FieldError{Field: "path", Message: msg})
+	}
+	if seg.ByteRangeLength < 0 {
+		errs = append(errs, FieldError{Field: "byte_range_length", Message: "must not be negative"})
+	}
+	if seg.ByteRangeOffset != nil {
+		switch {
+		case seg.ByteRangeLength == 0:
+			errs = append(errs, FieldError{Field: "byte_range_offset", Message: "requires byte_range_length"})
+		case *seg.ByteRangeOffset < 0:
+			errs = append(errs, FieldError{Field: "byte_range_offset", Message: "must not be negative"})
+		}
+	}
+	return errs
+}
+
+// validate reports every invalid field of a part registration.
+func (part PartialSegment) validate() []FieldError {
+	var errs []FieldError
+	if part.Index < 0 {
+		errs = append(errs, FieldError{Field: "index", Message: "must not be negative"})
+	}
+	if math.IsNaN(part.Duration) || math.IsInf(part.Duration, 0) || part.Duration <= 0 {
+		errs = append(errs, FieldError{Field: "duration", Message: "must be a positive number"})
+	}
+	if msg := invalidURI(part.URI); msg != "" {
+		errs = append(errs, FieldError{Field: "uri", Message: msg})
+	}
+	return errs
+}
+
+// invalidURI explains why uri cannot be written as a playlist URI line, or
+// returns "" if it can.
+func invalidURI(uri string) string {
+	switch {
+	case uri == "":
+		return "must not be empty"
+	case strings.HasPrefix(uri, "#"):
+		return "must not start with #"
+	case strings.IndexFunc(uri, func(r rune) bool { return r < 0x20 || r == 0x7f || unicode.IsSpace(r) }) >= 0:
+		return "must not contain whitespace or control characters"
+	}
+	if _, err := url.Parse(uri); err != nil {
+		return "must be a valid URI"
+	}
+	return ""
+}
+
+// byteRangeEnd returns the offset of the first byte after the sub-range of
+// seg. It must only be called on segments with a resolved byte range.
+func (seg Segment) byteRangeEnd() int64 {
+	return *seg.ByteRangeOffset + seg.ByteRangeLength
+}
+
+// PartialSegment represents a single LL-HLS partial segment (#EXT-X-PART) of
+// the media segment identified by Sequence.
+// This also matches the input JSON payload for registering parts; Sequence is
+// taken from the URL.
+type PartialSegment struct {
+	Sequence    int64     `json:"-"`
+	Index       int       `json:"index"`
+	Duration    float64   `json:"duration"`
+	URI         string    `json:"uri"`
+	Independent bool      `json:"independent,omitempty"`
+	ReceivedAt  time.Time `json:"-"` // when this part was registered
+}
+
+// RenditionInfo is the variant metadata a transcoder registers for a rendition.
+// It drives the #EXT-X-STREAM-INF attributes of the multivariant playlist.
+type RenditionInfo struct {
+	Bandwidth  int64   `json:"bandwidth,omitempty"`  // peak bits per second; required for VIDEO renditions
+	Resolution string  `json:"resolution,omitempty"` // e.g. "1280x720"
+	Codecs     string  `json:"codecs,omitempty"`     // e.g. "avc1.4d401f,mp4a.40.2"
+	FrameRate  float64 `json:"frame_rate,omitempty"` // e.g. 29.97
+
+	AverageBandwidth int64  `json:"average_bandwidth,omitempty"` // average bits per second
+	HDCPLevel        string `json:"hdcp_level,omitempty"`        // "TYPE-0", "TYPE-1" or "NONE"
+	VideoRange       string `json:"video_range,omitempty"`       // "SDR", "HLG" or "PQ"
+	AudioGroup       string `json:"audio_group,omitempty"`       // GROUP-ID of the variant's alternate audio
+
+	// SubtitlesGroup and ClosedCaptionsGroup link a variant to groups of
+	// alternate renditions, like AudioGroup.
+	SubtitlesGroup      string `json:"subtitles_group,omitempty"`
+	ClosedCaptionsGroup string `json:"closed_captions_group,omitempty"`
+
+	// Type is the kind of rendition, VIDEO (the default) or an alternate
+	// rendition (AUDIO, SUBTITLES, CLOSED-CAPTIONS) listed as #EXT-X-MEDIA.
+	// Alternate renditions need a GroupID and Name; closed captions are
+	// carried in the video and need an InstreamID instead of segments.
+	Type       MediaType `json:"type,omitempty"`
+	GroupID    string    `json:"group_id,omitempty"`
+	Name       string    `json:"name,omitempty"`
+	Language   string    `json:"language,omitempty"` // RFC 5646 tag, e.g. "en"
+	Default    bool      `json:"default,omitempty"`
+	AutoSelect bool      `json:"autoselect,omitempty"`
+	InstreamID string    `json:"instream_id,omitempty"` // e.g. "CC1"
+
+	// TargetDuration fixes the rendition's #EXT-X-TARGETDURATION in seconds.
+	// If omitted, it is locked from the first registered segment.
+	TargetDuration int `json:"target_duration,omitempty"`
+
+	// PartTarget fixes the rendition's LL-HLS PART-TARGET in seconds. If
+	// omitted, it is locked from the first registered part.
+	PartTarget float64 `json:"part_target,omitempty"`
+
+	// WindowSize is the number of segments in the rendition's live playlist,
+	// overriding the stream's window size. 0 uses the stream's.
+	WindowSize int `json:"window_size,omitempty"`
+
+	// Container is the segment format, "ts" (the default) or "fmp4". fMP4
+	// (CMAF) renditions need an initialization section.
+	Container string `json:"container,omitempty"`
+
+	// InitURI, optionally with a byte range, locates the media
+	// initialization section (#EXT-X-MAP) of segments registered from now on.
+	InitURI             string `json:"init_uri,omitempty"`
+	InitByteRangeLength int64  `json:"init_byte_range_length,omitempty"`
+	InitByteRangeOffset int64  `json:"init_byte_range_offset,omitempty"`
+}
+
+// Segment containers.
+const (
+	ContainerTS   = "ts"
+	ContainerFMP4 = "fmp4"
+)
+
+// InitSection locates the media initialization section of a segment.
+type InitSection struct {
+	URI             string
+	ByteRangeLength int64 // 0 for the whole resource
+	ByteRangeOffset int64
+}
+
+// validate reports the first invalid field of info, if any.
+func (info RenditionInfo) validate() error {
+	if err := info.validateMedia(); err != nil {
+		return err
+	}
+	if info.Type.isVariant() && info.Bandwidth <= 0 {
+		return fmt.Errorf("bandwidth must be positive")
+	}
+	if info.Bandwidth < 0 {
+		return fmt.Errorf("bandwidth must not be negative")
+	}
+	if info.FrameRate < 0 {
+		return fmt.Errorf("frame_rate must not be negative")
+	}
+	if info.TargetDuration < 0 {
+		return fmt.Errorf("target_duration must not be negative")
+	}
+	if info.PartTarget < 0 {
+		return fmt.Errorf("part_target must not be negative")
+	}
+	if info.WindowSize < 0 {
+		return fmt.Errorf("window_size must not be negative")
+	}
+	if info.AverageBandwidth < 0 || info.AverageBandwidth > info.Bandwidth {
+		return fmt.Errorf("average_bandwidth must be between 0 and bandwidth")
+	}
+	if info.Resolution != "" && !validResolution(info.Resolution) {
+		return fmt.Errorf("resolution must be WIDTHxHEIGHT, e.g. 1280x720")
+	}
+	switch info.HDCPLevel {
+	case "", "TYPE-0", "TYPE-1", "NONE":
+	default:
+		return fmt.Errorf("unknown hdcp_level %q", info.HDCPLevel)
+	}
+	switch info.VideoRange {
+	case "", "SDR", "HLG", "PQ":
+	default:
+		return fmt.Errorf("unknown video_range %q", info.VideoRange)
+	}
+	for name, value := range map[string]string{
+		"codecs":                info.Codecs,
+		"audio_group":           info.AudioGroup,
+		"subtitles_group":       info.SubtitlesGroup,
+		"closed_captions_group": info.ClosedCaptionsGroup,
+		"init_uri":              info.InitURI,
+	} {
+		if !validQuotedString(value) {
+			return fmt.Errorf("%s must not contain quotes or control characters", name)
+		}
+	}
+	switch info.Container {
+	case "", ContainerTS:
+	case ContainerFMP4:
+		if info.InitURI == "" {
+			return fmt.Errorf("init_uri is required for fmp4 renditions")
+		}
+	default:
+		return fmt.Errorf("unknown container %q", info.Container)
+	}
+	if info.InitByteRangeLength < 0 || info.InitByteRangeOffset < 0 {
+		return fmt.Errorf("init byte range must not be negative")
+	}
+	if info.InitByteRangeOffset > 0 && info.InitByteRangeLength == 0 {
+		return fmt.Errorf("init_byte_range_offset requires init_byte_range_length")
+	}
+	return nil
+}
+
+// validResolution reports whether s is a decimal-resolution such as 1280x720.
+func validResolution(s string) bool {
+	w, h, ok := strings.Cut(s, "x")
+	if !ok {
+		return false
+	}
+	width, err1 := strconv.Atoi(w)
+	height, err2 := strconv.Atoi(h)
+	return err1 == nil && err2 == nil && width > 0 && height > 0
+}
+
+// validQuotedString reports whether s can be written as a playlist
+// quoted-string attribute value.
+func validQuotedString(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool { return r == '"' || r < 0x20 || r == 0x7f }) < 0
+}
+
+// initSection returns the initialization section of segments registered
+// with info, or nil if there is none.
+func (info RenditionInfo) initSection() *InitSection {
+	if info.InitURI == "" {
+		return nil
+	}
+	return &InitSection{URI: info.InitURI, ByteRangeLength: info.InitByteRangeLength, ByteRangeOffset: info.InitByteRangeOffset}
 }
 
 // RenditionState holds all in-memory state for a specific rendition of a stream.
 type RenditionState struct {
 	ID       RenditionID
+	Info     RenditionInfo
 	Segments map[int64]Segment
+	Parts    map[int64][]PartialSegment // parts of segments not yet registered, by sequence
+	Ended    bool
+
+	// EvictedDiscontinuities counts discontinuity segments removed by the
+	// retention policy; it seeds #EXT-X-DISCONTINUITY-SEQUENCE.
+	EvictedDiscontinuities int64
+
+	// TargetDuration is the #EXT-X-TARGETDURATION of every playlist of the
+	// rendition: declared in Info, configured for the repository, or the
+	// duration of the first segment rounded up. 0 until any of these
+	// happens; it never changes once set.
+	TargetDuration int
+
+	// PartTarget is the #EXT-X-PART-INF PART-TARGET of every playlist of the
+	// rendition: declared in Info or the duration of the first part. 0 until
+	// either happens; it never changes once parts are registered.
+	PartTarget float64
+}
+
+// RenditionSnapshot is a read-only copy of a rendition's playlist state.
+type RenditionSnapshot struct {
+	Segments []Segment                  // sorted by sequence ascending
+	Parts    map[int64][]PartialSegment // parts of segments not yet registered, by sequence
 	Ended    bool
+
+	EvictedDiscontinuities int64   // discontinuity segments evicted before Segments[0]
+	TargetDuration         int     // locked target duration; 0 if not locked yet
+	PartTarget             float64 // locked part target duration; 0 if not locked yet
+	WindowSize             int     // the rendition's own window size; 0 uses the stream's
+
+	Settings StreamSettings // settings of the rendition's stream
+	Cues     []Cue          // cues of the rendition's stream, sorted by sequence
+	Keys     []ContentKey   // keys of the rendition's stream, sorted by first sequence
+}
+
+// RenditionSummary is a read-only view of a rendition without its segments.
+// This also matches the JSON response of the rendition endpoint.
+type RenditionSummary struct {
+	ID             RenditionID   `json:"id"`
+	Info           RenditionInfo `json:"info"`
+	Ended          bool          `json:"ended"`
+	TargetDuration int           `json:"target_duration,omitempty"` // locked target duration; 0 if not locked yet
+
+	SegmentCount   int    `json:"segment_count"`
+	LatestSequence *int64 `json:"latest_sequence,omitempty"` // omitted without segments
+}
+
+// StreamSummary is a read-only view of a stream without its segments.
+// This also matches the JSON response of the stream endpoints.
+type StreamSummary struct {
+	ID             StreamID           `json:"id"`
+	Ended          bool               `json:"ended"`
+	Settings       StreamSettings     `json:"settings"`
+	Renditions     []RenditionSummary `json:"renditions"`
+	LatestSequence *int64             `json:"latest_sequence,omitempty"` // newest sequence of any rendition
+	CreatedAt      time.Time          `json:"created_at"`
+	UpdatedAt      time.Time          `json:"updated_at"`
+	EndedAt        *time.Time         `json:"ended_at,omitempty"`
 }
 
 // StreamState is the top-level in-memory representation of a live stream.
@@ -31,4 +356,150 @@ type StreamState struct {
 	ID         StreamID
 	Renditions map[RenditionID]*RenditionState
 	Ended      bool
+	Settings   StreamSettings
+	Cues       []Cue        // ad break signals, sorted by sequence
+	Keys       []ContentKey // content keys, sorted by first sequence
+
+	CreatedAt time.Time // first mutation
+	UpdatedAt time.Time // latest mutation
+	EndedAt   time.Time // when the stream was ended; zero if not ended
+}
+
+// TargetDurationPolicy selects what happens to a segment whose duration,
+// rounded to the nearest second, exceeds its rendition's target duration.
+type TargetDurationPolicy string
+
+const (
+	// TargetDurationFlag accepts the segment and keeps the target duration.
+	TargetDurationFlag TargetDurationPolicy = "flag"
+
+	// TargetDurationReject rejects the segment with ErrTargetDurationExceeded.
+	TargetDurationReject TargetDurationPolicy = "reject"
+)
+
+// GapPolicy selects how a media playlist handles missing segments.
+type GapPolicy string
+
+const (
+	// GapPolicyTruncate ends the playlist at the first missing segment until
+	// the hole falls out of the sliding window.
+	GapPolicyTruncate GapPolicy = "truncate"
+
+	// GapPolicySkip waits up to the gap timeout for a missing segment, then
+	// restarts the playlist after the hole.
+	GapPolicySkip GapPolicy = "skip"
+
+	// GapPolicyGap waits up to the gap timeout for a missing segment, then
+	// lists an #EXT-X-GAP placeholder in its place.
+	GapPolicyGap GapPolicy = "gap"
+)
+
+// PlaylistType selects which segments a media playlist lists.
+type PlaylistType string
+
+const (
+	// PlaylistTypeLive is a sliding window of the most recent segments.
+	PlaylistTypeLive PlaylistType = "live"
+
+	// PlaylistTypeEvent lists every segment since the start of the stream
+	// (#EXT-X-PLAYLIST-TYPE:EVENT); segments are never evicted.
+	PlaylistTypeEvent PlaylistType = "event"
+
+	// PlaylistTypeDVR is a sliding window covering the stream's DVR window,
+	// so viewers can rewind that far behind the live edge.
+	PlaylistTypeDVR PlaylistType = "dvr"
+)
+
+// DefaultDVRWindow is the rewind depth of DVR playlists when the stream does
+// not set one.
+const DefaultDVRWindow = 2 * time.Hour
+
+// StreamSettings is the per-stream playlist configuration. Zero values select
+// the service defaults.
+// This also matches the input JSON payload for updating stream settings.
+type StreamSettings struct {
+	GapPolicy  GapPolicy `json:"gap_policy,omitempty"`  // default GapPolicyTruncate
+	GapTimeout float64   `json:"gap_timeout,omitempty"` // seconds to wait for a missing segment
+
+	PlaylistType PlaylistType `json:"playlist_type,omitempty"` // default PlaylistTypeLive
+	DVRWindow    float64      `json:"dvr_window,omitempty"`    // seconds of rewind for PlaylistTypeDVR
+
+	CueFormat CueFormat `json:"cue_format,omitempty"` // default CueFormatDateRange
+
+	Encryption  EncryptionMethod `json:"encryption,omitempty"`   // default none
+	KeyRotation int              `json:"key_rotation,omitempty"` // segments per key; 0 never rotates
+
+	// LastWriterWins replaces a registered segment when its sequence number is
+	// registered again with a different payload, instead of rejecting it.
+	LastWriterWins bool `json:"last_writer_wins,omitempty"`
+
+	// Aligned caps the live edge of every rendition's playlist at the lowest
+	// live edge of the stream's live renditions, so that players switching
+	// renditions always find the same sequence numbers.
+	Aligned bool `json:"aligned,omitempty"`
+
+	// WindowSize is the number of segments in live playlists of the stream,
+	// unless a rendition sets its own. 0 uses the service's default.
+	WindowSize int `json:"window_size,omitempty"`
+
+	// Archive keeps every segment of the stream, like an EVENT playlist, so
+	// that its VOD playlist is the complete recording. Live and DVR streams
+	// are otherwise pruned by the repository's retention policy.
+	Archive bool `json:"archive,omitempty"`
+
+	// TTL is how long, in seconds, the stream is kept after it ends or after
+	// its last update if it never ends, overriding the repository's TTLs.
+	// 0 uses the repository's TTLs.
+	TTL float64 `json:"ttl,omitempty"`
+}
+
+// validate reports the first invalid field of s, if any.
+func (s StreamSettings) validate() error {
+	switch s.GapPolicy {
+	case "", GapPolicyTruncate, GapPolicySkip, GapPolicyGap:
+	default:
+		return fmt.Errorf("unknown gap_policy %q", s.GapPolicy)
+	}
+	if s.GapTimeout < 0 {
+		return fmt.Errorf("gap_timeout must not be negative")
+	}
+	if !s.PlaylistType.valid() {
+		return fmt.Errorf("unknown playlist_type %q", s.PlaylistType)
+	}
+	if s.DVRWindow < 0 {
+		return fmt.Errorf("dvr_window must not be negative")
+	}
+	if !s.CueFormat.valid() {
+		return fmt.Errorf("unknown cue_format %q", s.CueFormat)
+	}
+	if !s.Encryption.valid() {
+		return fmt.Errorf("unknown encryption %q", s.Encryption)
+	}
+	if s.KeyRotation < 0 {
+		return fmt.Errorf("key_rotation must not be negative")
+	}
+	if s.WindowSize < 0 {
+		return fmt.Errorf("window_size must not be negative")
+	}
+	if s.TTL < 0 {
+		return fmt.Errorf("ttl must not be negative")
+	}
+	return nil
+}
+
+// dvrWindow returns the rewind depth of DVR playlists of the stream.
+func (s StreamSettings) dvrWindow() time.Duration {
+	if s.DVRWindow > 0 {
+		return seconds(s.DVRWindow)
+	}
+	return DefaultDVRWindow
+}
+
+// valid reports whether t is empty (the default) or a known playlist type.
+func (t PlaylistType) valid() bool {
+	switch t {
+	case "", PlaylistTypeLive, PlaylistTypeEvent, PlaylistTypeDVR:
+		return true
+	}
+	return false
 }
@@ -1,48 +1,386 @@
 package orchestrator
 
 import (
+	"encoding/hex"
 	"fmt"
 	"math"
+	"net/url"
+	"sort"
 	"strings"
 )
 
+// programDateTimeLayout formats #EXT-X-PROGRAM-DATE-TIME values (ISO 8601
+// with milliseconds).
+const programDateTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// MediaPlaylist describes a media playlist to be rendered by BuildMediaPlaylist.
+type MediaPlaylist struct {
+	Segments []Segment // ordered by sequence ascending
+	Ended    bool
+
+	// TargetDuration is the #EXT-X-TARGETDURATION value. If 0, it is the
+	// longest duration in Segments, rounded up.
+	TargetDuration int
+
+	// PartTarget is the #EXT-X-PART-INF PART-TARGET value, written only if
+	// the playlist lists any parts. If 0, it is the longest listed part.
+	PartTarget float64
+
+	// Type is the #EXT-X-PLAYLIST-TYPE value (e.g. "EVENT"), or empty for a
+	// sliding window playlist.
+	Type string
+
+	// Cues are the ad break markers on entries in Segments, written in the
+	// given format.
+	Cues      []CueMarker
+	CueFormat CueFormat
+
+	// Keys are the content keys protecting Segments, sorted by first
+	// sequence. Segments before the first key are not encrypted.
+	Keys []ContentKey
+
+	// DiscontinuitySequence is the number of discontinuities that precede
+	// the first entry in Segments (#EXT-X-DISCONTINUITY-SEQUENCE).
+	DiscontinuitySequence int64
+
+	// PendingParts are the LL-HLS parts of the segment that follows the last
+	// entry in Segments and has not been registered yet.
+	PendingParts []PartialSegment
+
+	// Token, if set, is added to the key URIs as the token query parameter,
+	// for players that cannot set an Authorization header.
+	Token string
+
+	// CanBlockReload advertises blocking playlist reload (_HLS_msn) with
+	// #EXT-X-SERVER-CONTROL, which players require before using it.
+	CanBlockReload bool
+}
+
 // BuildLivePlaylist converts a slice of segments (ordered by sequence ascending)
 // into a valid HLS live playlist string. If ended is true, #EXT-X-ENDLIST is appended.
 // An empty segments slice produces a minimal valid playlist with media sequence 0.
 func BuildLivePlaylist(segments []Segment, ended bool) string {
+	return BuildMediaPlaylist(MediaPlaylist{Segments: segments, Ended: ended})
+}
+
+// BuildMediaPlaylist renders p as an HLS media playlist. #EXT-X-SERVER-CONTROL
+// advertises blocking reload if p.CanBlockReload is set, and PART-HOLD-BACK
+// when any partial segments are present. With partial segments, the LL-HLS
+// #EXT-X-PART-INF tag is emitted and parts are listed for segments within the
+// last three target durations, followed by the pending parts of the
+// in-progress segment.
+// Segments with a known wall-clock time get #EXT-X-PROGRAM-DATE-TIME.
+// Cues are written as #EXT-X-DATERANGE and/or #EXT-X-CUE-OUT/#EXT-X-CUE-IN,
+// and #EXT-X-KEY is written wherever the content key changes.
+// Gap placeholders are tagged #EXT-X-GAP, which requires version 8.
+// #EXT-X-MAP is written before the first segment and wherever the
+// initialization section changes.
+// Byte-range segments get #EXT-X-BYTERANGE, whose offset is left implicit
+// when the range directly follows the previous segment's range.
+// Discontinuous segments are preceded by #EXT-X-DISCONTINUITY, and
+// #EXT-X-DISCONTINUITY-SEQUENCE is emitted once any have left the playlist.
+func BuildMediaPlaylist(p MediaPlaylist) string {
 	var b strings.Builder
 
+	partTarget := partTargetFromPlaylist(p)
+
 	b.WriteString("#EXTM3U\n")
-	b.WriteString("#EXT-X-VERSION:3\n")
+	b.WriteString(fmt.Sprintf("#EXT-X-VERSION:%d\n", mediaPlaylistVersion(p, partTarget)))
+
+	if p.Type != "" {
+		b.WriteString("#EXT-X-PLAYLIST-TYPE:" + p.Type + "\n")
+	}
 
-	if len(segments) == 0 {
-		b.WriteString("#EXT-X-TARGETDURATION:1\n")
+	targetDuration := p.TargetDuration
+	if targetDuration <= 0 {
+		targetDuration = targetDurationFromSegments(p.Segments)
+	}
+
+	if len(p.Segments) == 0 && len(p.PendingParts) == 0 {
+		b.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", targetDuration))
+		writeServerControl(&b, p.CanBlockReload, 0)
 		b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
-		if ended {
+		if p.Ended {
 			b.WriteString("#EXT-X-ENDLIST\n")
 		}
 		return b.String()
 	}
 
-	targetDuration := targetDurationFromSegments(segments)
-	mediaSequence := segments[0].Sequence
+	var mediaSequence int64
+	if len(p.Segments) > 0 {
+		mediaSequence = p.Segments[0].Sequence
+	} else {
+		mediaSequence = p.PendingParts[0].Sequence
+	}
 
 	b.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", targetDuration))
-	b.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n\n", mediaSequence))
+	writeServerControl(&b, p.CanBlockReload || partTarget > 0, partTarget)
+	if partTarget > 0 {
+		b.WriteString(fmt.Sprintf("#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget))
+	}
+	b.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", mediaSequence))
+	if p.DiscontinuitySequence > 0 {
+		b.WriteString(fmt.Sprintf("#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", p.DiscontinuitySequence))
+	}
+	b.WriteString("\n")
 
-	for _, seg := range segments {
+	firstWithParts := firstSegmentWithParts(p.Segments, targetDuration)
+	currentKey := int64(-1)
+	var currentMap *InitSection
+	var prevRange *Segment
+	for i, seg := range p.Segments {
+		if seg.Map != nil && (currentMap == nil || *seg.Map != *currentMap) {
+			b.WriteString("#EXT-X-MAP:" + mapAttributes(*seg.Map) + "\n")
+			currentMap = seg.Map
+		}
+		if key, ok := keyFor(p.Keys, seg.Sequence); ok && key.FirstSequence != currentKey {
+			b.WriteString("#EXT-X-KEY:" + keyAttributes(key, p.Token) + "\n")
+			currentKey = key.FirstSequence
+		}
+		if seg.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if i >= firstWithParts {
+			writeParts(&b, seg.Parts)
+		}
+		if seg.ProgramDateTime != nil {
+			b.WriteString("#EXT-X-PROGRAM-DATE-TIME:" + seg.ProgramDateTime.UTC().Format(programDateTimeLayout) + "\n")
+		}
+		writeCues(&b, p.Cues, seg.Sequence, p.CueFormat)
+		if seg.Gap {
+			b.WriteString("#EXT-X-GAP\n")
+		}
 		b.WriteString(fmt.Sprintf("#EXTINF:%.1f,\n", seg.Duration))
+		if seg.ByteRangeLength > 0 {
+			b.WriteString(fmt.Sprintf("#EXT-X-BYTERANGE:%d", seg.ByteRangeLength))
+			if prevRange == nil || prevRange.Path != seg.Path || prevRange.byteRangeEnd() != *seg.ByteRangeOffset {
+				b.WriteString(fmt.Sprintf("@%d", *seg.ByteRangeOffset))
+			}
+			b.WriteString("\n")
+			prevRange = &p.Segments[i]
+		} else {
+			prevRange = nil
+		}
 		b.WriteString(seg.Path)
 		b.WriteString("\n")
 	}
+	writeParts(&b, p.PendingParts)
 
-	if ended {
+	if p.Ended {
 		b.WriteString("#EXT-X-ENDLIST\n")
 	}
 
 	return b.String()
 }
 
+// writeServerControl writes #EXT-X-SERVER-CONTROL advertising blocking
+// reload, with PART-HOLD-BACK if the playlist lists parts (partTarget > 0).
+func writeServerControl(b *strings.Builder, canBlockReload bool, partTarget float64) {
+	if !canBlockReload {
+		return
+	}
+	b.WriteString("#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES")
+	if partTarget > 0 {
+		b.WriteString(fmt.Sprintf(",PART-HOLD-BACK=%.3f", 3*partTarget))
+	}
+	b.WriteString("\n")
+}
+
+// writeParts writes one #EXT-X-PART tag per partial segment.
+func writeParts(b *strings.Builder, parts []PartialSegment) {
+	for _, part := range parts {
+		b.WriteString(fmt.Sprintf("#EXT-X-PART:DURATION=%.3f,URI=%q", part.Duration, part.URI))
+		if part.Independent {
+			b.WriteString(",INDEPENDENT=YES")
+		}
+		b.WriteString("\n")
+	}
+}
+
+// firstSegmentWithParts returns the index of the oldest segment whose parts
+// should still be listed: parts are only kept for segments within the last
+// three target durations of the playlist.
+func firstSegmentWithParts(segments []Segment, targetDuration int) int {
+	limit := 3 * float64(targetDuration)
+	total := 0.0
+	for i := len(segments) - 1; i >= 0; i-- {
+		total += segments[i].Duration
+		if total > limit {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// mediaPlaylistVersion returns the lowest #EXT-X-VERSION that supports the
+// tags BuildMediaPlaylist writes for p.
+func mediaPlaylistVersion(p MediaPlaylist, partTarget float64) int {
+	version := 3
+	for _, seg := range p.Segments {
+		if seg.Gap {
+			return 8
+		}
+		switch {
+		case seg.Map != nil:
+			version = 6
+		case seg.ByteRangeLength > 0 && version < 4:
+			version = 4
+		}
+	}
+	for _, key := range p.Keys {
+		if key.Method == EncryptionSampleAES && version < 5 {
+			version = 5
+		}
+	}
+	if partTarget > 0 {
+		version = 6
+	}
+	return version
+}
+
+// mapAttributes formats the attribute list of an #EXT-X-MAP tag.
+func mapAttributes(m InitSection) string {
+	attrs := fmt.Sprintf("URI=%q", m.URI)
+	if m.ByteRangeLength > 0 {
+		attrs += fmt.Sprintf(",BYTERANGE=\"%d@%d\"", m.ByteRangeLength, m.ByteRangeOffset)
+	}
+	return attrs
+}
+
+// mediaPlaylistURIFormat is the URI of a media playlist relative to the
+// multivariant playlist (/streams/{stream_id}/master.m3u8).
+const mediaPlaylistURIFormat = "renditions/%s/playlist.m3u8"
+
+// keyURIFormat is the URI of a content key relative to the media playlist
+// (/streams/{stream_id}/renditions/{rendition}/playlist.m3u8).
+const keyURIFormat = "../../keys/%d"
+
+// withToken adds token to uri as the token query parameter, if set.
+func withToken(uri, token string) string {
+	if token == "" {
+		return uri
+	}
+	return uri + "?token=" + url.QueryEscape(token)
+}
+
+// keyAttributes formats the attribute list of an #EXT-X-KEY tag.
+func keyAttributes(key ContentKey, token string) string {
+	attrs := []string{
+		"METHOD=" + string(key.Method),
+		fmt.Sprintf("URI=%q", withToken(fmt.Sprintf(keyURIFormat, key.FirstSequence), token)),
+	}
+	if len(key.IV) > 0 {
+		attrs = append(attrs, "IV=0x"+strings.ToUpper(hex.EncodeToString(key.IV)))
+	}
+	return strings.Join(attrs, ",")
+}
+
+// partTargetFromPlaylist returns the #EXT-X-PART-INF PART-TARGET value: 0 if
+// there are no parts in the playlist, otherwise p.PartTarget or, if that is
+// not set, the maximum duration of any part in the playlist.
+func partTargetFromPlaylist(p MediaPlaylist) float64 {
+	max := 0.0
+	for _, seg := range p.Segments {
+		for _, part := range seg.Parts {
+			max = math.Max(max, part.Duration)
+		}
+	}
+	for _, part := range p.PendingParts {
+		max = math.Max(max, part.Duration)
+	}
+	if max > 0 && p.PartTarget > 0 {
+		return p.PartTarget
+	}
+	return max
+}
+
+// BuildMasterPlaylist converts rendition summaries into an HLS multivariant
+// playlist with one #EXT-X-STREAM-INF entry per VIDEO rendition, preceded by
+// one #EXT-X-MEDIA entry per alternate (AUDIO, SUBTITLES, CLOSED-CAPTIONS)
+// rendition. Ended renditions and variants without a registered bandwidth
+// (BANDWIDTH is a required attribute) are skipped.
+// Variant URIs are relative to /streams/{stream_id}/master.m3u8.
+func BuildMasterPlaylist(renditions []RenditionSummary) string {
+	return BuildMasterPlaylistWithToken(renditions, "")
+}
+
+// BuildMasterPlaylistWithToken is BuildMasterPlaylist with token added to the
+// variant and alternate rendition URIs as the token query parameter, so that
+// players that cannot set an Authorization header carry it to the key URIs.
+func BuildMasterPlaylistWithToken(renditions []RenditionSummary, token string) string {
+	variants := make([]RenditionSummary, 0, len(renditions))
+	for _, r := range renditions {
+		if r.Info.Type.isVariant() && r.Info.Bandwidth > 0 && !r.Ended {
+			variants = append(variants, r)
+		}
+	}
+	// Highest bandwidth first; ties broken by ID for a stable output.
+	sort.SliceStable(variants, func(i, j int) bool {
+		if variants[i].Info.Bandwidth != variants[j].Info.Bandwidth {
+			return variants[i].Info.Bandwidth > variants[j].Info.Bandwidth
+		}
+		return variants[i].ID < variants[j].ID
+	})
+
+	var b strings.Builder
+
+	b.WriteString("#EXTM3U\n")
+	b.WriteString(fmt.Sprintf("#EXT-X-VERSION:%d\n", masterPlaylistVersion(renditions)))
+
+	var groups map[MediaType]map[string]bool
+	if hasMedia(renditions) {
+		b.WriteString("\n")
+		groups = writeMediaGroups(&b, renditions, token)
+	}
+
+	for _, v := range variants {
+		b.WriteString("\n#EXT-X-STREAM-INF:")
+		b.WriteString(streamInfAttributes(v.Info, groups))
+		b.WriteString("\n")
+		b.WriteString(withToken(fmt.Sprintf(mediaPlaylistURIFormat, v.ID), token) + "\n")
+	}
+
+	return b.String()
+}
+
+// masterPlaylistVersion returns the lowest #EXT-X-VERSION that supports the
+// tags BuildMasterPlaylistWithToken writes for renditions: an INSTREAM-ID of
+// SERVICE1-SERVICE63 requires version 7.
+func masterPlaylistVersion(renditions []RenditionSummary) int {
+	for _, r := range renditions {
+		if r.Info.Type == MediaTypeClosedCaptions && !r.Ended && strings.HasPrefix(r.Info.InstreamID, "SERVICE") {
+			return 7
+		}
+	}
+	return 3
+}
+
+// streamInfAttributes formats the attribute list of an #EXT-X-STREAM-INF tag,
+// linking the variant to the alternate rendition groups that exist.
+func streamInfAttributes(info RenditionInfo, groups map[MediaType]map[string]bool) string {
+	attrs := []string{fmt.Sprintf("BANDWIDTH=%d", info.Bandwidth)}
+	if info.AverageBandwidth > 0 {
+		attrs = append(attrs, fmt.Sprintf("AVERAGE-BANDWIDTH=%d", info.AverageBandwidth))
+	}
+	if info.Resolution != "" {
+		attrs = append(attrs, "RESOLUTION="+info.Resolution)
+	}
+	if info.Codecs != "" {
+		attrs = append(attrs, fmt.Sprintf("CODECS=%q", info.Codecs))
+	}
+	if info.FrameRate > 0 {
+		attrs = append(attrs, fmt.Sprintf("FRAME-RATE=%.3f", info.FrameRate))
+	}
+	if info.HDCPLevel != "" {
+		attrs = append(attrs, "HDCP-LEVEL="+info.HDCPLevel)
+	}
+	if info.VideoRange != "" {
+		attrs = append(attrs, "VIDEO-RANGE="+info.VideoRange)
+	}
+	attrs = append(attrs, groupAttributes(info, groups)...)
+	return strings.Join(attrs, ",")
+}
+
 // targetDurationFromSegments returns the HLS #EXT-X-TARGETDURATION value:
 // the ceiling of the maximum segment duration in seconds (integer).
 func targetDurationFromSegments(segments []Segment) int {
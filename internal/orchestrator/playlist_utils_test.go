@@ -3,6 +3,7 @@ package orchestrator
 import (
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestBuildLivePlaylist_empty_not_ended(t *testing.T) {
@@ -81,3 +82,282 @@ func TestBuildLivePlaylist_target_duration_ceiling(t *testing.T) {
 		t.Errorf("expected TARGETDURATION 2 (ceil 1.1): %s", out)
 	}
 }
+
+func TestBuildMasterPlaylist(t *testing.T) {
+	renditions := []RenditionSummary{
+		{ID: "480p", Info: RenditionInfo{Bandwidth: 1400000, Resolution: "854x480", Codecs: "avc1.4d401e,mp4a.40.2", FrameRate: 30}},
+		{ID: "720p", Info: RenditionInfo{Bandwidth: 2800000, Resolution: "1280x720", Codecs: "avc1.4d401f,mp4a.40.2", FrameRate: 29.97}},
+		{ID: "unregistered"},
+	}
+	out := BuildMasterPlaylist(renditions)
+
+	if !strings.HasPrefix(out, "#EXTM3U\n") {
+		t.Error("expected #EXTM3U header")
+	}
+	want720 := "#EXT-X-STREAM-INF:BANDWIDTH=2800000,RESOLUTION=1280x720,CODECS=\"avc1.4d401f,mp4a.40.2\",FRAME-RATE=29.970\nrenditions/720p/playlist.m3u8\n"
+	if !strings.Contains(out, want720) {
+		t.Errorf("expected 720p variant entry: %s", out)
+	}
+	if !strings.Contains(out, "renditions/480p/playlist.m3u8") {
+		t.Errorf("expected 480p variant entry: %s", out)
+	}
+	if strings.Index(out, "renditions/720p/") > strings.Index(out, "renditions/480p/") {
+		t.Errorf("expected highest bandwidth first: %s", out)
+	}
+	if strings.Contains(out, "unregistered") {
+		t.Errorf("renditions without bandwidth should be skipped: %s", out)
+	}
+}
+
+func TestBuildMasterPlaylist_optional_attributes(t *testing.T) {
+	out := BuildMasterPlaylist([]RenditionSummary{{ID: "audio", Info: RenditionInfo{Bandwidth: 128000}}})
+	if !strings.Contains(out, "#EXT-X-STREAM-INF:BANDWIDTH=128000\n") {
+		t.Errorf("expected only BANDWIDTH attribute: %s", out)
+	}
+}
+
+func TestBuildMasterPlaylist_extended_attributes(t *testing.T) {
+	out := BuildMasterPlaylist([]RenditionSummary{{ID: "2160p", Info: RenditionInfo{
+		Bandwidth: 16000000, AverageBandwidth: 12000000, Resolution: "3840x2160", HDCPLevel: "TYPE-1", VideoRange: "PQ",
+	}}})
+	want := "#EXT-X-STREAM-INF:BANDWIDTH=16000000,AVERAGE-BANDWIDTH=12000000,RESOLUTION=3840x2160,HDCP-LEVEL=TYPE-1,VIDEO-RANGE=PQ\n"
+	if !strings.Contains(out, want) {
+		t.Errorf("expected AVERAGE-BANDWIDTH, HDCP-LEVEL and VIDEO-RANGE: %s", out)
+	}
+}
+
+func TestBuildMasterPlaylist_media_groups(t *testing.T) {
+	out := BuildMasterPlaylist([]RenditionSummary{
+		{ID: "720p", Info: RenditionInfo{Bandwidth: 2800000, AudioGroup: "aac", SubtitlesGroup: "subs", ClosedCaptionsGroup: "missing"}},
+		{ID: "audio-en", Info: RenditionInfo{Type: MediaTypeAudio, GroupID: "aac", Name: "English", Language: "en", Default: true}},
+		{ID: "audio-de", Info: RenditionInfo{Type: MediaTypeAudio, GroupID: "aac", Name: "Deutsch", Language: "de", AutoSelect: true}},
+		{ID: "subs-en", Info: RenditionInfo{Type: MediaTypeSubtitles, GroupID: "subs", Name: "English", Language: "en"}},
+		{ID: "cc", Info: RenditionInfo{Type: MediaTypeClosedCaptions, GroupID: "cc", Name: "English CC", InstreamID: "CC1"}},
+	})
+
+	want := "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aac\",LANGUAGE=\"de\",NAME=\"Deutsch\",AUTOSELECT=YES,URI=\"renditions/audio-de/playlist.m3u8\"\n" +
+		"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aac\",LANGUAGE=\"en\",NAME=\"English\",DEFAULT=YES,AUTOSELECT=YES,URI=\"renditions/audio-en/playlist.m3u8\"\n" +
+		"#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID=\"cc\",NAME=\"English CC\",INSTREAM-ID=\"CC1\"\n" +
+		"#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",LANGUAGE=\"en\",NAME=\"English\",URI=\"renditions/subs-en/playlist.m3u8\"\n"
+	if !strings.Contains(out, want) {
+		t.Errorf("expected EXT-X-MEDIA entries grouped by type and group: %s", out)
+	}
+	if !strings.Contains(out, "#EXT-X-STREAM-INF:BANDWIDTH=2800000,AUDIO=\"aac\",SUBTITLES=\"subs\"\nrenditions/720p/playlist.m3u8\n") {
+		t.Errorf("expected the variant to link existing groups only: %s", out)
+	}
+	if strings.Count(out, "#EXT-X-STREAM-INF") != 1 {
+		t.Errorf("expected alternate renditions not to be variants: %s", out)
+	}
+}
+
+func TestBuildMasterPlaylist_version(t *testing.T) {
+	renditions := []RenditionSummary{
+		{ID: "720p", Info: RenditionInfo{Bandwidth: 2800000, ClosedCaptionsGroup: "cc"}},
+		{ID: "cc", Info: RenditionInfo{Type: MediaTypeClosedCaptions, GroupID: "cc", Name: "English CC", InstreamID: "CC1"}},
+	}
+	if out := BuildMasterPlaylist(renditions); !strings.Contains(out, "#EXT-X-VERSION:3\n") {
+		t.Errorf("expected version 3 for CC1: %s", out)
+	}
+
+	renditions[1].Info.InstreamID = "SERVICE1"
+	if out := BuildMasterPlaylist(renditions); !strings.Contains(out, "#EXT-X-VERSION:7\n") || !strings.Contains(out, `INSTREAM-ID="SERVICE1"`) {
+		t.Errorf("expected version 7 for SERVICE1: %s", out)
+	}
+}
+
+func TestBuildMediaPlaylist_parts(t *testing.T) {
+	p := MediaPlaylist{
+		Segments: []Segment{
+			{Sequence: 10, Duration: 2.0, Path: "/10.ts", Parts: []PartialSegment{
+				{Sequence: 10, Index: 0, Duration: 1.0, URI: "/10.0.ts", Independent: true},
+				{Sequence: 10, Index: 1, Duration: 1.0, URI: "/10.1.ts"},
+			}},
+		},
+		PendingParts: []PartialSegment{{Sequence: 11, Index: 0, Duration: 0.5, URI: "/11.0.ts", Independent: true}},
+	}
+	out := BuildMediaPlaylist(p)
+
+	for _, want := range []string{
+		"#EXT-X-VERSION:6\n",
+		"#EXT-X-PART-INF:PART-TARGET=1.000\n",
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=3.000\n",
+		"#EXT-X-PART:DURATION=1.000,URI=\"/10.0.ts\",INDEPENDENT=YES\n#EXT-X-PART:DURATION=1.000,URI=\"/10.1.ts\"\n#EXTINF:2.0,\n/10.ts\n",
+		"/10.ts\n#EXT-X-PART:DURATION=0.500,URI=\"/11.0.ts\",INDEPENDENT=YES\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in playlist: %s", want, out)
+		}
+	}
+}
+
+func TestBuildMediaPlaylist_server_control_without_parts(t *testing.T) {
+	p := MediaPlaylist{
+		Segments:       []Segment{{Sequence: 1, Duration: 2.0, Path: "/1.ts"}},
+		CanBlockReload: true,
+	}
+	out := BuildMediaPlaylist(p)
+	if !strings.Contains(out, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES\n") || strings.Contains(out, "#EXT-X-PART-INF") {
+		t.Errorf("expected CAN-BLOCK-RELOAD without PART-HOLD-BACK: %s", out)
+	}
+
+	if out := BuildMediaPlaylist(MediaPlaylist{CanBlockReload: true}); !strings.Contains(out, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES\n") {
+		t.Errorf("expected CAN-BLOCK-RELOAD in an empty playlist: %s", out)
+	}
+
+	p.CanBlockReload = false
+	if out := BuildMediaPlaylist(p); strings.Contains(out, "#EXT-X-SERVER-CONTROL") {
+		t.Errorf("expected no SERVER-CONTROL: %s", out)
+	}
+}
+
+func TestBuildMediaPlaylist_parts_only_for_recent_segments(t *testing.T) {
+	var segs []Segment
+	for i := int64(1); i <= 5; i++ {
+		segs = append(segs, Segment{Sequence: i, Duration: 2.0, Path: "/s.ts", Parts: []PartialSegment{
+			{Sequence: i, Index: 0, Duration: 1.0, URI: "/p.ts"},
+		}})
+	}
+	out := BuildMediaPlaylist(MediaPlaylist{Segments: segs})
+	// Target duration 2s: parts are kept for the last 6s, i.e. 3 segments.
+	if n := strings.Count(out, "#EXT-X-PART:"); n != 3 {
+		t.Errorf("expected parts for the last 3 segments, got %d: %s", n, out)
+	}
+}
+
+func TestBuildMediaPlaylist_pending_parts_only(t *testing.T) {
+	out := BuildMediaPlaylist(MediaPlaylist{
+		PendingParts: []PartialSegment{{Sequence: 7, Index: 0, Duration: 0.5, URI: "/7.0.ts"}},
+	})
+	if !strings.Contains(out, "#EXT-X-MEDIA-SEQUENCE:7") {
+		t.Errorf("expected media sequence of the in-progress segment: %s", out)
+	}
+	if !strings.Contains(out, "URI=\"/7.0.ts\"") {
+		t.Errorf("expected pending part: %s", out)
+	}
+}
+
+func TestBuildMediaPlaylist_discontinuity(t *testing.T) {
+	out := BuildMediaPlaylist(MediaPlaylist{
+		Segments: []Segment{
+			{Sequence: 10, Duration: 2.0, Path: "/10.ts"},
+			{Sequence: 11, Duration: 2.0, Path: "/slate.ts", Discontinuity: true},
+		},
+		DiscontinuitySequence: 2,
+	})
+
+	if !strings.Contains(out, "#EXT-X-DISCONTINUITY-SEQUENCE:2\n") {
+		t.Errorf("expected DISCONTINUITY-SEQUENCE 2: %s", out)
+	}
+	if !strings.Contains(out, "/10.ts\n#EXT-X-DISCONTINUITY\n#EXTINF:2.0,\n/slate.ts\n") {
+		t.Errorf("expected DISCONTINUITY before the flagged segment: %s", out)
+	}
+
+	out = BuildLivePlaylist([]Segment{{Sequence: 1, Duration: 2.0, Path: "/1.ts"}}, false)
+	if strings.Contains(out, "DISCONTINUITY") {
+		t.Errorf("expected no discontinuity tags: %s", out)
+	}
+}
+
+func TestBuildMediaPlaylist_gap(t *testing.T) {
+	out := BuildMediaPlaylist(MediaPlaylist{
+		Segments: []Segment{
+			{Sequence: 1, Duration: 2.0, Path: "/1.ts"},
+			{Sequence: 2, Duration: 2.0, Path: "/1.ts", Gap: true},
+			{Sequence: 3, Duration: 2.0, Path: "/3.ts"},
+		},
+	})
+
+	if !strings.Contains(out, "#EXT-X-VERSION:8") {
+		t.Errorf("expected version 8 for EXT-X-GAP: %s", out)
+	}
+	if !strings.Contains(out, "/1.ts\n#EXT-X-GAP\n#EXTINF:2.0,\n/1.ts\n#EXTINF:2.0,\n/3.ts\n") {
+		t.Errorf("expected GAP placeholder for sequence 2: %s", out)
+	}
+}
+
+func TestBuildMediaPlaylist_program_date_time(t *testing.T) {
+	pdt := time.Date(2026, 3, 1, 8, 30, 0, 500000000, time.UTC)
+	out := BuildLivePlaylist([]Segment{{Sequence: 1, Duration: 2.0, Path: "/1.ts", ProgramDateTime: &pdt}}, false)
+
+	if !strings.Contains(out, "#EXT-X-PROGRAM-DATE-TIME:2026-03-01T08:30:00.500Z\n#EXTINF:2.0,\n/1.ts\n") {
+		t.Errorf("expected PROGRAM-DATE-TIME before the segment: %s", out)
+	}
+}
+
+func TestBuildMediaPlaylist_map(t *testing.T) {
+	init1 := &InitSection{URI: "/init1.mp4"}
+	init2 := &InitSection{URI: "/init.mp4", ByteRangeLength: 720, ByteRangeOffset: 0}
+	out := BuildMediaPlaylist(MediaPlaylist{
+		Segments: []Segment{
+			{Sequence: 1, Duration: 2.0, Path: "/1.m4s", Map: init1},
+			{Sequence: 2, Duration: 2.0, Path: "/2.m4s", Map: &InitSection{URI: "/init1.mp4"}},
+			{Sequence: 3, Duration: 2.0, Path: "/3.m4s", Map: init2},
+		},
+	})
+
+	if !strings.Contains(out, "#EXT-X-VERSION:6") {
+		t.Errorf("expected version 6 for EXT-X-MAP: %s", out)
+	}
+	if strings.Count(out, "#EXT-X-MAP:") != 2 {
+		t.Errorf("expected the map once per initialization section: %s", out)
+	}
+	if !strings.Contains(out, "#EXT-X-MAP:URI=\"/init1.mp4\"\n#EXTINF:2.0,\n/1.m4s\n") {
+		t.Errorf("expected map before the first segment: %s", out)
+	}
+	if !strings.Contains(out, "/2.m4s\n#EXT-X-MAP:URI=\"/init.mp4\",BYTERANGE=\"720@0\"\n#EXTINF:2.0,\n/3.m4s\n") {
+		t.Errorf("expected map with byte range when the init section changes: %s", out)
+	}
+}
+
+func TestBuildMediaPlaylist_byte_range(t *testing.T) {
+	offsets := []int64{0, 500, 1200, 0}
+	out := BuildMediaPlaylist(MediaPlaylist{
+		Segments: []Segment{
+			{Sequence: 1, Duration: 2.0, Path: "/min1.ts", ByteRangeLength: 500, ByteRangeOffset: &offsets[0]},
+			{Sequence: 2, Duration: 2.0, Path: "/min1.ts", ByteRangeLength: 600, ByteRangeOffset: &offsets[1]},
+			{Sequence: 3, Duration: 2.0, Path: "/min1.ts", ByteRangeLength: 300, ByteRangeOffset: &offsets[2]},
+			{Sequence: 4, Duration: 2.0, Path: "/min2.ts", ByteRangeLength: 400, ByteRangeOffset: &offsets[3]},
+		},
+	})
+
+	if !strings.Contains(out, "#EXT-X-VERSION:4") {
+		t.Errorf("expected version 4 for EXT-X-BYTERANGE: %s", out)
+	}
+	want := "#EXTINF:2.0,\n#EXT-X-BYTERANGE:500@0\n/min1.ts\n" +
+		"#EXTINF:2.0,\n#EXT-X-BYTERANGE:600\n/min1.ts\n" +
+		"#EXTINF:2.0,\n#EXT-X-BYTERANGE:300@1200\n/min1.ts\n" +
+		"#EXTINF:2.0,\n#EXT-X-BYTERANGE:400@0\n/min2.ts\n"
+	if !strings.Contains(out, want) {
+		t.Errorf("expected implicit offsets only for contiguous ranges: %s", out)
+	}
+}
+
+func TestBuildMediaPlaylist_sample_aes(t *testing.T) {
+	p := MediaPlaylist{
+		Segments: []Segment{{Sequence: 1, Duration: 2.0, Path: "/1.ts"}},
+		Keys:     []ContentKey{{FirstSequence: 1, Method: EncryptionSampleAES}},
+	}
+	if out := BuildMediaPlaylist(p); !strings.Contains(out, "#EXT-X-VERSION:5\n") || !strings.Contains(out, "METHOD=SAMPLE-AES") {
+		t.Errorf("expected version 5 for SAMPLE-AES: %s", out)
+	}
+
+	p.Keys[0].Method = EncryptionAES128
+	if out := BuildMediaPlaylist(p); !strings.Contains(out, "#EXT-X-VERSION:3\n") {
+		t.Errorf("expected version 3 for AES-128: %s", out)
+	}
+}
+
+func TestBuildMediaPlaylist_locked_target_duration(t *testing.T) {
+	out := BuildMediaPlaylist(MediaPlaylist{
+		Segments:       []Segment{{Sequence: 1, Duration: 2.0, Path: "/1.ts"}},
+		TargetDuration: 6,
+	})
+	if !strings.Contains(out, "#EXT-X-TARGETDURATION:6\n") {
+		t.Errorf("expected the locked target duration: %s", out)
+	}
+
+	out = BuildMediaPlaylist(MediaPlaylist{TargetDuration: 6})
+	if !strings.Contains(out, "#EXT-X-TARGETDURATION:6\n") {
+		t.Errorf("expected the locked target duration in an empty playlist: %s", out)
+	}
+}
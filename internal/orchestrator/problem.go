@@ -0,0 +1,118 @@
+package orchestrator
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const problemContentType = "application/problem+json"
+
+// DefaultMaxBodyBytes is the default limit on the size of request bodies
+// validated by the Handler.
+const DefaultMaxBodyBytes = 64 << 10
+
+// Problem is an RFC 9457 problem details response body.
+type Problem struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError describes why a single field of a request body is invalid.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// writeProblem writes a problem details response with the given status.
+func writeProblem(w http.ResponseWriter, status int, detail string, errs ...FieldError) {
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Errors: errs,
+	})
+}
+
+// decodeStrict decodes the JSON object in body into v. It rejects unknown
+// fields, trailing data, bodies larger than maxBytes and objects missing any
+// of the required fields. On failure it returns the status and problem to
+// report.
+func decodeStrict(w http.ResponseWriter, r *http.Request, maxBytes int64, v any, required ...string) (int, *Problem) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return http.StatusRequestEntityTooLarge, &Problem{Detail: fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit)}
+		}
+		return http.StatusBadRequest, &Problem{Detail: "cannot read request body"}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return http.StatusBadRequest, decodeProblem(err)
+	}
+	if dec.More() {
+		return http.StatusBadRequest, &Problem{Detail: "request body must contain a single JSON object"}
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return http.StatusBadRequest, decodeProblem(err)
+	}
+	var missing []FieldError
+	for _, name := range required {
+		if raw, ok := fields[name]; !ok || string(raw) == "null" {
+			missing = append(missing, FieldError{Field: name, Message: "is required"})
+		}
+	}
+	if len(missing) > 0 {
+		return http.StatusBadRequest, &Problem{Detail: "request body is missing required fields", Errors: missing}
+	}
+	return 0, nil
+}
+
+// decodeProblem converts a JSON decoding error into a problem, with a field
+// error where the failing field is known.
+func decodeProblem(err error) *Problem {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return &Problem{
+			Detail: "request body has fields of the wrong type",
+			Errors: []FieldError{{Field: typeErr.Field, Message: "must be a " + jsonTypeName(typeErr.Type.Kind().String())}},
+		}
+	}
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return &Problem{
+			Detail: "request body has unknown fields",
+			Errors: []FieldError{{Field: strings.Trim(name, `"`), Message: "is not a known field"}},
+		}
+	}
+	return &Problem{Detail: "request body is not a valid JSON object"}
+}
+
+// jsonTypeName names a Go kind the way a JSON client would think of it.
+func jsonTypeName(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+		return "number"
+	case kind == "bool":
+		return "boolean"
+	case kind == "slice", kind == "array":
+		return "array"
+	case kind == "struct", kind == "map", kind == "ptr":
+		return "object"
+	}
+	return kind
+}
@@ -0,0 +1,277 @@
+package orchestrator
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"hls-orchestrator/internal/platform/redis"
+)
+
+// DefaultRedisKeyPrefix is the default prefix of every key a RedisStore writes.
+const DefaultRedisKeyPrefix = "hls:"
+
+const (
+	redisLockTTL     = 5 * time.Second
+	redisLockTimeout = 2 * time.Second
+	redisLockRetry   = 10 * time.Millisecond
+)
+
+var (
+	// ErrLockTimeout is returned when a stream lock cannot be acquired in time.
+	ErrLockTimeout = errors.New("timed out acquiring stream lock")
+
+	// ErrLockLost is returned when a stream is written after its lock expired
+	// and may have been taken over by another replica.
+	ErrLockLost = errors.New("stream lock lost")
+)
+
+// unlockScript deletes a lock only if it still holds our token, so a lock that
+// expired and was taken over by another replica is never released by us.
+const unlockScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+
+// renewScript extends a lock only if it still holds our token.
+const renewScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`
+
+// saveScript writes a stream (KEYS[2]) and adds it to the stream set
+// (KEYS[3]) only if the lock (KEYS[1]) still holds our token, so a replica
+// whose lock expired cannot overwrite the state of the one that took it over.
+const saveScript = `if redis.call("GET", KEYS[1]) ~= ARGV[1] then return 0 end
+redis.call("SET", KEYS[2], ARGV[2])
+redis.call("SADD", KEYS[3], ARGV[3])
+return 1`
+
+// removeScript is saveScript for deleting a stream.
+const removeScript = `if redis.call("GET", KEYS[1]) ~= ARGV[1] then return 0 end
+redis.call("DEL", KEYS[2])
+redis.call("SREM", KEYS[3], ARGV[2])
+return 1`
+
+// RedisStore is a SharedStore that keeps stream state in a Redis-compatible
+// server so that several orchestrator replicas can serve the same streams.
+// Each stream is stored gob-encoded under "{prefix}stream:{id}", stream IDs
+// are tracked in the "{prefix}streams" set, and mutations are serialised with
+// a "{prefix}lock:{id}" lock (SET NX PX with a random token).
+//
+// A held lock is renewed until it is released, and SaveStream and
+// RemoveStream only write while the lock still holds our token. Every
+// mutation reads and writes the whole stream, so its cost grows with the
+// number of renditions and retained segments; keep retention bounded.
+type RedisStore struct {
+	client *redis.Client
+	prefix string
+
+	lockTTL     time.Duration
+	lockTimeout time.Duration
+
+	mu    sync.Mutex
+	locks map[StreamID]string // tokens of the locks held by this store
+}
+
+// NewRedisStore returns a store that uses client and prefixes every key with
+// prefix. If prefix is empty, DefaultRedisKeyPrefix is used.
+func NewRedisStore(client *redis.Client, prefix string) *RedisStore {
+	if prefix == "" {
+		prefix = DefaultRedisKeyPrefix
+	}
+	return &RedisStore{
+		client:      client,
+		prefix:      prefix,
+		lockTTL:     redisLockTTL,
+		lockTimeout: redisLockTimeout,
+		locks:       make(map[StreamID]string),
+	}
+}
+
+// GetStream implements Store.GetStream. Backend errors are reported as not found;
+// use LoadStream to tell them apart, as the repository's read paths do.
+func (s *RedisStore) GetStream(id StreamID) (*StreamState, bool) {
+	st, ok, err := s.LoadStream(id)
+	if err != nil {
+		return nil, false
+	}
+	return st, ok
+}
+
+// SetStream implements Store.SetStream. Backend errors are dropped; use
+// SaveStream to observe them.
+func (s *RedisStore) SetStream(st *StreamState) {
+	_ = s.SaveStream(st)
+}
+
+// DeleteStream implements Store.DeleteStream. Backend errors are dropped; use
+// RemoveStream to observe them.
+func (s *RedisStore) DeleteStream(id StreamID) {
+	_ = s.RemoveStream(id)
+}
+
+// ListStreamIDs implements Store.ListStreamIDs.
+func (s *RedisStore) ListStreamIDs() []StreamID {
+	reply, err := s.client.Do("SMEMBERS", s.prefix+"streams")
+	if err != nil {
+		return nil
+	}
+	items, _ := reply.([]interface{})
+	ids := make([]StreamID, 0, len(items))
+	for _, item := range items {
+		if b, ok := item.([]byte); ok {
+			ids = append(ids, StreamID(b))
+		}
+	}
+	return ids
+}
+
+// LoadStream implements SharedStore.LoadStream.
+func (s *RedisStore) LoadStream(id StreamID) (*StreamState, bool, error) {
+	reply, err := s.client.Do("GET", s.streamKey(id))
+	if err != nil {
+		return nil, false, err
+	}
+	if reply == nil {
+		return nil, false, nil
+	}
+	b, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("unexpected GET reply %T", reply)
+	}
+
+	var st StreamState
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&st); err != nil {
+		return nil, false, fmt.Errorf("decode stream %s: %w", id, err)
+	}
+	initStreamMaps(&st)
+	return &st, true, nil
+}
+
+// SaveStream implements SharedStore.SaveStream. If this store holds the
+// stream's lock, the write is fenced by it and fails with ErrLockLost once
+// the lock has expired.
+func (s *RedisStore) SaveStream(st *StreamState) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(st); err != nil {
+		return fmt.Errorf("encode stream %s: %w", st.ID, err)
+	}
+	if token, ok := s.heldToken(st.ID); ok {
+		return s.fenced(saveScript, s.lockKey(st.ID), s.streamKey(st.ID), s.prefix+"streams", token, buf.String(), string(st.ID))
+	}
+	if _, err := s.client.Do("SET", s.streamKey(st.ID), buf.String()); err != nil {
+		return err
+	}
+	_, err := s.client.Do("SADD", s.prefix+"streams", string(st.ID))
+	return err
+}
+
+// RemoveStream implements SharedStore.RemoveStream. Like SaveStream, it is
+// fenced by the stream's lock if this store holds it.
+func (s *RedisStore) RemoveStream(id StreamID) error {
+	if token, ok := s.heldToken(id); ok {
+		return s.fenced(removeScript, s.lockKey(id), s.streamKey(id), s.prefix+"streams", token, string(id))
+	}
+	if _, err := s.client.Do("DEL", s.streamKey(id)); err != nil {
+		return err
+	}
+	_, err := s.client.Do("SREM", s.prefix+"streams", string(id))
+	return err
+}
+
+// fenced runs a save or remove script on the lock, stream and stream set
+// keys, reporting ErrLockLost if the lock no longer holds our token.
+func (s *RedisStore) fenced(script, lockKey, streamKey, setKey string, args ...string) error {
+	reply, err := s.client.Do(append([]string{"EVAL", script, "3", lockKey, streamKey, setKey}, args...)...)
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n != 1 {
+		return ErrLockLost
+	}
+	return nil
+}
+
+// LockStream implements SharedStore.LockStream. The lock expires after
+// redisLockTTL so a crashed replica cannot block a stream forever; while it
+// is held it is renewed every third of that.
+func (s *RedisStore) LockStream(id StreamID) (unlock func(), err error) {
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	key := s.lockKey(id)
+	ttl := fmt.Sprint(s.lockTTL.Milliseconds())
+
+	deadline := time.Now().Add(s.lockTimeout)
+	for {
+		reply, err := s.client.Do("SET", key, token, "NX", "PX", ttl)
+		if err != nil {
+			return nil, err
+		}
+		if reply != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrLockTimeout
+		}
+		time.Sleep(redisLockRetry)
+	}
+
+	s.mu.Lock()
+	s.locks[id] = token
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go s.renewLock(key, token, ttl, done)
+
+	return func() {
+		close(done)
+		s.mu.Lock()
+		delete(s.locks, id)
+		s.mu.Unlock()
+		_, _ = s.client.Do("EVAL", unlockScript, "1", key, token)
+	}, nil
+}
+
+// renewLock extends the lock key every third of its TTL until done is closed
+// or the lock no longer holds token.
+func (s *RedisStore) renewLock(key, token, ttl string, done <-chan struct{}) {
+	ticker := time.NewTicker(s.lockTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			reply, err := s.client.Do("EVAL", renewScript, "1", key, token, ttl)
+			if n, _ := reply.(int64); err == nil && n != 1 {
+				return // lost; the next fenced write reports it
+			}
+		}
+	}
+}
+
+// heldToken returns the token of the stream's lock if this store holds it.
+func (s *RedisStore) heldToken(id StreamID) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.locks[id]
+	return token, ok
+}
+
+func (s *RedisStore) lockKey(id StreamID) string {
+	return s.prefix + "lock:" + string(id)
+}
+
+func (s *RedisStore) streamKey(id StreamID) string {
+	return s.prefix + "stream:" + string(id)
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,477 @@
+package orchestrator
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"hls-orchestrator/internal/platform/redis"
+)
+
+// fakeRedis is an in-process server speaking enough of the Redis protocol for
+// RedisStore: GET, SET (NX/PX), DEL, SADD, SREM, SMEMBERS and the lock,
+// save and remove EVAL scripts.
+type fakeRedis struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	strings map[string]string
+	expires map[string]time.Time
+	sets    map[string]map[string]bool
+
+	// down makes every command fail, as during an outage.
+	down bool
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	f := &fakeRedis{
+		ln:      ln,
+		strings: make(map[string]string),
+		expires: make(map[string]time.Time),
+		sets:    make(map[string]map[string]bool),
+	}
+	go f.serve()
+	t.Cleanup(func() { ln.Close() })
+	return f
+}
+
+func (f *fakeRedis) addr() string { return f.ln.Addr().String() }
+
+func (f *fakeRedis) serve() {
+	for {
+		c, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(c)
+	}
+}
+
+func (f *fakeRedis) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if _, err := io.WriteString(c, f.exec(args)); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func bulk(s string) string { return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s) }
+
+func (f *fakeRedis) get(key string) (string, bool) {
+	if exp, ok := f.expires[key]; ok && time.Now().After(exp) {
+		delete(f.strings, key)
+		delete(f.expires, key)
+	}
+	v, ok := f.strings[key]
+	return v, ok
+}
+
+func (f *fakeRedis) exec(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.down {
+		return "-LOADING Redis is loading the dataset in memory\r\n"
+	}
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		if v, ok := f.get(args[1]); ok {
+			return bulk(v)
+		}
+		return "$-1\r\n"
+	case "SET":
+		key, val := args[1], args[2]
+		var nx bool
+		var ttl time.Duration
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "PX":
+				ms, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(ms) * time.Millisecond
+				i++
+			}
+		}
+		if _, exists := f.get(key); nx && exists {
+			return "$-1\r\n"
+		}
+		f.strings[key] = val
+		delete(f.expires, key)
+		if ttl > 0 {
+			f.expires[key] = time.Now().Add(ttl)
+		}
+		return "+OK\r\n"
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			if _, ok := f.get(key); ok {
+				delete(f.strings, key)
+				n++
+			}
+			if _, ok := f.sets[key]; ok {
+				delete(f.sets, key)
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "SADD":
+		set := f.sets[args[1]]
+		if set == nil {
+			set = make(map[string]bool)
+			f.sets[args[1]] = set
+		}
+		n := 0
+		for _, m := range args[2:] {
+			if !set[m] {
+				set[m] = true
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "SREM":
+		n := 0
+		for _, m := range args[2:] {
+			if f.sets[args[1]][m] {
+				delete(f.sets[args[1]], m)
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "SMEMBERS":
+		set := f.sets[args[1]]
+		out := fmt.Sprintf("*%d\r\n", len(set))
+		for m := range set {
+			out += bulk(m)
+		}
+		return out
+	case "EVAL":
+		// Only RedisStore's scripts are supported. Each starts by comparing
+		// KEYS[1] with ARGV[1].
+		n, _ := strconv.Atoi(args[2])
+		keys, argv := args[3:3+n], args[3+n:]
+		if v, ok := f.get(keys[0]); !ok || v != argv[0] {
+			return ":0\r\n"
+		}
+		switch args[1] {
+		case unlockScript:
+			delete(f.strings, keys[0])
+			delete(f.expires, keys[0])
+		case renewScript:
+			ms, _ := strconv.Atoi(argv[1])
+			f.expires[keys[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		case saveScript:
+			f.strings[keys[1]] = argv[1]
+			if f.sets[keys[2]] == nil {
+				f.sets[keys[2]] = make(map[string]bool)
+			}
+			f.sets[keys[2]][argv[2]] = true
+		case removeScript:
+			delete(f.strings, keys[1])
+			delete(f.sets[keys[2]], argv[1])
+		default:
+			return "-ERR unsupported script\r\n"
+		}
+		return ":1\r\n"
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func newRedisTestStore(t *testing.T, f *fakeRedis) *RedisStore {
+	t.Helper()
+	client := redis.NewClient(f.addr(), redis.Options{Timeout: time.Second})
+	t.Cleanup(func() { client.Close() })
+	return NewRedisStore(client, "test:")
+}
+
+func TestRedisStore_GetSetStream(t *testing.T) {
+	store := newRedisTestStore(t, newFakeRedis(t))
+
+	if _, ok := store.GetStream("s1"); ok {
+		t.Error("expected not found for empty store")
+	}
+
+	st := newStreamState("s1")
+	st.Renditions["720p"] = &RenditionState{
+		ID:       "720p",
+		Info:     RenditionInfo{Bandwidth: 2800000},
+		Segments: map[int64]Segment{1: {Sequence: 1, Duration: 2.0, Path: "/1.ts", ReceivedAt: time.Now().UTC()}},
+	}
+	if err := store.SaveStream(st); err != nil {
+		t.Fatalf("SaveStream: %v", err)
+	}
+
+	got, ok := store.GetStream("s1")
+	if !ok {
+		t.Fatal("GetStream: not found after SaveStream")
+	}
+	rendition := got.Renditions["720p"]
+	if rendition.Info.Bandwidth != 2800000 || rendition.Segments[1].Path != "/1.ts" {
+		t.Errorf("unexpected round-tripped rendition: %+v", rendition)
+	}
+	if rendition.Parts == nil {
+		t.Error("expected empty parts map to be initialised after decode")
+	}
+	if ids := store.ListStreamIDs(); len(ids) != 1 || ids[0] != "s1" {
+		t.Errorf("ListStreamIDs: got %v", ids)
+	}
+}
+
+func TestRedisStore_replicas_share_state(t *testing.T) {
+	f := newFakeRedis(t)
+	replicaA := NewService(NewInMemoryRepositoryWithStore(newRedisTestStore(t, f)), 6)
+	replicaB := NewService(NewInMemoryRepositoryWithStore(newRedisTestStore(t, f)), 6)
+
+	if err := replicaA.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"}); err != nil {
+		t.Fatalf("RegisterSegment on A: %v", err)
+	}
+	m3u8, ok := replicaB.GetPlaylist("s1", "720p")
+	if !ok || !strings.Contains(m3u8, "/1.ts") {
+		t.Fatalf("replica B should see segment registered on A: ok=%v %s", ok, m3u8)
+	}
+
+	_ = replicaB.EndStream("s1")
+	err := replicaA.RegisterSegment("s1", "720p", Segment{Sequence: 2, Duration: 2.0, Path: "/2.ts"})
+	if !errors.Is(err, ErrStreamEnded) {
+		t.Errorf("replica A should see stream ended on B, got %v", err)
+	}
+}
+
+func TestRedisStore_concurrent_replicas(t *testing.T) {
+	f := newFakeRedis(t)
+	repos := []*InMemoryRepository{
+		NewInMemoryRepositoryWithStore(newRedisTestStore(t, f)),
+		NewInMemoryRepositoryWithStore(newRedisTestStore(t, f)),
+	}
+
+	// Without the cross-replica lock, concurrent read-modify-writes from the
+	// two replicas would overwrite each other's segments.
+	var wg sync.WaitGroup
+	for i := int64(1); i <= 40; i++ {
+		wg.Add(1)
+		go func(seq int64) {
+			defer wg.Done()
+			repo := repos[seq%2]
+			if err := repo.RegisterSegment("s1", "720p", Segment{Sequence: seq, Duration: 2.0, Path: "/x.ts"}); err != nil {
+				t.Errorf("RegisterSegment %d: %v", seq, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	segs, _, _ := repos[0].GetRenditionSnapshot("s1", "720p")
+	if len(segs) != 40 {
+		t.Errorf("expected 40 segments, got %d", len(segs))
+	}
+}
+
+func TestRedisStore_backend_unavailable(t *testing.T) {
+	f := newFakeRedis(t)
+	repo := NewInMemoryRepositoryWithStore(newRedisTestStore(t, f))
+	f.ln.Close()
+
+	err := repo.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+	if err == nil {
+		t.Error("expected error when the backend is unavailable")
+	}
+}
+
+func TestRedisStore_read_unavailable(t *testing.T) {
+	f := newFakeRedis(t)
+	svc := NewService(NewInMemoryRepositoryWithStore(newRedisTestStore(t, f)), 6)
+	_ = svc.RegisterRendition("s1", "720p", RenditionInfo{Bandwidth: 2800000})
+	_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+	_ = svc.EndStream("s1")
+
+	f.mu.Lock()
+	f.down = true
+	f.mu.Unlock()
+
+	// A read failure must not look like a missing stream: players give up
+	// on 404 but retry 503.
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	r := newTestRouter(NewHandler(svc, log, nil))
+	for _, path := range []string{
+		"/streams/s1/renditions/720p/playlist.m3u8",
+		"/streams/s1/renditions/720p/vod.m3u8",
+		"/streams/s1/renditions/720p",
+		"/streams/s1/master.m3u8",
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("GET %s: expected 503, got %d", path, w.Code)
+		}
+	}
+
+	if _, err := svc.GetVODPlaylist("s1", "720p"); !errors.Is(err, ErrStoreUnavailable) {
+		t.Errorf("expected ErrStoreUnavailable, got %v", err)
+	}
+}
+
+func TestInMemoryRepository_Watch_polls_shared_store(t *testing.T) {
+	f := newFakeRedis(t)
+	repo := NewInMemoryRepositoryWithConfig(newRedisTestStore(t, f), RepositoryConfig{WatchPollInterval: 10 * time.Millisecond})
+
+	select {
+	case <-repo.Watch("s1", "720p"):
+	case <-time.After(time.Second):
+		t.Error("expected watch channel closed by polling for a shared store")
+	}
+}
+
+func TestRedisStore_RemoveStream(t *testing.T) {
+	f := newFakeRedis(t)
+	replicaA := NewInMemoryRepositoryWithStore(newRedisTestStore(t, f))
+	replicaB := NewInMemoryRepositoryWithStore(newRedisTestStore(t, f))
+
+	_ = replicaA.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+	if err := replicaB.DeleteStream("s1"); err != nil {
+		t.Fatalf("DeleteStream on B: %v", err)
+	}
+
+	if _, ok := replicaA.GetRendition("s1", "720p"); ok {
+		t.Error("replica A should not see a stream deleted on B")
+	}
+	if err := replicaA.DeleteStream("s1"); !errors.Is(err, ErrStreamNotFound) {
+		t.Errorf("expected ErrStreamNotFound, got %v", err)
+	}
+}
+
+func TestRedisStore_LockStream_renews_lock(t *testing.T) {
+	f := newFakeRedis(t)
+	store := newRedisTestStore(t, f)
+	store.lockTTL = 60 * time.Millisecond
+
+	unlock, err := store.LockStream("s1")
+	if err != nil {
+		t.Fatalf("LockStream: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	f.mu.Lock()
+	_, held := f.get("test:lock:s1")
+	f.mu.Unlock()
+	if !held {
+		t.Error("expected the lock renewed past its TTL while held")
+	}
+	if err := store.SaveStream(newStreamState("s1")); err != nil {
+		t.Errorf("SaveStream under a renewed lock: %v", err)
+	}
+
+	unlock()
+	f.mu.Lock()
+	_, held = f.get("test:lock:s1")
+	f.mu.Unlock()
+	if held {
+		t.Error("expected the lock released")
+	}
+}
+
+func TestRedisStore_SaveStream_fenced_by_lock(t *testing.T) {
+	f := newFakeRedis(t)
+	store := newRedisTestStore(t, f)
+
+	unlock, err := store.LockStream("s1")
+	if err != nil {
+		t.Fatalf("LockStream: %v", err)
+	}
+	defer unlock()
+
+	// Simulate the lock expiring and another replica taking it over.
+	f.mu.Lock()
+	f.strings["test:lock:s1"] = "other"
+	f.mu.Unlock()
+
+	if err := store.SaveStream(newStreamState("s1")); !errors.Is(err, ErrLockLost) {
+		t.Errorf("SaveStream: expected ErrLockLost, got %v", err)
+	}
+	if err := store.RemoveStream("s1"); !errors.Is(err, ErrLockLost) {
+		t.Errorf("RemoveStream: expected ErrLockLost, got %v", err)
+	}
+	if _, ok := store.GetStream("s1"); ok {
+		t.Error("expected no write without the lock")
+	}
+}
+
+func TestRedisStore_waiting_for_lock_does_not_block_other_streams(t *testing.T) {
+	f := newFakeRedis(t)
+	store := newRedisTestStore(t, f)
+	repo := NewInMemoryRepositoryWithStore(store)
+
+	// Another replica holds the lock on s1.
+	unlock, err := newRedisTestStore(t, f).LockStream("s1")
+	if err != nil {
+		t.Fatalf("LockStream: %v", err)
+	}
+	blocked := make(chan error, 1)
+	go func() {
+		blocked <- repo.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- repo.RegisterSegment("s2", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("RegisterSegment s2: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("s2 blocked by the wait for the lock on s1")
+	}
+
+	unlock()
+	if err := <-blocked; err != nil {
+		t.Errorf("RegisterSegment s1: %v", err)
+	}
+}
@@ -1,7 +1,10 @@
 package orchestrator
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math"
 	"sort"
 	"sync"
 	"time"
@@ -16,16 +19,112 @@ type Repository interface {
 	// If the stream or rendition has been ended, an error is returned.
 	RegisterSegment(streamID StreamID, renditionID RenditionID, seg Segment) error
 
+	// PutSegment is RegisterSegment that also reports what happened to the
+	// segment. Re-registering a sequence number with the same payload is a
+	// no-op (SegmentUnchanged). With a different payload it returns a
+	// *SegmentConflictError, unless the stream's settings enable
+	// LastWriterWins, in which case the segment is replaced.
+	PutSegment(streamID StreamID, renditionID RenditionID, seg Segment) (SegmentOutcome, error)
+
+	// RegisterPart records an LL-HLS partial segment of a segment that has not
+	// been registered yet. Parts are folded into the segment when it is
+	// registered. Duplicate part indexes are ignored. If the segment is already
+	// complete, or the stream or rendition has been ended, an error is returned.
+	RegisterPart(streamID StreamID, renditionID RenditionID, part PartialSegment) error
+
 	// GetRenditionSnapshot returns an ordered snapshot of all segments for the
 	// given stream and rendition, sorted by sequence number, along with the
 	// rendition's ended flag. The ok return is false if either the stream or
 	// rendition does not exist.
 	GetRenditionSnapshot(streamID StreamID, renditionID RenditionID) (segments []Segment, ended bool, ok bool)
 
+	// GetRendition returns a snapshot of the rendition's segments (sorted by
+	// sequence number), pending parts and ended flag. The ok return is false if
+	// either the stream or rendition does not exist.
+	GetRendition(streamID StreamID, renditionID RenditionID) (snap RenditionSnapshot, ok bool)
+
+	// LoadRendition is GetRendition that reports a failure to read the
+	// store as an error wrapping ErrStoreUnavailable instead of as not found.
+	LoadRendition(streamID StreamID, renditionID RenditionID) (snap RenditionSnapshot, ok bool, err error)
+
+	// RegisterRendition stores variant metadata for the given stream and
+	// rendition, replacing any previous metadata. If the stream or rendition
+	// does not exist they are created. If either has been ended, an error is
+	// returned. Once segments are registered, declaring a different target
+	// duration returns ErrTargetDurationLocked.
+	RegisterRendition(streamID StreamID, renditionID RenditionID, info RenditionInfo) error
+
+	// ListRenditions returns a summary of every rendition of the given stream,
+	// sorted by rendition ID. The ok return is false if the stream does not exist.
+	ListRenditions(streamID StreamID) (renditions []RenditionSummary, ok bool)
+
+	// LoadRenditions is ListRenditions that reports a failure to read the
+	// store as an error wrapping ErrStoreUnavailable instead of as not found.
+	LoadRenditions(streamID StreamID) (renditions []RenditionSummary, ok bool, err error)
+
+	// EndRendition marks a single rendition of a stream as ended. After this,
+	// new segments for that rendition will be rejected while other renditions
+	// continue.
+	EndRendition(streamID StreamID, renditionID RenditionID) error
+
+	// Watch returns a channel that is closed the next time the given rendition
+	// changes: a segment or part is registered, or the rendition is ended.
+	// The rendition does not need to exist yet. Waiters should re-read the
+	// rendition after being woken and call Watch again to keep waiting.
+	Watch(streamID StreamID, renditionID RenditionID) <-chan struct{}
+
 	// EndStream marks a stream (and all its renditions) as ended. After this,
 	// new segments for the stream will be rejected.
 	EndStream(streamID StreamID) error
 
+	// UpdateStreamSettings replaces the settings of the given stream. If the
+	// stream does not exist it is created. If it has been ended, an error is
+	// returned.
+	UpdateStreamSettings(streamID StreamID, settings StreamSettings) error
+
+	// SetWindowSize sets the window size of the given stream, or of one of
+	// its renditions if renditionID is not empty, leaving all other settings
+	// and metadata unchanged. A window size of 0 removes the override. It
+	// returns ErrStreamNotFound or ErrRenditionNotFound if the stream or
+	// rendition does not exist, and an error if it has been ended.
+	SetWindowSize(streamID StreamID, renditionID RenditionID, windowSize int) error
+
+	// RegisterCue attaches an ad break signal to the segment with the cue's
+	// sequence number in every rendition of the stream. Omitted IDs are
+	// assigned (see Cue.ID); a cue with the ID and type of an existing one is
+	// ignored. If the stream does not exist it is created. If it has been
+	// ended, an error is returned.
+	RegisterCue(streamID StreamID, cue Cue) error
+
+	// GetStreamSettings returns the settings of the given stream. The ok
+	// return is false if the stream does not exist.
+	GetStreamSettings(streamID StreamID) (settings StreamSettings, ok bool)
+
+	// AddKey stores a content key of the stream. Adding a key identical to
+	// the one starting at the same sequence is a no-op; a different one
+	// returns ErrKeyExists. If the stream does not exist it is created. If it
+	// has been ended, an error is returned.
+	AddKey(streamID StreamID, key ContentKey) error
+
+	// GetKey returns the content key of the stream that starts at
+	// firstSequence. The ok return is false if there is none.
+	GetKey(streamID StreamID, firstSequence int64) (key ContentKey, ok bool)
+
+	// DeleteStream removes a stream and all its renditions. It returns
+	// ErrStreamNotFound if the stream does not exist.
+	DeleteStream(streamID StreamID) error
+
+	// CreateStream creates an empty stream with the given settings. It
+	// returns ErrStreamExists if the stream already exists.
+	CreateStream(streamID StreamID, settings StreamSettings) error
+
+	// GetStream returns a summary of the given stream. The ok return is false
+	// if the stream does not exist.
+	GetStream(streamID StreamID) (stream StreamSummary, ok bool)
+
+	// ListStreams returns a summary of every stream, sorted by stream ID.
+	ListStreams() []StreamSummary
+
 	// ActiveStreamCount returns the number of streams that are not ended.
 	// Used for metrics.
 	ActiveStreamCount() int
@@ -39,13 +138,159 @@ var (
 	// ErrRenditionEnded is returned when attempting to register a segment on a
 	// rendition that has already been ended.
 	ErrRenditionEnded = errors.New("rendition has ended")
+
+	// ErrSegmentComplete is returned when attempting to register a part of a
+	// segment that has already been registered in full.
+	ErrSegmentComplete = errors.New("segment already complete")
+
+	// ErrStreamNotFound is returned when deleting a stream that does not exist.
+	ErrStreamNotFound = errors.New("stream not found")
+
+	// ErrRenditionNotFound is returned when updating a rendition that does
+	// not exist.
+	ErrRenditionNotFound = errors.New("rendition not found")
+
+	// ErrStreamExists is returned when creating a stream that already exists.
+	ErrStreamExists = errors.New("stream already exists")
+
+	// ErrTargetDurationExceeded is returned when a segment is longer than
+	// its rendition's target duration under TargetDurationReject.
+	ErrTargetDurationExceeded = errors.New("segment exceeds the target duration")
+
+	// ErrTargetDurationLocked is returned when rendition metadata declares a
+	// target duration different from the one its segments are already
+	// listed with.
+	ErrTargetDurationLocked = errors.New("target duration is locked once segments are registered")
+
+	// ErrPartTargetExceeded is returned when a part is longer than its
+	// rendition's part target.
+	ErrPartTargetExceeded = errors.New("part exceeds the part target")
+
+	// ErrPartTargetLocked is returned when rendition metadata declares a
+	// part target different from the one its parts are already listed with.
+	ErrPartTargetLocked = errors.New("part target is locked once parts are registered")
+
+	// ErrWindowExceedsRetention is returned when a window size is larger
+	// than the retention policy's MaxSegments, so the playlist could never
+	// be filled.
+	ErrWindowExceedsRetention = errors.New("window_size exceeds the retention limit")
+
+	// ErrByteRangeOverlap is returned when a segment's byte range overlaps
+	// the range of another segment of the same resource.
+	ErrByteRangeOverlap = errors.New("byte range overlaps another segment")
+
+	// ErrStoreUnavailable is wrapped by errors reading a SharedStore, such
+	// as during a Redis outage. Unlike not found, it is worth retrying.
+	ErrStoreUnavailable = errors.New("state store unavailable")
+)
+
+// SegmentConflictError is returned when a sequence number is registered again
+// with a different payload, which usually means two encoders are writing to
+// the same rendition.
+type SegmentConflictError struct {
+	Existing Segment // the registered segment
+	Received Segment // the rejected payload
+}
+
+func (e *SegmentConflictError) Error() string {
+	return fmt.Sprintf("segment %d is already registered with a different payload", e.Received.Sequence)
+}
+
+// SegmentOutcome is the effect of a PutSegment call.
+type SegmentOutcome int
+
+const (
+	SegmentCreated   SegmentOutcome = iota // a new sequence number was registered
+	SegmentUnchanged                       // an identical segment was already registered
+	SegmentReplaced                        // a conflicting segment was overwritten (LastWriterWins)
 )
 
+// RetentionPolicy bounds how many segments a rendition keeps behind its live
+// edge. A segment is evicted once it falls outside either limit; zero values
+// disable the corresponding limit. Retention is independent of the playlist
+// sliding window and should be at least as large.
+type RetentionPolicy struct {
+	// MaxSegments keeps only sequences within this many of the highest
+	// registered sequence.
+	MaxSegments int
+	// MaxAge keeps only segments registered within this duration of the most
+	// recent registration.
+	MaxAge time.Duration
+}
+
+// RepositoryConfig holds optional InMemoryRepository settings.
+type RepositoryConfig struct {
+	Retention RetentionPolicy
+
+	// OnEvict, if set, is called with the number of segments evicted by the
+	// retention policy. It is called with the repository lock held and must
+	// not call back into the repository. It is not called for evictions
+	// replayed by Restore.
+	OnEvict func(n int)
+
+	// OnStoreError, if set, is called with non-fatal persistence errors such
+	// as a failed journal checkpoint. The mutation itself has succeeded.
+	OnStoreError func(err error)
+
+	// EndedStreamTTL is how long an ended stream is kept before the janitor
+	// purges it. Zero keeps ended streams forever.
+	EndedStreamTTL time.Duration
+
+	// ArchivedStreamTTL replaces EndedStreamTTL for streams with the archive
+	// setting, whose VOD playlists should outlive the live stream. Zero keeps
+	// them forever.
+	ArchivedStreamTTL time.Duration
+
+	// IdleStreamTTL is how long a stream that was never ended is kept after
+	// its last mutation before the janitor purges it. Zero disables this.
+	IdleStreamTTL time.Duration
+
+	// OnPurge, if set, is called with the number of streams purged by each
+	// PurgeExpired run.
+	OnPurge func(n int)
+
+	// WatchPollInterval bounds how long Watch channels stay open when the
+	// store is a SharedStore, so that waiters also notice changes written by
+	// other replicas. Zero disables polling.
+	WatchPollInterval time.Duration
+
+	// TargetDurationPolicy decides whether segments longer than their
+	// rendition's target duration are accepted. It defaults to
+	// TargetDurationFlag.
+	TargetDurationPolicy TargetDurationPolicy
+
+	// TargetDuration is the target duration, in seconds, of renditions that
+	// do not declare one. If 0, it is taken from the longest of the first
+	// segments of each rendition.
+	TargetDuration int
+
+	// OnTargetDurationExceeded, if set, is called for every segment longer
+	// than its rendition's target duration, whether it is accepted or not. It
+	// is called with the repository lock held and must not call back into the
+	// repository. It is not called for segments replayed by Restore.
+	OnTargetDurationExceeded func(streamID StreamID, renditionID RenditionID, seg Segment, target int)
+}
+
 // InMemoryRepository is a concurrency-safe in-memory implementation of Repository.
 // It uses a Store for persistence; by default that is an InMemoryStore.
 type InMemoryRepository struct {
 	mu    sync.RWMutex
 	store Store
+	cfg   RepositoryConfig
+	now   func() time.Time
+
+	// replaying is set while Restore replays the journal, so that hooks do
+	// not report the replayed mutations a second time.
+	replaying bool
+
+	watchMu  sync.Mutex
+	watchers map[renditionKey]chan struct{}
+}
+
+// renditionKey identifies a rendition across streams.
+type renditionKey struct {
+	stream    StreamID
+	rendition RenditionID
 }
 
 // NewInMemoryRepository constructs a new repository with a default in-memory store.
@@ -56,53 +301,110 @@ func NewInMemoryRepository() *InMemoryRepository {
 // NewInMemoryRepositoryWithStore constructs a repository that uses the given Store.
 // Useful for testing or for plugging in a different persistence backend.
 func NewInMemoryRepositoryWithStore(store Store) *InMemoryRepository {
-	return &InMemoryRepository{store: store}
+	return NewInMemoryRepositoryWithConfig(store, RepositoryConfig{})
+}
+
+// NewInMemoryRepositoryWithConfig constructs a repository that uses the given
+// Store and settings.
+func NewInMemoryRepositoryWithConfig(store Store, cfg RepositoryConfig) *InMemoryRepository {
+	return &InMemoryRepository{
+		store:    store,
+		cfg:      cfg,
+		now:      time.Now,
+		watchers: make(map[renditionKey]chan struct{}),
+	}
 }
 
 // RegisterSegment implements Repository.RegisterSegment.
 func (r *InMemoryRepository) RegisterSegment(streamID StreamID, renditionID RenditionID, seg Segment) error {
+	_, err := r.PutSegment(streamID, renditionID, seg)
+	return err
+}
+
+// PutSegment implements Repository.PutSegment.
+func (r *InMemoryRepository) PutSegment(streamID StreamID, renditionID RenditionID, seg Segment) (SegmentOutcome, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	stream := r.getOrCreateStreamLocked(streamID)
-	if stream.Ended {
-		return ErrStreamEnded
-	}
-
-	rendition := r.getOrCreateRenditionLocked(stream, renditionID)
-	if rendition.Ended {
-		return ErrRenditionEnded
+	existed := false
+	var rendition *RenditionState
+	inspect := func(stream *StreamState) {
+		var ok bool
+		if rendition, ok = stream.Renditions[renditionID]; ok {
+			_, existed = rendition.Segments[seg.Sequence]
+		}
 	}
-
-	// Ignore duplicate sequence numbers to avoid corrupting state.
-	if _, exists := rendition.Segments[seg.Sequence]; exists {
-		return nil
+	applied, err := r.tryCommitLocked(Op{Kind: OpRegisterSegment, StreamID: streamID, RenditionID: renditionID, Segment: &seg}, inspect)
+	switch {
+	case err == ErrTargetDurationExceeded:
+		// Rejected segments are never journaled, so this is reported once.
+		if r.cfg.OnTargetDurationExceeded != nil {
+			r.cfg.OnTargetDurationExceeded(streamID, renditionID, seg, r.lockedTargetDuration(rendition))
+		}
+		return 0, err
+	case err != nil:
+		return 0, err
+	case !applied:
+		return SegmentUnchanged, nil
+	case existed:
+		return SegmentReplaced, nil
 	}
+	return SegmentCreated, nil
+}
 
-	seg.ReceivedAt = time.Now().UTC()
-	rendition.Segments[seg.Sequence] = seg
+// RegisterPart implements Repository.RegisterPart.
+func (r *InMemoryRepository) RegisterPart(streamID StreamID, renditionID RenditionID, part PartialSegment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	return nil
+	return r.commitLocked(Op{Kind: OpRegisterPart, StreamID: streamID, RenditionID: renditionID, Sequence: part.Sequence, Part: &part})
 }
 
 // GetRenditionSnapshot implements Repository.GetRenditionSnapshot.
 func (r *InMemoryRepository) GetRenditionSnapshot(streamID StreamID, renditionID RenditionID) (segments []Segment, ended bool, ok bool) {
+	snap, ok := r.GetRendition(streamID, renditionID)
+	return snap.Segments, snap.Ended, ok
+}
+
+// GetRendition implements Repository.GetRendition.
+func (r *InMemoryRepository) GetRendition(streamID StreamID, renditionID RenditionID) (snap RenditionSnapshot, ok bool) {
+	snap, ok, _ = r.LoadRendition(streamID, renditionID)
+	return snap, ok
+}
+
+// LoadRendition implements Repository.LoadRendition.
+func (r *InMemoryRepository) LoadRendition(streamID StreamID, renditionID RenditionID) (snap RenditionSnapshot, ok bool, err error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	stream, exists := r.store.GetStream(streamID)
-	if !exists {
-		return nil, false, false
+	stream, exists, err := r.loadStreamLocked(streamID)
+	if err != nil || !exists {
+		return RenditionSnapshot{}, false, err
 	}
 
 	rendition, exists := stream.Renditions[renditionID]
 	if !exists {
-		return nil, false, false
+		return RenditionSnapshot{}, false, nil
+	}
+
+	snap.Ended = rendition.Ended
+	snap.Settings = stream.Settings
+	snap.Cues = append([]Cue(nil), stream.Cues...)
+	snap.Keys = append([]ContentKey(nil), stream.Keys...)
+	snap.EvictedDiscontinuities = rendition.EvictedDiscontinuities
+	snap.TargetDuration = r.lockedTargetDuration(rendition)
+	snap.PartTarget = rendition.PartTarget
+	snap.WindowSize = rendition.Info.WindowSize
+	if len(rendition.Parts) > 0 {
+		snap.Parts = make(map[int64][]PartialSegment, len(rendition.Parts))
+		for seq, parts := range rendition.Parts {
+			snap.Parts[seq] = append([]PartialSegment(nil), parts...)
+		}
 	}
 
 	// Build a sorted copy of the segments to avoid exposing internal maps.
 	if len(rendition.Segments) == 0 {
-		return nil, rendition.Ended, true
+		return snap, true, nil
 	}
 
 	sequences := make([]int64, 0, len(rendition.Segments))
@@ -111,12 +413,103 @@ func (r *InMemoryRepository) GetRenditionSnapshot(streamID StreamID, renditionID
 	}
 	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
 
-	segments = make([]Segment, 0, len(sequences))
+	snap.Segments = make([]Segment, 0, len(sequences))
 	for _, seq := range sequences {
-		segments = append(segments, rendition.Segments[seq])
+		snap.Segments = append(snap.Segments, rendition.Segments[seq])
+	}
+
+	return snap, true, nil
+}
+
+// RegisterRendition implements Repository.RegisterRendition.
+func (r *InMemoryRepository) RegisterRendition(streamID StreamID, renditionID RenditionID, info RenditionInfo) error {
+	if err := r.checkWindowSize(info.WindowSize); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.commitLocked(Op{Kind: OpRegisterRendition, StreamID: streamID, RenditionID: renditionID, Info: &info})
+}
+
+// ListRenditions implements Repository.ListRenditions.
+func (r *InMemoryRepository) ListRenditions(streamID StreamID) (renditions []RenditionSummary, ok bool) {
+	renditions, ok, _ = r.LoadRenditions(streamID)
+	return renditions, ok
+}
+
+// LoadRenditions implements Repository.LoadRenditions.
+func (r *InMemoryRepository) LoadRenditions(streamID StreamID) (renditions []RenditionSummary, ok bool, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stream, exists, err := r.loadStreamLocked(streamID)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+
+	return summarizeRenditions(stream), true, nil
+}
+
+// loadStreamLocked reads a stream from the store. Unlike Store.GetStream,
+// a SharedStore's backend errors are returned, wrapping ErrStoreUnavailable,
+// so that read paths do not mistake an outage for a missing stream.
+func (r *InMemoryRepository) loadStreamLocked(streamID StreamID) (*StreamState, bool, error) {
+	shared, ok := r.store.(SharedStore)
+	if !ok {
+		stream, exists := r.store.GetStream(streamID)
+		return stream, exists, nil
+	}
+	stream, exists, err := shared.LoadStream(streamID)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: load stream %s: %w", ErrStoreUnavailable, streamID, err)
 	}
+	return stream, exists, nil
+}
 
-	return segments, rendition.Ended, true
+// summarizeRenditions returns a summary of every rendition of stream, sorted
+// by rendition ID.
+func summarizeRenditions(stream *StreamState) []RenditionSummary {
+	renditions := make([]RenditionSummary, 0, len(stream.Renditions))
+	for _, rendition := range stream.Renditions {
+		summary := RenditionSummary{
+			ID:             rendition.ID,
+			Info:           rendition.Info,
+			Ended:          rendition.Ended,
+			TargetDuration: rendition.TargetDuration,
+			SegmentCount:   len(rendition.Segments),
+		}
+		for seq := range rendition.Segments {
+			if summary.LatestSequence == nil || seq > *summary.LatestSequence {
+				summary.LatestSequence = &seq
+			}
+		}
+		renditions = append(renditions, summary)
+	}
+	sort.Slice(renditions, func(i, j int) bool { return renditions[i].ID < renditions[j].ID })
+	return renditions
+}
+
+// summarizeStream returns a summary of stream and its renditions.
+func summarizeStream(stream *StreamState) StreamSummary {
+	summary := StreamSummary{
+		ID:         stream.ID,
+		Ended:      stream.Ended,
+		Settings:   stream.Settings,
+		Renditions: summarizeRenditions(stream),
+		CreatedAt:  stream.CreatedAt,
+		UpdatedAt:  stream.UpdatedAt,
+	}
+	for _, r := range summary.Renditions {
+		if r.LatestSequence != nil && (summary.LatestSequence == nil || *r.LatestSequence > *summary.LatestSequence) {
+			summary.LatestSequence = r.LatestSequence
+		}
+	}
+	if stream.Ended && !stream.EndedAt.IsZero() {
+		endedAt := stream.EndedAt
+		summary.EndedAt = &endedAt
+	}
+	return summary
 }
 
 // EndStream implements Repository.EndStream.
@@ -124,24 +517,241 @@ func (r *InMemoryRepository) EndStream(streamID StreamID) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	stream, exists := r.store.GetStream(streamID)
-	if !exists {
-		// Treat ending a non-existent stream as a no-op for idempotency.
-		return nil
+	return r.commitLocked(Op{Kind: OpEndStream, StreamID: streamID})
+}
+
+// EndRendition implements Repository.EndRendition.
+func (r *InMemoryRepository) EndRendition(streamID StreamID, renditionID RenditionID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.commitLocked(Op{Kind: OpEndRendition, StreamID: streamID, RenditionID: renditionID})
+}
+
+// Watch implements Repository.Watch.
+func (r *InMemoryRepository) Watch(streamID StreamID, renditionID RenditionID) <-chan struct{} {
+	r.watchMu.Lock()
+	defer r.watchMu.Unlock()
+
+	key := renditionKey{stream: streamID, rendition: renditionID}
+	ch, ok := r.watchers[key]
+	if !ok {
+		ch = make(chan struct{})
+		r.watchers[key] = ch
+
+		// Other replicas cannot notify us; wake waiters periodically instead.
+		if _, shared := r.store.(SharedStore); shared && r.cfg.WatchPollInterval > 0 {
+			time.AfterFunc(r.cfg.WatchPollInterval, func() { r.notify(streamID, renditionID) })
+		}
 	}
+	return ch
+}
 
-	if stream.Ended {
-		return nil
+// notifyStream wakes everyone watching any rendition of stream.
+func (r *InMemoryRepository) notifyStream(stream *StreamState) {
+	for id := range stream.Renditions {
+		r.notify(stream.ID, id)
+	}
+}
+
+// notify wakes everyone watching the given rendition.
+func (r *InMemoryRepository) notify(streamID StreamID, renditionID RenditionID) {
+	r.watchMu.Lock()
+	defer r.watchMu.Unlock()
+
+	key := renditionKey{stream: streamID, rendition: renditionID}
+	if ch, ok := r.watchers[key]; ok {
+		close(ch)
+		delete(r.watchers, key)
 	}
+}
 
-	stream.Ended = true
-	for _, rendition := range stream.Renditions {
-		rendition.Ended = true
+// UpdateStreamSettings implements Repository.UpdateStreamSettings.
+func (r *InMemoryRepository) UpdateStreamSettings(streamID StreamID, settings StreamSettings) error {
+	if err := r.checkWindowSize(settings.WindowSize); err != nil {
+		return err
 	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.commitLocked(Op{Kind: OpUpdateSettings, StreamID: streamID, Settings: &settings})
+}
+
+// RegisterCue implements Repository.RegisterCue.
+func (r *InMemoryRepository) RegisterCue(streamID StreamID, cue Cue) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
+	return r.commitLocked(Op{Kind: OpRegisterCue, StreamID: streamID, Cue: &cue})
+}
+
+// GetStreamSettings implements Repository.GetStreamSettings.
+func (r *InMemoryRepository) GetStreamSettings(streamID StreamID) (settings StreamSettings, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stream, ok := r.store.GetStream(streamID)
+	if !ok {
+		return StreamSettings{}, false
+	}
+	return stream.Settings, true
+}
+
+// AddKey implements Repository.AddKey.
+func (r *InMemoryRepository) AddKey(streamID StreamID, key ContentKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.commitLocked(Op{Kind: OpAddKey, StreamID: streamID, Key: &key})
+}
+
+// GetKey implements Repository.GetKey.
+func (r *InMemoryRepository) GetKey(streamID StreamID, firstSequence int64) (key ContentKey, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stream, ok := r.store.GetStream(streamID)
+	if !ok {
+		return ContentKey{}, false
+	}
+	key, ok = keyFor(stream.Keys, firstSequence)
+	if !ok || key.FirstSequence != firstSequence {
+		return ContentKey{}, false
+	}
+	return key, true
+}
+
+// DeleteStream implements Repository.DeleteStream.
+func (r *InMemoryRepository) DeleteStream(streamID StreamID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.commitLocked(Op{Kind: OpDeleteStream, StreamID: streamID})
+}
+
+// CreateStream implements Repository.CreateStream.
+func (r *InMemoryRepository) CreateStream(streamID StreamID, settings StreamSettings) error {
+	if err := r.checkWindowSize(settings.WindowSize); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.commitLocked(Op{Kind: OpCreateStream, StreamID: streamID, Settings: &settings})
+}
+
+// SetWindowSize implements Repository.SetWindowSize.
+func (r *InMemoryRepository) SetWindowSize(streamID StreamID, renditionID RenditionID, windowSize int) error {
+	if err := r.checkWindowSize(windowSize); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.commitLocked(Op{Kind: OpSetWindowSize, StreamID: streamID, RenditionID: renditionID, WindowSize: windowSize})
+}
+
+// checkWindowSize returns ErrWindowExceedsRetention if windowSize is larger
+// than the retention policy keeps. It is checked before ops are journaled
+// rather than when they are applied, so that lowering the limit does not
+// drop journaled settings on Restore.
+func (r *InMemoryRepository) checkWindowSize(windowSize int) error {
+	if limit := r.cfg.Retention.MaxSegments; limit > 0 && windowSize > limit {
+		return ErrWindowExceedsRetention
+	}
 	return nil
 }
 
+// GetStream implements Repository.GetStream.
+func (r *InMemoryRepository) GetStream(streamID StreamID) (stream StreamSummary, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	st, ok := r.store.GetStream(streamID)
+	if !ok {
+		return StreamSummary{}, false
+	}
+	return summarizeStream(st), true
+}
+
+// ListStreams implements Repository.ListStreams.
+func (r *InMemoryRepository) ListStreams() []StreamSummary {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := r.store.ListStreamIDs()
+	streams := make([]StreamSummary, 0, len(ids))
+	for _, id := range ids {
+		if st, ok := r.store.GetStream(id); ok {
+			streams = append(streams, summarizeStream(st))
+		}
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].ID < streams[j].ID })
+	return streams
+}
+
+// PurgeExpired deletes ended streams older than EndedStreamTTL (or
+// ArchivedStreamTTL) and idle streams not updated within IdleStreamTTL, or
+// within their own TTL setting, and returns how many were purged.
+func (r *InMemoryRepository) PurgeExpired() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, id := range r.store.ListStreamIDs() {
+		st, ok := r.store.GetStream(id)
+		if !ok || !r.expired(st, r.now()) {
+			continue
+		}
+		// Expiry is re-checked under the stream lock, since another replica
+		// may have updated or purged the stream in the meantime.
+		purged, err := r.tryCommitLocked(Op{Kind: OpPurgeStream, StreamID: id}, nil)
+		if err != nil && r.cfg.OnStoreError != nil {
+			r.cfg.OnStoreError(fmt.Errorf("purge stream %s: %w", id, err))
+		}
+		if purged {
+			n++
+		}
+	}
+
+	if n > 0 && r.cfg.OnPurge != nil {
+		r.cfg.OnPurge(n)
+	}
+	return n
+}
+
+// RunJanitor calls PurgeExpired every interval until ctx is done.
+func (r *InMemoryRepository) RunJanitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.PurgeExpired()
+		}
+	}
+}
+
+// expired reports whether st is due for purging at now. The stream's TTL
+// setting, if any, replaces both repository TTLs. Streams without timestamps
+// (e.g. restored from an older snapshot) never expire.
+func (r *InMemoryRepository) expired(st *StreamState, now time.Time) bool {
+	endedTTL, idleTTL := r.cfg.EndedStreamTTL, r.cfg.IdleStreamTTL
+	if st.Settings.Archive {
+		endedTTL = r.cfg.ArchivedStreamTTL
+	}
+	if st.Settings.TTL > 0 {
+		endedTTL, idleTTL = seconds(st.Settings.TTL), seconds(st.Settings.TTL)
+	}
+	if st.Ended {
+		return endedTTL > 0 && !st.EndedAt.IsZero() && now.Sub(st.EndedAt) > endedTTL
+	}
+	return idleTTL > 0 && !st.UpdatedAt.IsZero() && now.Sub(st.UpdatedAt) > idleTTL
+}
+
 // ActiveStreamCount implements Repository.ActiveStreamCount.
 func (r *InMemoryRepository) ActiveStreamCount() int {
 	r.mu.RLock()
@@ -156,19 +766,615 @@ func (r *InMemoryRepository) ActiveStreamCount() int {
 	return n
 }
 
-// getOrCreateStreamLocked returns an existing stream or creates a new one.
+// pruneLocked evicts segments (and abandoned pending parts) of rendition that
+// fell behind the retention policy as of now. EVENT and archived streams are
+// never pruned and DVR streams keep the segments received within their DVR
+// window.
 // Caller must hold r.mu in write mode.
-func (r *InMemoryRepository) getOrCreateStreamLocked(streamID StreamID) *StreamState {
-	if stream, ok := r.store.GetStream(streamID); ok {
-		return stream
+func (r *InMemoryRepository) pruneLocked(rendition *RenditionState, settings StreamSettings, now time.Time) {
+	policy := r.cfg.Retention
+	if (policy.MaxSegments <= 0 && policy.MaxAge <= 0) || settings.PlaylistType == PlaylistTypeEvent || settings.Archive {
+		return
+	}
+	// DVR streams keep at least their rewind window.
+	var keepSince time.Time
+	if settings.PlaylistType == PlaylistTypeDVR {
+		keepSince = now.Add(-settings.dvrWindow())
 	}
 
-	stream := &StreamState{
+	var edge int64
+	for seq := range rendition.Segments {
+		if seq > edge {
+			edge = seq
+		}
+	}
+	tooOld := func(seq int64) bool {
+		return policy.MaxSegments > 0 && seq <= edge-int64(policy.MaxSegments)
+	}
+
+	evicted := 0
+	for seq, seg := range rendition.Segments {
+		if !keepSince.IsZero() && seg.ReceivedAt.After(keepSince) {
+			continue
+		}
+		if tooOld(seq) || (policy.MaxAge > 0 && now.Sub(seg.ReceivedAt) > policy.MaxAge) {
+			delete(rendition.Segments, seq)
+			evicted++
+			if seg.Discontinuity {
+				rendition.EvictedDiscontinuities++
+			}
+		}
+	}
+	for seq, parts := range rendition.Parts {
+		// Parts are ordered by index, not arrival; the newest decides.
+		var last time.Time
+		for _, part := range parts {
+			if part.ReceivedAt.After(last) {
+				last = part.ReceivedAt
+			}
+		}
+		if !keepSince.IsZero() && last.After(keepSince) {
+			continue
+		}
+		if tooOld(seq) || (policy.MaxAge > 0 && now.Sub(last) > policy.MaxAge) {
+			delete(rendition.Parts, seq)
+		}
+	}
+
+	if evicted > 0 && !r.replaying && r.cfg.OnEvict != nil {
+		r.cfg.OnEvict(evicted)
+	}
+}
+
+// Restore rebuilds the repository state from the store's journal, if the
+// store implements Journal. It must be called once, before the repository
+// serves any requests.
+func (r *InMemoryRepository) Restore() error {
+	journal, ok := r.store.(Journal)
+	if !ok {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.replaying = true
+	defer func() { r.replaying = false }()
+	return journal.Replay(func(op Op) error {
+		// Ops were validated before they were journaled; one that no longer
+		// applies (e.g. a duplicate) is skipped rather than failing recovery.
+		_ = r.applyLocked(op)
+		return nil
+	})
+}
+
+// commitLocked validates op against the current state, records it in the
+// store's journal (if any) and applies it. With a SharedStore the whole
+// read-modify-write runs under the store's cross-replica stream lock.
+// Caller must hold r.mu in write mode.
+func (r *InMemoryRepository) commitLocked(op Op) error {
+	_, err := r.tryCommitLocked(op, nil)
+	return err
+}
+
+// tryCommitLocked is commitLocked that also reports whether op changed
+// anything (false for no-ops such as duplicates). If inspect is not nil, it
+// is called with the stream's state before op is validated, from the same
+// read that op is applied to.
+// Caller must hold r.mu in write mode.
+func (r *InMemoryRepository) tryCommitLocked(op Op, inspect func(stream *StreamState)) (applied bool, err error) {
+	op.At = r.now().UTC()
+
+	if shared, ok := r.store.(SharedStore); ok {
+		return r.commitSharedLocked(shared, op, inspect)
+	}
+
+	stream, exists := r.store.GetStream(op.StreamID)
+	if !exists {
+		stream = newStreamState(op.StreamID)
+	}
+	if inspect != nil {
+		inspect(stream)
+	}
+	apply, err := r.prepareLocked(stream, exists, op)
+	if err != nil || apply == nil {
+		return false, err
+	}
+
+	journal, journaled := r.store.(Journal)
+	if journaled {
+		if err := journal.Append(op); err != nil {
+			return false, fmt.Errorf("journal %s: %w", op.Kind, err)
+		}
+	}
+
+	apply()
+	r.saveLocked(stream, exists, op)
+
+	if journaled {
+		if err := journal.Checkpoint(); err != nil && r.cfg.OnStoreError != nil {
+			r.cfg.OnStoreError(err)
+		}
+	}
+	return true, nil
+}
+
+// commitSharedLocked is tryCommitLocked for a SharedStore. r.mu is released
+// while waiting for the stream lock, so that a stream held by another replica
+// does not block requests for other streams.
+// Caller must hold r.mu in write mode.
+func (r *InMemoryRepository) commitSharedLocked(store SharedStore, op Op, inspect func(stream *StreamState)) (applied bool, err error) {
+	r.mu.Unlock()
+	unlock, err := store.LockStream(op.StreamID)
+	r.mu.Lock()
+	if err != nil {
+		return false, fmt.Errorf("lock stream: %w", err)
+	}
+	defer unlock()
+
+	stream, exists, err := store.LoadStream(op.StreamID)
+	if err != nil {
+		return false, fmt.Errorf("load stream: %w", err)
+	}
+	if !exists {
+		stream = newStreamState(op.StreamID)
+	}
+	if inspect != nil {
+		inspect(stream)
+	}
+	apply, err := r.prepareLocked(stream, exists, op)
+	if err != nil || apply == nil {
+		return false, err
+	}
+
+	apply()
+	if op.Kind.removesStream() {
+		if err := store.RemoveStream(stream.ID); err != nil {
+			return false, fmt.Errorf("remove stream: %w", err)
+		}
+		return true, nil
+	}
+	touch(stream, exists, op)
+	if err := store.SaveStream(stream); err != nil {
+		return false, fmt.Errorf("save stream: %w", err)
+	}
+	return true, nil
+}
+
+// applyLocked validates and applies op without journaling it. It is used to
+// replay a journal.
+// Caller must hold r.mu in write mode.
+func (r *InMemoryRepository) applyLocked(op Op) error {
+	stream, exists := r.store.GetStream(op.StreamID)
+	if !exists {
+		stream = newStreamState(op.StreamID)
+	}
+	apply, err := r.prepareLocked(stream, exists, op)
+	if err != nil || apply == nil {
+		return err
+	}
+	apply()
+	r.saveLocked(stream, exists, op)
+	return nil
+}
+
+// saveLocked writes stream back to the store after op has been applied to it,
+// or removes it if op deletes the stream.
+// Caller must hold r.mu in write mode.
+func (r *InMemoryRepository) saveLocked(stream *StreamState, exists bool, op Op) {
+	if op.Kind.removesStream() {
+		r.store.DeleteStream(stream.ID)
+		return
+	}
+	touch(stream, exists, op)
+	r.store.SetStream(stream)
+}
+
+// touch updates the stream's timestamps after op has been applied to it.
+func touch(stream *StreamState, exists bool, op Op) {
+	if !exists {
+		stream.CreatedAt = op.At
+	}
+	stream.UpdatedAt = op.At
+}
+
+// prepareLocked validates op against stream (exists is false if stream is a
+// new, not yet stored state) and returns a function that applies it, or a nil
+// function if op is a no-op (e.g. a duplicate). prepareLocked itself must not
+// modify any state.
+// Caller must hold r.mu in write mode.
+func (r *InMemoryRepository) prepareLocked(stream *StreamState, exists bool, op Op) (apply func(), err error) {
+	switch op.Kind {
+	case OpRegisterRendition:
+		if err := checkWritable(stream, op.RenditionID); err != nil {
+			return nil, err
+		}
+		// #EXT-X-TARGETDURATION must not change while segments are listed.
+		if rendition, ok := stream.Renditions[op.RenditionID]; ok && len(rendition.Segments) > 0 &&
+			op.Info.TargetDuration > 0 && op.Info.TargetDuration != rendition.TargetDuration {
+			return nil, ErrTargetDurationLocked
+		}
+		// So must PART-TARGET while parts are listed.
+		if rendition, ok := stream.Renditions[op.RenditionID]; ok && hasParts(rendition) &&
+			op.Info.PartTarget > 0 && op.Info.PartTarget != rendition.PartTarget {
+			return nil, ErrPartTargetLocked
+		}
+		return func() {
+			rendition := r.getOrCreateRenditionLocked(stream, op.RenditionID)
+			rendition.Info = *op.Info
+			if op.Info.TargetDuration > 0 {
+				rendition.TargetDuration = op.Info.TargetDuration
+			}
+			if op.Info.PartTarget > 0 && !hasParts(rendition) {
+				rendition.PartTarget = op.Info.PartTarget
+			}
+		}, nil
+
+	case OpRegisterPart:
+		if err := checkWritable(stream, op.RenditionID); err != nil {
+			return nil, err
+		}
+		part := *op.Part
+		part.Sequence = op.Sequence
+
+		var parts []PartialSegment
+		if rendition, ok := stream.Renditions[op.RenditionID]; ok {
+			if _, exists := rendition.Segments[part.Sequence]; exists {
+				return nil, ErrSegmentComplete
+			}
+			parts = rendition.Parts[part.Sequence]
+			if exceedsPartTarget(part, rendition.PartTarget) {
+				return nil, ErrPartTargetExceeded
+			}
+		}
+
+		// Keep parts ordered by index and ignore duplicates.
+		i := sort.Search(len(parts), func(i int) bool { return parts[i].Index >= part.Index })
+		if i < len(parts) && parts[i].Index == part.Index {
+			return nil, nil
+		}
+		return func() {
+			rendition := r.getOrCreateRenditionLocked(stream, op.RenditionID)
+			part.ReceivedAt = op.At
+			if rendition.PartTarget == 0 {
+				rendition.PartTarget = part.Duration
+			}
+			parts := append(rendition.Parts[part.Sequence], PartialSegment{})
+			copy(parts[i+1:], parts[i:])
+			parts[i] = part
+			rendition.Parts[part.Sequence] = parts
+			r.notify(stream.ID, op.RenditionID)
+		}, nil
+
+	case OpRegisterSegment:
+		if err := checkWritable(stream, op.RenditionID); err != nil {
+			return nil, err
+		}
+		seg := *op.Segment
+
+		// Ignore identical duplicates; reject conflicting ones unless the
+		// stream lets the last writer win.
+		if rendition, ok := stream.Renditions[op.RenditionID]; ok {
+			if existing, exists := rendition.Segments[seg.Sequence]; exists {
+				if sameSegment(existing, seg) {
+					return nil, nil
+				}
+				if !stream.Settings.LastWriterWins {
+					return nil, &SegmentConflictError{Existing: existing, Received: seg}
+				}
+			}
+			if err := resolveByteRange(rendition, &seg); err != nil {
+				return nil, err
+			}
+		} else if seg.ByteRangeLength > 0 && seg.ByteRangeOffset == nil {
+			seg.ByteRangeOffset = new(int64)
+		}
+		target := r.lockedTargetDuration(stream.Renditions[op.RenditionID])
+		exceeded := target > 0 && math.Round(seg.Duration) > float64(target)
+		if exceeded && r.cfg.TargetDurationPolicy == TargetDurationReject {
+			return nil, ErrTargetDurationExceeded
+		}
+		return func() {
+			if exceeded && !r.replaying && r.cfg.OnTargetDurationExceeded != nil {
+				r.cfg.OnTargetDurationExceeded(stream.ID, op.RenditionID, seg, target)
+			}
+			rendition := r.getOrCreateRenditionLocked(stream, op.RenditionID)
+			seg.ReceivedAt = op.At
+			pdt := derivedProgramDateTime(rendition, seg)
+			seg.ProgramDateTime = &pdt
+			seg.Map = rendition.Info.initSection()
+			r.lockTargetDuration(rendition, seg)
+			seg.Parts = rendition.Parts[seg.Sequence]
+			delete(rendition.Parts, seg.Sequence)
+			rendition.Segments[seg.Sequence] = seg
+			r.pruneLocked(rendition, stream.Settings, seg.ReceivedAt)
+			r.notify(stream.ID, op.RenditionID)
+		}, nil
+
+	case OpEndStream:
+		// Treat ending a non-existent or ended stream as a no-op for idempotency.
+		if !exists || stream.Ended {
+			return nil, nil
+		}
+		return func() {
+			stream.Ended = true
+			stream.EndedAt = op.At
+			for _, rendition := range stream.Renditions {
+				rendition.Ended = true
+				r.notify(stream.ID, rendition.ID)
+			}
+		}, nil
+
+	case OpEndRendition:
+		// Like EndStream, ending a non-existent or ended rendition is a no-op.
+		rendition, ok := stream.Renditions[op.RenditionID]
+		if !exists || !ok || rendition.Ended {
+			return nil, nil
+		}
+		return func() {
+			rendition.Ended = true
+			r.notify(stream.ID, rendition.ID)
+		}, nil
+
+	case OpUpdateSettings:
+		if stream.Ended {
+			return nil, ErrStreamEnded
+		}
+		return func() {
+			stream.Settings = *op.Settings
+			for _, rendition := range stream.Renditions {
+				r.notify(stream.ID, rendition.ID)
+			}
+		}, nil
+
+	case OpSetWindowSize:
+		if !exists {
+			return nil, ErrStreamNotFound
+		}
+		if op.RenditionID == "" {
+			if stream.Ended {
+				return nil, ErrStreamEnded
+			}
+			if stream.Settings.WindowSize == op.WindowSize {
+				return nil, nil
+			}
+			return func() {
+				stream.Settings.WindowSize = op.WindowSize
+				for _, rendition := range stream.Renditions {
+					r.notify(stream.ID, rendition.ID)
+				}
+			}, nil
+		}
+		rendition, ok := stream.Renditions[op.RenditionID]
+		if !ok {
+			return nil, ErrRenditionNotFound
+		}
+		if err := checkWritable(stream, op.RenditionID); err != nil {
+			return nil, err
+		}
+		if rendition.Info.WindowSize == op.WindowSize {
+			return nil, nil
+		}
+		return func() {
+			rendition.Info.WindowSize = op.WindowSize
+			r.notify(stream.ID, rendition.ID)
+		}, nil
+
+	case OpRegisterCue:
+		if stream.Ended {
+			return nil, ErrStreamEnded
+		}
+		cue := *op.Cue
+		if cue.ID == "" {
+			cue.ID = defaultCueID(stream.Cues, cue)
+		}
+		if _, dup := findCue(stream.Cues, cue.ID, cue.Type); dup {
+			return nil, nil
+		}
+		return func() {
+			i := sort.Search(len(stream.Cues), func(i int) bool { return stream.Cues[i].Sequence > cue.Sequence })
+			stream.Cues = append(stream.Cues, Cue{})
+			copy(stream.Cues[i+1:], stream.Cues[i:])
+			stream.Cues[i] = cue
+			for _, rendition := range stream.Renditions {
+				r.notify(stream.ID, rendition.ID)
+			}
+		}, nil
+
+	case OpAddKey:
+		if stream.Ended {
+			return nil, ErrStreamEnded
+		}
+		key := *op.Key
+		i := sort.Search(len(stream.Keys), func(i int) bool { return stream.Keys[i].FirstSequence >= key.FirstSequence })
+		if i < len(stream.Keys) && stream.Keys[i].FirstSequence == key.FirstSequence {
+			if sameKey(stream.Keys[i], key) {
+				return nil, nil
+			}
+			return nil, ErrKeyExists
+		}
+		return func() {
+			stream.Keys = append(stream.Keys, ContentKey{})
+			copy(stream.Keys[i+1:], stream.Keys[i:])
+			stream.Keys[i] = key
+			for _, rendition := range stream.Renditions {
+				r.notify(stream.ID, rendition.ID)
+			}
+		}, nil
+
+	case OpDeleteStream:
+		if !exists {
+			return nil, ErrStreamNotFound
+		}
+		return func() { r.notifyStream(stream) }, nil
+
+	case OpPurgeStream:
+		if !exists || !r.expired(stream, op.At) {
+			return nil, nil
+		}
+		return func() { r.notifyStream(stream) }, nil
+
+	case OpCreateStream:
+		if exists {
+			return nil, ErrStreamExists
+		}
+		return func() { stream.Settings = *op.Settings }, nil
+	}
+
+	return nil, fmt.Errorf("unknown op kind %q", op.Kind)
+}
+
+// lockedTargetDuration returns the target duration that segments of
+// rendition (nil if it does not exist yet) must not exceed, or 0 if it is not
+// locked yet.
+func (r *InMemoryRepository) lockedTargetDuration(rendition *RenditionState) int {
+	if rendition == nil || rendition.TargetDuration == 0 {
+		return r.cfg.TargetDuration
+	}
+	return rendition.TargetDuration
+}
+
+// lockTargetDuration locks the target duration of rendition when seg is its
+// first segment and none is declared: to the configured one, or else to seg's
+// duration rounded up. It never changes afterwards, since players must see
+// the same #EXT-X-TARGETDURATION on every reload.
+func (r *InMemoryRepository) lockTargetDuration(rendition *RenditionState, seg Segment) {
+	switch {
+	case rendition.TargetDuration > 0:
+	case r.cfg.TargetDuration > 0:
+		rendition.TargetDuration = r.cfg.TargetDuration
+	default:
+		rendition.TargetDuration = max(1, int(math.Ceil(seg.Duration)))
+	}
+}
+
+// exceedsPartTarget reports whether part is longer than a part target of
+// target seconds (0 if not locked yet), as both are written to playlists:
+// every #EXT-X-PART duration must be at most PART-TARGET.
+func exceedsPartTarget(part PartialSegment, target float64) bool {
+	return target > 0 && math.Round(part.Duration*1000) > math.Round(target*1000)
+}
+
+// hasParts reports whether any part of rendition has been registered and is
+// still retained, pending or folded into its segment.
+func hasParts(rendition *RenditionState) bool {
+	if len(rendition.Parts) > 0 {
+		return true
+	}
+	for _, seg := range rendition.Segments {
+		if len(seg.Parts) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWritable returns an error if stream or the given rendition of it has
+// been ended.
+func checkWritable(stream *StreamState, renditionID RenditionID) error {
+	if stream.Ended {
+		return ErrStreamEnded
+	}
+	if rendition, ok := stream.Renditions[renditionID]; ok && rendition.Ended {
+		return ErrRenditionEnded
+	}
+	return nil
+}
+
+// newStreamState returns an empty stream that has not been stored yet.
+func newStreamState(streamID StreamID) *StreamState {
+	return &StreamState{
 		ID:         streamID,
 		Renditions: make(map[RenditionID]*RenditionState),
 	}
-	r.store.SetStream(stream)
-	return stream
+}
+
+// defaultCueID returns the ID of a cue registered without one: an in cue
+// closes the latest out cue at or before it that has no in cue yet; other
+// cues are named after their sequence number.
+func defaultCueID(cues []Cue, cue Cue) string {
+	if cue.Type == CueIn {
+		for i := len(cues) - 1; i >= 0; i-- {
+			out := cues[i]
+			if out.Type != CueOut || out.Sequence > cue.Sequence {
+				continue
+			}
+			if _, closed := findCue(cues, out.ID, CueIn); !closed {
+				return out.ID
+			}
+		}
+	}
+	return fmt.Sprintf("cue-%d", cue.Sequence)
+}
+
+// derivedProgramDateTime returns the wall-clock start of seg in UTC: the
+// producer-supplied value if any, else the end of the previous segment if it
+// is known, else the time seg was received minus its duration.
+func derivedProgramDateTime(rendition *RenditionState, seg Segment) time.Time {
+	if seg.ProgramDateTime != nil {
+		return seg.ProgramDateTime.UTC()
+	}
+	if prev, ok := rendition.Segments[seg.Sequence-1]; ok && prev.ProgramDateTime != nil {
+		return prev.ProgramDateTime.Add(seconds(prev.Duration))
+	}
+	return seg.ReceivedAt.Add(-seconds(seg.Duration))
+}
+
+// sameSegment reports whether received repeats the registration of existing.
+// Fields the producer omitted from received (and that were derived when
+// existing was registered) are not compared.
+func sameSegment(existing, received Segment) bool {
+	if existing.Duration != received.Duration || existing.Path != received.Path ||
+		existing.Discontinuity != received.Discontinuity || existing.ByteRangeLength != received.ByteRangeLength {
+		return false
+	}
+	if received.ByteRangeOffset != nil && (existing.ByteRangeOffset == nil || *existing.ByteRangeOffset != *received.ByteRangeOffset) {
+		return false
+	}
+	if received.ProgramDateTime != nil && (existing.ProgramDateTime == nil || !existing.ProgramDateTime.Equal(*received.ProgramDateTime)) {
+		return false
+	}
+	return true
+}
+
+// resolveByteRange fills in the omitted offset of a byte-range segment from
+// the closest earlier segment of the same resource (or 0 if there is none) and
+// returns ErrByteRangeOverlap if the range overlaps another retained segment
+// of that resource.
+func resolveByteRange(rendition *RenditionState, seg *Segment) error {
+	if seg.ByteRangeLength == 0 {
+		return nil
+	}
+	var prev *Segment
+	for _, other := range rendition.Segments {
+		if other.Sequence == seg.Sequence || other.Path != seg.Path || other.ByteRangeLength == 0 {
+			continue
+		}
+		if other.Sequence < seg.Sequence && (prev == nil || other.Sequence > prev.Sequence) {
+			prev = &other
+		}
+	}
+	if seg.ByteRangeOffset == nil {
+		var offset int64
+		if prev != nil {
+			offset = prev.byteRangeEnd()
+		}
+		seg.ByteRangeOffset = &offset
+	}
+	for _, other := range rendition.Segments {
+		if other.Sequence == seg.Sequence || other.Path != seg.Path || other.ByteRangeLength == 0 {
+			continue
+		}
+		if *seg.ByteRangeOffset < other.byteRangeEnd() && *other.ByteRangeOffset < seg.byteRangeEnd() {
+			return ErrByteRangeOverlap
+		}
+	}
+	return nil
+}
+
+// seconds converts a duration in (fractional) seconds to a time.Duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
 }
 
 // getOrCreateRenditionLocked returns an existing rendition or creates a new one.
@@ -181,6 +1387,7 @@ func (r *InMemoryRepository) getOrCreateRenditionLocked(stream *StreamState, ren
 	rendition := &RenditionState{
 		ID:       renditionID,
 		Segments: make(map[int64]Segment),
+		Parts:    make(map[int64][]PartialSegment),
 	}
 	stream.Renditions[renditionID] = rendition
 	return rendition
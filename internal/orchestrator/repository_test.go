@@ -2,7 +2,10 @@ package orchestrator
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestInMemoryRepository_RegisterSegment(t *testing.T) {
@@ -118,3 +121,660 @@ func TestInMemoryRepository_EndStream(t *testing.T) {
 		}
 	})
 }
+
+func TestInMemoryRepository_RegisterRendition(t *testing.T) {
+	repo := NewInMemoryRepository()
+	streamID := StreamID("s6")
+	info := RenditionInfo{Bandwidth: 2800000, Resolution: "1280x720"}
+
+	if err := repo.RegisterRendition(streamID, "720p", info); err != nil {
+		t.Fatalf("RegisterRendition: %v", err)
+	}
+	_ = repo.RegisterSegment(streamID, "480p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+
+	renditions, ok := repo.ListRenditions(streamID)
+	if !ok || len(renditions) != 2 {
+		t.Fatalf("ListRenditions: ok=%v len=%d", ok, len(renditions))
+	}
+	if renditions[0].ID != "480p" || renditions[1].ID != "720p" {
+		t.Errorf("expected renditions sorted by ID, got %v", renditions)
+	}
+	if renditions[1].Info != info {
+		t.Errorf("expected registered info %+v, got %+v", info, renditions[1].Info)
+	}
+
+	t.Run("rejected_after_end", func(t *testing.T) {
+		_ = repo.EndStream(streamID)
+		err := repo.RegisterRendition(streamID, "720p", info)
+		if !errors.Is(err, ErrStreamEnded) {
+			t.Errorf("expected ErrStreamEnded, got %v", err)
+		}
+	})
+
+	t.Run("stream_not_found", func(t *testing.T) {
+		if _, ok := repo.ListRenditions("missing"); ok {
+			t.Error("expected ok false for missing stream")
+		}
+	})
+}
+
+func TestInMemoryRepository_RegisterPart(t *testing.T) {
+	repo := NewInMemoryRepository()
+	streamID := StreamID("s7")
+	renditionID := RenditionID("720p")
+
+	_ = repo.RegisterPart(streamID, renditionID, PartialSegment{Sequence: 1, Index: 1, Duration: 1.0, URI: "/1.1.ts"})
+	_ = repo.RegisterPart(streamID, renditionID, PartialSegment{Sequence: 1, Index: 0, Duration: 1.0, URI: "/1.0.ts", Independent: true})
+
+	t.Run("pending_parts_ordered", func(t *testing.T) {
+		snap, ok := repo.GetRendition(streamID, renditionID)
+		if !ok {
+			t.Fatal("GetRendition: ok false")
+		}
+		parts := snap.Parts[1]
+		if len(parts) != 2 || parts[0].Index != 0 || parts[1].Index != 1 {
+			t.Errorf("expected parts 0,1 pending for sequence 1, got %v", parts)
+		}
+	})
+
+	t.Run("duplicate_part_idempotent", func(t *testing.T) {
+		if err := repo.RegisterPart(streamID, renditionID, PartialSegment{Sequence: 1, Index: 0, Duration: 1.0, URI: "/other.ts"}); err != nil {
+			t.Fatalf("duplicate RegisterPart: %v", err)
+		}
+		snap, _ := repo.GetRendition(streamID, renditionID)
+		if len(snap.Parts[1]) != 2 || snap.Parts[1][0].URI != "/1.0.ts" {
+			t.Errorf("duplicate should not change parts, got %v", snap.Parts[1])
+		}
+	})
+
+	t.Run("parts_folded_into_segment", func(t *testing.T) {
+		_ = repo.RegisterSegment(streamID, renditionID, Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+		snap, _ := repo.GetRendition(streamID, renditionID)
+		if len(snap.Parts) != 0 {
+			t.Errorf("expected no pending parts after segment registered, got %v", snap.Parts)
+		}
+		if len(snap.Segments) != 1 || len(snap.Segments[0].Parts) != 2 {
+			t.Errorf("expected 2 parts folded into segment, got %v", snap.Segments)
+		}
+	})
+
+	t.Run("part_of_complete_segment_rejected", func(t *testing.T) {
+		err := repo.RegisterPart(streamID, renditionID, PartialSegment{Sequence: 1, Index: 2, Duration: 1.0, URI: "/1.2.ts"})
+		if !errors.Is(err, ErrSegmentComplete) {
+			t.Errorf("expected ErrSegmentComplete, got %v", err)
+		}
+	})
+}
+
+func TestInMemoryRepository_Watch(t *testing.T) {
+	repo := NewInMemoryRepository()
+	streamID := StreamID("s8")
+	renditionID := RenditionID("720p")
+
+	changed := repo.Watch(streamID, renditionID)
+	select {
+	case <-changed:
+		t.Fatal("watch channel closed before any change")
+	default:
+	}
+
+	_ = repo.RegisterSegment(streamID, renditionID, Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+	select {
+	case <-changed:
+	default:
+		t.Fatal("expected watch channel closed after RegisterSegment")
+	}
+
+	t.Run("other_rendition_not_woken", func(t *testing.T) {
+		other := repo.Watch(streamID, "480p")
+		_ = repo.RegisterSegment(streamID, renditionID, Segment{Sequence: 2, Duration: 2.0, Path: "/2.ts"})
+		select {
+		case <-other:
+			t.Error("480p watcher woken by 720p segment")
+		default:
+		}
+	})
+
+	t.Run("woken_on_end", func(t *testing.T) {
+		ch := repo.Watch(streamID, renditionID)
+		_ = repo.EndStream(streamID)
+		select {
+		case <-ch:
+		default:
+			t.Error("expected watch channel closed after EndStream")
+		}
+	})
+}
+
+func TestInMemoryRepository_retention(t *testing.T) {
+	t.Run("max_segments", func(t *testing.T) {
+		evicted := 0
+		repo := NewInMemoryRepositoryWithConfig(NewInMemoryStore(), RepositoryConfig{
+			Retention: RetentionPolicy{MaxSegments: 3},
+			OnEvict:   func(n int) { evicted += n },
+		})
+		_ = repo.RegisterPart("s1", "720p", PartialSegment{Sequence: 2, Index: 0, Duration: 1.0, URI: "/2.0.ts"})
+		for i := int64(1); i <= 5; i++ {
+			if i == 2 {
+				continue
+			}
+			_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: i, Duration: 2.0, Path: "/x.ts"})
+		}
+
+		snap, _ := repo.GetRendition("s1", "720p")
+		if len(snap.Segments) != 3 || snap.Segments[0].Sequence != 3 {
+			t.Errorf("expected sequences 3..5 retained, got %v", snap.Segments)
+		}
+		if len(snap.Parts) != 0 {
+			t.Errorf("expected abandoned parts of sequence 2 evicted, got %v", snap.Parts)
+		}
+		if evicted != 1 {
+			t.Errorf("expected 1 eviction reported, got %d", evicted)
+		}
+	})
+
+	t.Run("max_age", func(t *testing.T) {
+		repo := NewInMemoryRepositoryWithConfig(NewInMemoryStore(), RepositoryConfig{
+			Retention: RetentionPolicy{MaxAge: 10 * time.Second},
+		})
+		now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+		repo.now = func() time.Time { return now }
+		// Parts of a segment that never arrives, ahead of the live edge.
+		_ = repo.RegisterPart("s1", "720p", PartialSegment{Sequence: 20, Index: 0, Duration: 1.0, URI: "/20.0.ts"})
+		for i := int64(1); i <= 10; i++ {
+			_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: i, Duration: 2.0, Path: "/x.ts"})
+			now = now.Add(2 * time.Second)
+		}
+
+		snap, _ := repo.GetRendition("s1", "720p")
+		// Segment 10 was registered at t=18s; segments older than t=8s are gone.
+		if len(snap.Segments) != 6 || snap.Segments[0].Sequence != 5 {
+			t.Errorf("expected sequences 5..10 retained, got %v", snap.Segments)
+		}
+		if len(snap.Parts) != 0 {
+			t.Errorf("expected abandoned parts of sequence 20 evicted by age, got %v", snap.Parts)
+		}
+	})
+
+	t.Run("disabled_by_default", func(t *testing.T) {
+		repo := NewInMemoryRepository()
+		for i := int64(1); i <= 100; i++ {
+			_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: i, Duration: 2.0, Path: "/x.ts"})
+		}
+		segs, _, _ := repo.GetRenditionSnapshot("s1", "720p")
+		if len(segs) != 100 {
+			t.Errorf("expected all 100 segments kept, got %d", len(segs))
+		}
+	})
+}
+
+func TestInMemoryRepository_part_target(t *testing.T) {
+	repo := NewInMemoryRepository()
+
+	// The first part locks the part target before it is first published;
+	// longer parts are rejected so that none exceeds it.
+	for i, d := range []float64{0.333, 0.3334, 0.2} {
+		if err := repo.RegisterPart("s1", "720p", PartialSegment{Sequence: 1, Index: i, Duration: d, URI: fmt.Sprintf("/1.%d.ts", i)}); err != nil {
+			t.Fatalf("RegisterPart %v: %v", d, err)
+		}
+		if snap, _ := repo.GetRendition("s1", "720p"); snap.PartTarget != 0.333 {
+			t.Fatalf("expected part target 0.333 after part %d, got %v", i, snap.PartTarget)
+		}
+	}
+	if err := repo.RegisterPart("s1", "720p", PartialSegment{Sequence: 1, Index: 3, Duration: 1.5, URI: "/1.3.ts"}); err != ErrPartTargetExceeded {
+		t.Errorf("expected ErrPartTargetExceeded, got %v", err)
+	}
+	snap, _ := repo.GetRendition("s1", "720p")
+	m3u8 := BuildMediaPlaylist(MediaPlaylist{PartTarget: snap.PartTarget, PendingParts: snap.Parts[1]})
+	if !strings.Contains(m3u8, "#EXT-X-PART-INF:PART-TARGET=0.333\n") || strings.Contains(m3u8, "DURATION=1.500") {
+		t.Errorf("expected the locked part target and no longer part, got %s", m3u8)
+	}
+
+	// A declared part target is used from the first part on and is locked
+	// once parts are registered.
+	_ = repo.RegisterRendition("s1", "480p", RenditionInfo{Bandwidth: 800000, PartTarget: 1.0})
+	if err := repo.RegisterPart("s1", "480p", PartialSegment{Sequence: 1, Index: 0, Duration: 0.5, URI: "/1.0.ts"}); err != nil {
+		t.Errorf("expected a part within the declared part target, got %v", err)
+	}
+	if snap, _ := repo.GetRendition("s1", "480p"); snap.PartTarget != 1.0 {
+		t.Errorf("expected the declared part target 1.0, got %v", snap.PartTarget)
+	}
+	if err := repo.RegisterRendition("s1", "480p", RenditionInfo{Bandwidth: 800000, PartTarget: 2.0}); err != ErrPartTargetLocked {
+		t.Errorf("expected ErrPartTargetLocked, got %v", err)
+	}
+}
+
+func TestInMemoryRepository_EndRendition(t *testing.T) {
+	repo := NewInMemoryRepository()
+	streamID := StreamID("s9")
+
+	if err := repo.EndRendition(streamID, "1080p"); err != nil {
+		t.Errorf("EndRendition nonexistent should be no-op: %v", err)
+	}
+
+	_ = repo.RegisterSegment(streamID, "1080p", Segment{Sequence: 1, Duration: 2.0, Path: "/a.ts"})
+	_ = repo.RegisterSegment(streamID, "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/b.ts"})
+	if err := repo.EndRendition(streamID, "1080p"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ended, _ := repo.GetRenditionSnapshot(streamID, "1080p"); !ended {
+		t.Error("1080p should be ended")
+	}
+	if _, ended, _ := repo.GetRenditionSnapshot(streamID, "720p"); ended {
+		t.Error("720p should not be ended")
+	}
+
+	err := repo.RegisterSegment(streamID, "1080p", Segment{Sequence: 2, Duration: 2.0, Path: "/a.ts"})
+	if !errors.Is(err, ErrRenditionEnded) {
+		t.Errorf("expected ErrRenditionEnded, got %v", err)
+	}
+	if err := repo.RegisterSegment(streamID, "720p", Segment{Sequence: 2, Duration: 2.0, Path: "/b.ts"}); err != nil {
+		t.Errorf("other renditions should keep going: %v", err)
+	}
+	if repo.ActiveStreamCount() != 1 {
+		t.Errorf("stream should still be active, got %d", repo.ActiveStreamCount())
+	}
+}
+
+func TestInMemoryRepository_DeleteStream(t *testing.T) {
+	repo := NewInMemoryRepository()
+
+	if err := repo.DeleteStream("missing"); !errors.Is(err, ErrStreamNotFound) {
+		t.Errorf("expected ErrStreamNotFound, got %v", err)
+	}
+
+	_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/a.ts"})
+	watch := repo.Watch("s1", "720p")
+	if err := repo.DeleteStream("s1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := repo.GetRendition("s1", "720p"); ok {
+		t.Error("rendition should be gone after DeleteStream")
+	}
+	select {
+	case <-watch:
+	default:
+		t.Error("watchers should be woken when the stream is deleted")
+	}
+	if err := repo.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/b.ts"}); err != nil {
+		t.Errorf("stream ID should be reusable after delete: %v", err)
+	}
+}
+
+func TestInMemoryRepository_PurgeExpired(t *testing.T) {
+	purged := 0
+	repo := NewInMemoryRepositoryWithConfig(NewInMemoryStore(), RepositoryConfig{
+		EndedStreamTTL: time.Minute,
+		IdleStreamTTL:  time.Hour,
+		OnPurge:        func(n int) { purged += n },
+	})
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	repo.now = func() time.Time { return now }
+
+	_ = repo.RegisterSegment("ended", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/a.ts"})
+	_ = repo.EndStream("ended")
+	_ = repo.RegisterSegment("idle", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/a.ts"})
+	_ = repo.RegisterSegment("live", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/a.ts"})
+
+	now = now.Add(2 * time.Minute)
+	if n := repo.PurgeExpired(); n != 1 {
+		t.Errorf("expected only the ended stream purged, got %d", n)
+	}
+	if _, ok := repo.GetRendition("ended", "720p"); ok {
+		t.Error("ended stream should be purged after EndedStreamTTL")
+	}
+
+	now = now.Add(59 * time.Minute)
+	_ = repo.RegisterSegment("live", "720p", Segment{Sequence: 2, Duration: 2.0, Path: "/b.ts"})
+	now = now.Add(2 * time.Minute)
+	if n := repo.PurgeExpired(); n != 1 {
+		t.Errorf("expected only the idle stream purged, got %d", n)
+	}
+	if _, ok := repo.GetRendition("idle", "720p"); ok {
+		t.Error("idle stream should be purged after IdleStreamTTL")
+	}
+	if _, ok := repo.GetRendition("live", "720p"); !ok {
+		t.Error("recently updated stream should be kept")
+	}
+	if purged != 2 {
+		t.Errorf("expected OnPurge to report 2, got %d", purged)
+	}
+}
+
+func TestInMemoryRepository_PurgeExpired_archived(t *testing.T) {
+	repo := NewInMemoryRepositoryWithConfig(NewInMemoryStore(), RepositoryConfig{EndedStreamTTL: time.Minute})
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	repo.now = func() time.Time { return now }
+
+	_ = repo.CreateStream("archived", StreamSettings{Archive: true})
+	_ = repo.CreateStream("live", StreamSettings{})
+	for _, id := range []StreamID{"archived", "live"} {
+		_ = repo.RegisterSegment(id, "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/a.ts"})
+		_ = repo.EndStream(id)
+	}
+
+	now = now.Add(24 * time.Hour)
+	if n := repo.PurgeExpired(); n != 1 {
+		t.Errorf("expected only the live stream purged, got %d", n)
+	}
+	if _, ok := repo.GetRendition("archived", "720p"); !ok {
+		t.Error("archived stream should be kept without an ArchivedStreamTTL")
+	}
+
+	repo.cfg.ArchivedStreamTTL = time.Hour
+	if n := repo.PurgeExpired(); n != 1 {
+		t.Errorf("expected the archived stream purged after ArchivedStreamTTL, got %d", n)
+	}
+}
+
+func TestInMemoryRepository_PurgeExpired_stream_ttl(t *testing.T) {
+	repo := NewInMemoryRepository()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	repo.now = func() time.Time { return now }
+
+	_ = repo.CreateStream("short", StreamSettings{TTL: 60})
+	_ = repo.CreateStream("default", StreamSettings{})
+
+	now = now.Add(2 * time.Minute)
+	if n := repo.PurgeExpired(); n != 1 {
+		t.Errorf("expected only the stream with a TTL purged, got %d", n)
+	}
+	if _, ok := repo.GetStream("short"); ok {
+		t.Error("stream should be purged after its own TTL")
+	}
+	if _, ok := repo.GetStream("default"); !ok {
+		t.Error("stream without TTLs should be kept")
+	}
+}
+
+func TestInMemoryRepository_CreateStream(t *testing.T) {
+	repo := NewInMemoryRepository()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	repo.now = func() time.Time { return now }
+
+	if err := repo.CreateStream("s1", StreamSettings{WindowSize: 3}); err != nil {
+		t.Fatalf("CreateStream: %v", err)
+	}
+	if err := repo.CreateStream("s1", StreamSettings{}); err != ErrStreamExists {
+		t.Errorf("expected ErrStreamExists, got %v", err)
+	}
+
+	_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: 4, Duration: 2.0, Path: "/720p/4.ts"})
+	_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: 5, Duration: 2.0, Path: "/720p/5.ts"})
+	_ = repo.RegisterSegment("s1", "480p", Segment{Sequence: 4, Duration: 2.0, Path: "/480p/4.ts"})
+	now = now.Add(time.Minute)
+	_ = repo.EndStream("s1")
+
+	stream, ok := repo.GetStream("s1")
+	if !ok {
+		t.Fatal("GetStream: ok false")
+	}
+	if stream.Settings.WindowSize != 3 || !stream.Ended || stream.EndedAt == nil || !stream.EndedAt.Equal(now) {
+		t.Errorf("unexpected stream %+v", stream)
+	}
+	if stream.LatestSequence == nil || *stream.LatestSequence != 5 {
+		t.Errorf("expected latest sequence 5, got %v", stream.LatestSequence)
+	}
+	if len(stream.Renditions) != 2 || stream.Renditions[1].ID != "720p" || stream.Renditions[1].SegmentCount != 2 {
+		t.Errorf("unexpected renditions %+v", stream.Renditions)
+	}
+
+	_ = repo.CreateStream("a", StreamSettings{})
+	var ids []StreamID
+	for _, st := range repo.ListStreams() {
+		ids = append(ids, st.ID)
+	}
+	if len(ids) != 2 || ids[0] != "a" || ids[1] != "s1" {
+		t.Errorf("expected streams sorted by ID, got %v", ids)
+	}
+}
+
+func TestInMemoryRepository_UpdateStreamSettings(t *testing.T) {
+	repo := NewInMemoryRepository()
+	settings := StreamSettings{GapPolicy: GapPolicyGap, GapTimeout: 2}
+
+	if err := repo.UpdateStreamSettings("s1", settings); err != nil {
+		t.Fatal(err)
+	}
+	_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/a.ts"})
+
+	snap, _ := repo.GetRendition("s1", "720p")
+	if snap.Settings != settings {
+		t.Errorf("expected settings %+v in snapshot, got %+v", settings, snap.Settings)
+	}
+
+	_ = repo.EndStream("s1")
+	if err := repo.UpdateStreamSettings("s1", StreamSettings{}); !errors.Is(err, ErrStreamEnded) {
+		t.Errorf("expected ErrStreamEnded, got %v", err)
+	}
+}
+
+func TestInMemoryRepository_RegisterSegment_program_date_time(t *testing.T) {
+	repo := NewInMemoryRepository()
+	now := time.Date(2026, 1, 1, 12, 0, 10, 0, time.UTC)
+	repo.now = func() time.Time { return now }
+
+	supplied := time.Date(2026, 1, 1, 13, 0, 0, 0, time.FixedZone("CET", 3600))
+	_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts", ProgramDateTime: &supplied})
+	_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: 2, Duration: 2.0, Path: "/2.ts"})
+	_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: 5, Duration: 4.0, Path: "/5.ts"})
+
+	snap, _ := repo.GetRendition("s1", "720p")
+	want := []time.Time{
+		time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC), // supplied, normalised to UTC
+		time.Date(2026, 1, 1, 12, 0, 2, 0, time.UTC), // previous segment + its duration
+		time.Date(2026, 1, 1, 12, 0, 6, 0, time.UTC), // received at minus duration
+	}
+	for i, seg := range snap.Segments {
+		if seg.ProgramDateTime == nil || !seg.ProgramDateTime.Equal(want[i]) || seg.ProgramDateTime.Location() != time.UTC {
+			t.Errorf("segment %d: expected program date time %v, got %v", seg.Sequence, want[i], seg.ProgramDateTime)
+		}
+	}
+}
+
+func TestInMemoryRepository_RegisterSegment_init_section(t *testing.T) {
+	repo := NewInMemoryRepository()
+	info := RenditionInfo{Bandwidth: 2000000, Container: ContainerFMP4, InitURI: "/init1.mp4"}
+	_ = repo.RegisterRendition("s1", "720p", info)
+	_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.m4s"})
+
+	info.InitURI = "/init2.mp4"
+	_ = repo.RegisterRendition("s1", "720p", info)
+	_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: 2, Duration: 2.0, Path: "/2.m4s"})
+
+	snap, _ := repo.GetRendition("s1", "720p")
+	for i, want := range []string{"/init1.mp4", "/init2.mp4"} {
+		if m := snap.Segments[i].Map; m == nil || m.URI != want {
+			t.Errorf("segment %d: expected map %s, got %+v", i+1, want, m)
+		}
+	}
+}
+
+func TestInMemoryRepository_RegisterSegment_byte_range(t *testing.T) {
+	repo := NewInMemoryRepository()
+	offset := int64(100)
+	_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/min1.ts", ByteRangeLength: 500, ByteRangeOffset: &offset})
+	_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: 2, Duration: 2.0, Path: "/min1.ts", ByteRangeLength: 400})
+	_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: 3, Duration: 2.0, Path: "/min2.ts", ByteRangeLength: 300})
+
+	snap, _ := repo.GetRendition("s1", "720p")
+	for i, want := range []int64{100, 600, 0} {
+		if got := snap.Segments[i].ByteRangeOffset; got == nil || *got != want {
+			t.Errorf("segment %d: expected offset %d, got %v", i+1, want, got)
+		}
+	}
+
+	overlapping := int64(900)
+	err := repo.RegisterSegment("s1", "720p", Segment{Sequence: 4, Duration: 2.0, Path: "/min1.ts", ByteRangeLength: 200, ByteRangeOffset: &overlapping})
+	if err != ErrByteRangeOverlap {
+		t.Errorf("expected ErrByteRangeOverlap, got %v", err)
+	}
+	err = repo.RegisterSegment("s1", "720p", Segment{Sequence: 4, Duration: 2.0, Path: "/min2.ts", ByteRangeLength: 200, ByteRangeOffset: &overlapping})
+	if err != nil {
+		t.Errorf("expected ranges of other resources not to overlap, got %v", err)
+	}
+}
+
+func TestInMemoryRepository_PutSegment_duplicates(t *testing.T) {
+	repo := NewInMemoryRepository()
+	seg := Segment{Sequence: 1, Duration: 2.0, Path: "/a/1.ts"}
+
+	if outcome, err := repo.PutSegment("s1", "720p", seg); err != nil || outcome != SegmentCreated {
+		t.Fatalf("expected SegmentCreated, got %v, %v", outcome, err)
+	}
+	if outcome, err := repo.PutSegment("s1", "720p", seg); err != nil || outcome != SegmentUnchanged {
+		t.Errorf("expected SegmentUnchanged for an identical duplicate, got %v, %v", outcome, err)
+	}
+
+	other := Segment{Sequence: 1, Duration: 2.0, Path: "/b/1.ts"}
+	_, err := repo.PutSegment("s1", "720p", other)
+	conflict, ok := err.(*SegmentConflictError)
+	if !ok {
+		t.Fatalf("expected *SegmentConflictError, got %v", err)
+	}
+	if conflict.Existing.Path != "/a/1.ts" || conflict.Received.Path != "/b/1.ts" {
+		t.Errorf("expected both payloads in the conflict, got %+v", conflict)
+	}
+
+	_ = repo.UpdateStreamSettings("s1", StreamSettings{LastWriterWins: true})
+	if outcome, err := repo.PutSegment("s1", "720p", other); err != nil || outcome != SegmentReplaced {
+		t.Errorf("expected SegmentReplaced with last_writer_wins, got %v, %v", outcome, err)
+	}
+	snap, _ := repo.GetRendition("s1", "720p")
+	if len(snap.Segments) != 1 || snap.Segments[0].Path != "/b/1.ts" {
+		t.Errorf("expected the segment to be replaced, got %+v", snap.Segments)
+	}
+}
+
+func TestInMemoryRepository_target_duration(t *testing.T) {
+	var violations []int64
+	repo := NewInMemoryRepositoryWithConfig(NewInMemoryStore(), RepositoryConfig{
+		OnTargetDurationExceeded: func(_ StreamID, _ RenditionID, seg Segment, target int) {
+			violations = append(violations, seg.Sequence)
+		},
+	})
+
+	// The first segment locks the target duration.
+	_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 1.6, Path: "/1.ts"})
+	_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: 2, Duration: 2.0, Path: "/2.ts"})
+	_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: 3, Duration: 2.4, Path: "/3.ts"})
+	if err := repo.RegisterSegment("s1", "720p", Segment{Sequence: 4, Duration: 2.6, Path: "/4.ts"}); err != nil {
+		t.Fatalf("expected the flag policy to accept a long segment, got %v", err)
+	}
+	snap, _ := repo.GetRendition("s1", "720p")
+	if snap.TargetDuration != 2 || len(snap.Segments) != 4 {
+		t.Errorf("expected target duration 2 locked from the first segment and 4 segments, got %d and %d", snap.TargetDuration, len(snap.Segments))
+	}
+	if len(violations) != 1 || violations[0] != 4 {
+		t.Errorf("expected a violation for segment 4 only, got %v", violations)
+	}
+
+	_ = repo.RegisterRendition("s1", "480p", RenditionInfo{Bandwidth: 800000, TargetDuration: 6})
+	_ = repo.RegisterSegment("s1", "480p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+	if snap, _ := repo.GetRendition("s1", "480p"); snap.TargetDuration != 6 {
+		t.Errorf("expected the declared target duration 6, got %d", snap.TargetDuration)
+	}
+
+	if err := repo.RegisterRendition("s1", "720p", RenditionInfo{Bandwidth: 2800000, TargetDuration: 10}); err != ErrTargetDurationLocked {
+		t.Errorf("expected ErrTargetDurationLocked, got %v", err)
+	}
+	if err := repo.RegisterRendition("s1", "720p", RenditionInfo{Bandwidth: 2800000, TargetDuration: 2}); err != nil {
+		t.Errorf("expected the locked target duration to be accepted, got %v", err)
+	}
+	if err := repo.RegisterRendition("s1", "720p", RenditionInfo{Bandwidth: 3000000}); err != nil {
+		t.Errorf("expected metadata without a target duration to be accepted, got %v", err)
+	}
+	if snap, _ := repo.GetRendition("s1", "720p"); snap.TargetDuration != 2 {
+		t.Errorf("expected the target duration to stay 2, got %d", snap.TargetDuration)
+	}
+}
+
+func TestInMemoryRepository_target_duration_reject(t *testing.T) {
+	repo := NewInMemoryRepositoryWithConfig(NewInMemoryStore(), RepositoryConfig{TargetDurationPolicy: TargetDurationReject})
+
+	for seq := int64(1); seq <= 3; seq++ {
+		_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: seq, Duration: 2.0, Path: fmt.Sprintf("/%d.ts", seq)})
+	}
+	if err := repo.RegisterSegment("s1", "720p", Segment{Sequence: 4, Duration: 2.6, Path: "/4.ts"}); err != ErrTargetDurationExceeded {
+		t.Errorf("expected ErrTargetDurationExceeded, got %v", err)
+	}
+	if snap, _ := repo.GetRendition("s1", "720p"); len(snap.Segments) != 3 {
+		t.Errorf("expected the long segment to be rejected, got %d segments", len(snap.Segments))
+	}
+}
+
+func TestInMemoryRepository_target_duration_configured(t *testing.T) {
+	repo := NewInMemoryRepositoryWithConfig(NewInMemoryStore(), RepositoryConfig{TargetDuration: 4, TargetDurationPolicy: TargetDurationReject})
+
+	_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 1.0, Path: "/1.ts"})
+	if err := repo.RegisterSegment("s1", "720p", Segment{Sequence: 2, Duration: 4.2, Path: "/2.ts"}); err != nil {
+		t.Errorf("expected a segment within the configured target duration, got %v", err)
+	}
+	if err := repo.RegisterSegment("s1", "720p", Segment{Sequence: 3, Duration: 4.6, Path: "/3.ts"}); err != ErrTargetDurationExceeded {
+		t.Errorf("expected ErrTargetDurationExceeded, got %v", err)
+	}
+	if snap, _ := repo.GetRendition("s1", "720p"); snap.TargetDuration != 4 {
+		t.Errorf("expected the configured target duration 4, got %d", snap.TargetDuration)
+	}
+}
+
+func TestInMemoryRepository_retention_playlist_types(t *testing.T) {
+	repo := NewInMemoryRepositoryWithConfig(NewInMemoryStore(), RepositoryConfig{
+		Retention: RetentionPolicy{MaxSegments: 3},
+	})
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	repo.now = func() time.Time { return now }
+	_ = repo.UpdateStreamSettings("event", StreamSettings{PlaylistType: PlaylistTypeEvent})
+	_ = repo.UpdateStreamSettings("dvr", StreamSettings{PlaylistType: PlaylistTypeDVR, DVRWindow: 10})
+	_ = repo.UpdateStreamSettings("archive", StreamSettings{Archive: true})
+	_ = repo.UpdateStreamSettings("live", StreamSettings{})
+	for i := int64(1); i <= 10; i++ {
+		for _, id := range []StreamID{"event", "dvr", "archive", "live"} {
+			_ = repo.RegisterSegment(id, "720p", Segment{Sequence: i, Duration: 2.0, Path: "/x.ts"})
+		}
+		now = now.Add(2 * time.Second)
+	}
+
+	if segs, _, _ := repo.GetRenditionSnapshot("event", "720p"); len(segs) != 10 {
+		t.Errorf("event: expected no eviction, got %d segments", len(segs))
+	}
+	if segs, _, _ := repo.GetRenditionSnapshot("archive", "720p"); len(segs) != 10 {
+		t.Errorf("archive: expected no eviction, got %d segments", len(segs))
+	}
+	if segs, _, _ := repo.GetRenditionSnapshot("live", "720p"); len(segs) != 3 {
+		t.Errorf("live: expected 3 segments retained, got %d", len(segs))
+	}
+	// Segment 10 was registered at t=18s; the DVR window keeps t>8s.
+	if segs, _, _ := repo.GetRenditionSnapshot("dvr", "720p"); len(segs) != 5 || segs[0].Sequence != 6 {
+		t.Errorf("dvr: expected sequences 6..10 retained, got %v", segs)
+	}
+}
+
+func TestInMemoryRepository_RegisterCue(t *testing.T) {
+	repo := NewInMemoryRepository()
+	_ = repo.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/a.ts"})
+
+	_ = repo.RegisterCue("s1", Cue{ID: "b", Type: CueOut, Sequence: 20})
+	_ = repo.RegisterCue("s1", Cue{Type: CueOut, Sequence: 10})
+	_ = repo.RegisterCue("s1", Cue{Type: CueIn, Sequence: 15})
+	_ = repo.RegisterCue("s1", Cue{Type: CueIn, Sequence: 25})
+	_ = repo.RegisterCue("s1", Cue{Type: CueIn, Sequence: 30})
+
+	snap, _ := repo.GetRendition("s1", "720p")
+	want := []string{"cue-10", "cue-10", "b", "b", "cue-30"}
+	if len(snap.Cues) != len(want) {
+		t.Fatalf("expected %d cues, got %v", len(want), snap.Cues)
+	}
+	for i, cue := range snap.Cues {
+		if cue.ID != want[i] {
+			t.Errorf("cue %d (sequence %d): expected ID %q, got %q", i, cue.Sequence, want[i], cue.ID)
+		}
+	}
+
+	_ = repo.EndStream("s1")
+	if err := repo.RegisterCue("s1", Cue{Type: CueOut, Sequence: 40}); !errors.Is(err, ErrStreamEnded) {
+		t.Errorf("expected ErrStreamEnded, got %v", err)
+	}
+}
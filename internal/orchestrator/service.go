@@ -1,48 +1,424 @@
 package orchestrator
 
 import (
+	"context"
+	"errors"
 	"sort"
+	"time"
 )
 
 // DefaultWindowSize is the default number of segments in the sliding window (per spec).
 const DefaultWindowSize = 6
 
+// DefaultBlockingReloadTimeout is how long a blocking playlist reload waits for
+// the requested segment or part before giving up.
+const DefaultBlockingReloadTimeout = 6 * time.Second
+
+// DefaultGapTimeout is how long the skip and gap policies wait for a missing
+// segment before moving past it, unless the stream overrides it.
+const DefaultGapTimeout = 6 * time.Second
+
+var (
+	// ErrPlaylistNotFound is returned when the requested stream or rendition
+	// does not exist.
+	ErrPlaylistNotFound = errors.New("playlist not found")
+
+	// ErrPlaylistTimeout is returned when a blocking playlist reload expires
+	// before the requested segment or part becomes visible.
+	ErrPlaylistTimeout = errors.New("timed out waiting for playlist update")
+
+	// ErrInvalidDirective is returned for malformed or out-of-range
+	// _HLS_msn / _HLS_part delivery directives.
+	ErrInvalidDirective = errors.New("invalid delivery directive")
+
+	// ErrEventOverride is returned when an EVENT playlist is requested for a
+	// stream that is not an EVENT stream: its segments are evicted by the
+	// retention policy, while an EVENT playlist must only grow.
+	ErrEventOverride = errors.New("event playlists are only served for event streams")
+)
+
+// ServiceConfig holds Service settings. Zero values select the defaults.
+type ServiceConfig struct {
+	WindowSize            int
+	BlockingReloadTimeout time.Duration
+	GapTimeout            time.Duration
+
+	// VODOutputDir, if set, is where the VOD playlist of each rendition is
+	// written when it ends. OnVODError is called when writing fails.
+	VODOutputDir string
+	OnVODError   func(error)
+}
+
 // Service applies business logic (contiguous sliding window) and delegates storage to Repository.
 type Service struct {
-	repo       Repository
-	windowSize int
+	repo                  Repository
+	windowSize            int
+	blockingReloadTimeout time.Duration
+	gapTimeout            time.Duration
+	vodOutputDir          string
+	onVODError            func(error)
+	now                   func() time.Time
 }
 
 // NewService returns a Service that uses repo and keeps at most windowSize segments
 // in the contiguous sliding window. If windowSize <= 0, DefaultWindowSize is used.
 func NewService(repo Repository, windowSize int) *Service {
-	if windowSize <= 0 {
-		windowSize = DefaultWindowSize
+	return NewServiceWithConfig(repo, ServiceConfig{WindowSize: windowSize})
+}
+
+// NewServiceWithConfig returns a Service that uses repo and the given settings.
+func NewServiceWithConfig(repo Repository, cfg ServiceConfig) *Service {
+	if cfg.WindowSize <= 0 {
+		cfg.WindowSize = DefaultWindowSize
+	}
+	if cfg.BlockingReloadTimeout <= 0 {
+		cfg.BlockingReloadTimeout = DefaultBlockingReloadTimeout
+	}
+	if cfg.GapTimeout <= 0 {
+		cfg.GapTimeout = DefaultGapTimeout
+	}
+	return &Service{
+		repo:                  repo,
+		windowSize:            cfg.WindowSize,
+		blockingReloadTimeout: cfg.BlockingReloadTimeout,
+		gapTimeout:            cfg.GapTimeout,
+		vodOutputDir:          cfg.VODOutputDir,
+		onVODError:            cfg.OnVODError,
+		now:                   time.Now,
 	}
-	return &Service{repo: repo, windowSize: windowSize}
 }
 
 // RegisterSegment records a segment for the given stream and rendition.
-// It delegates to the repository; duplicates are idempotent.
+// It delegates to the repository; identical duplicates are idempotent.
 func (s *Service) RegisterSegment(streamID StreamID, renditionID RenditionID, seg Segment) error {
 	return s.repo.RegisterSegment(streamID, renditionID, seg)
 }
 
+// PutSegment is RegisterSegment that also reports whether the segment was
+// created, was already registered, or replaced a conflicting registration.
+// Conflicting duplicates return a *SegmentConflictError.
+func (s *Service) PutSegment(streamID StreamID, renditionID RenditionID, seg Segment) (SegmentOutcome, error) {
+	return s.repo.PutSegment(streamID, renditionID, seg)
+}
+
 // GetPlaylist returns the HLS playlist for the given stream and rendition:
-// a contiguous sliding window of at most s.windowSize segments, no gaps.
+// for live streams a sliding window of at most the rendition's window size, with
+// missing segments handled according to the stream's gap policy.
 func (s *Service) GetPlaylist(streamID StreamID, renditionID RenditionID) (m3u8 string, ok bool) {
-	segments, ended, ok := s.repo.GetRenditionSnapshot(streamID, renditionID)
+	snap, ok := s.repo.GetRendition(streamID, renditionID)
 	if !ok {
 		return "", false
 	}
-	// This is the alternative implementation to contiguousSlidingWindow.
-	window := contiguousVisibleSegments(segments, s.windowSize)
-	return BuildLivePlaylist(window, ended), true
+	p, _ := s.mediaPlaylist(s.alignedSnapshot(streamID, renditionID, snap), "")
+	return BuildMediaPlaylist(p), true
+}
+
+// PlaylistRequest holds the LL-HLS delivery directives of a playlist request.
+type PlaylistRequest struct {
+	// MSN is the _HLS_msn directive: the media sequence number to wait for.
+	MSN *int64
+	// Part is the _HLS_part directive: the part of MSN to wait for. It is
+	// only valid together with MSN.
+	Part *int
+	// Type overrides the stream's playlist type when set.
+	Type PlaylistType
+	// Token is the token query parameter of the request, added to the key
+	// URIs of the playlist.
+	Token string
+}
+
+// WaitForPlaylist is GetPlaylist with blocking playlist reload: when req
+// carries an _HLS_msn directive, it holds the request until that segment (or
+// part of it) is in the playlist, the rendition ends, or the blocking reload
+// timeout expires. Without directives it returns immediately.
+func (s *Service) WaitForPlaylist(ctx context.Context, streamID StreamID, renditionID RenditionID, req PlaylistRequest) (string, error) {
+	if req.Part != nil && req.MSN == nil {
+		return "", ErrInvalidDirective
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.blockingReloadTimeout)
+	defer cancel()
+
+	for {
+		// Subscribe before reading so no change between the two is missed.
+		// Aligned playlists also change when another rendition does.
+		var changed <-chan struct{}
+		if settings, _ := s.repo.GetStreamSettings(streamID); settings.Aligned {
+			changed = s.watchStream(ctx, streamID, renditionID)
+		} else {
+			changed = s.repo.Watch(streamID, renditionID)
+		}
+
+		snap, ok, err := s.repo.LoadRendition(streamID, renditionID)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", ErrPlaylistNotFound
+		}
+		if req.Type == PlaylistTypeEvent && snap.Settings.PlaylistType != PlaylistTypeEvent {
+			return "", ErrEventOverride
+		}
+		p, refreshAt := s.mediaPlaylist(s.alignedSnapshot(streamID, renditionID, snap), req.Type)
+		p.Token = req.Token
+		if req.MSN == nil || p.Ended {
+			return BuildMediaPlaylist(p), nil
+		}
+		if n := len(p.Segments); n > 0 && *req.MSN > p.Segments[n-1].Sequence+2 {
+			return "", ErrInvalidDirective
+		}
+		if playlistContains(p, *req.MSN, req.Part) {
+			return BuildMediaPlaylist(p), nil
+		}
+
+		// A hole blocking the live edge may expire without any change.
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !refreshAt.IsZero() {
+			timer = time.NewTimer(refreshAt.Sub(s.now()))
+			expired = timer.C
+		}
+
+		select {
+		case <-changed:
+		case <-expired:
+		case <-ctx.Done():
+			return "", ErrPlaylistTimeout
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// mediaPlaylist computes the visible media playlist of a rendition snapshot as
+// a playlist of type typ, or of the stream's playlist type if typ is empty.
+// refreshAt is when a missing segment truncating the playlist will be skipped
+// or filled, or zero if there is none.
+//
+// EVENT and DVR playlists span far more segments than a live window, so under
+// the truncate policy a hole would hold them back until it slid out of the
+// whole playlist. In these playlists a hole is therefore filled with
+// #EXT-X-GAP placeholders once it is older than the gap timeout, whatever the
+// policy, except that the skip policy skips it in DVR playlists. EVENT
+// playlists must only grow and never skip.
+func (s *Service) mediaPlaylist(snap RenditionSnapshot, typ PlaylistType) (p MediaPlaylist, refreshAt time.Time) {
+	if typ == "" {
+		typ = snap.Settings.PlaylistType
+	}
+	timeout := s.gapTimeout
+	if snap.Settings.GapTimeout > 0 {
+		timeout = seconds(snap.Settings.GapTimeout)
+	}
+	windowSize := s.windowSizeFor(snap)
+
+	var window []Segment
+	switch {
+	case typ == PlaylistTypeEvent:
+		p.Type = "EVENT"
+		window, refreshAt = eventSegments(snap.Segments, timeout, s.now())
+	case typ == PlaylistTypeDVR:
+		// Slide first, so that holes too long to fill eventually leave the
+		// DVR window.
+		n := max(dvrWindowSize(snap.Segments, snap.Settings.dvrWindow()), windowSize)
+		segs := snap.Segments[max(len(snap.Segments)-n, 0):]
+		fill := snap.Settings.GapPolicy != GapPolicySkip
+		window, refreshAt = gapTolerantSegments(segs, max(len(segs), 1), fill, timeout, s.now())
+	case snap.Settings.GapPolicy == GapPolicySkip, snap.Settings.GapPolicy == GapPolicyGap:
+		fill := snap.Settings.GapPolicy == GapPolicyGap
+		window, refreshAt = gapTolerantSegments(snap.Segments, windowSize, fill, timeout, s.now())
+	default:
+		// This is the alternative implementation to contiguousSlidingWindow.
+		window = contiguousVisibleSegments(snap.Segments, windowSize)
+	}
+	p.Segments = window
+	p.Ended = snap.Ended
+	p.CanBlockReload = true
+	p.TargetDuration = snap.TargetDuration
+	p.PartTarget = snap.PartTarget
+	p.PendingParts = pendingParts(snap, window)
+	p.DiscontinuitySequence = discontinuitySequence(snap, window)
+	p.Cues = cueMarkers(snap, window)
+	p.CueFormat = snap.Settings.CueFormat
+	// Keys follow the segments they protect, not the current settings:
+	// segments encrypted before encryption was turned off still need them.
+	p.Keys = snap.Keys
+	return p, refreshAt
+}
+
+// dvrWindowSize returns how many of the most recent segs fit in a DVR window
+// of the given depth.
+// segs must be sorted by Sequence ascending.
+func dvrWindowSize(segs []Segment, depth time.Duration) int {
+	var total time.Duration
+	for i := len(segs) - 1; i >= 0; i-- {
+		total += seconds(segs[i].Duration)
+		if total > depth {
+			return len(segs) - 1 - i
+		}
+	}
+	return len(segs)
+}
+
+// discontinuitySequence counts the discontinuities that precede the first
+// segment of window: those evicted by the retention policy plus those of
+// retained segments that slid out of the window.
+func discontinuitySequence(snap RenditionSnapshot, window []Segment) int64 {
+	n := snap.EvictedDiscontinuities
+	if len(window) == 0 {
+		return n
+	}
+	for _, seg := range snap.Segments {
+		if seg.Sequence >= window[0].Sequence {
+			break
+		}
+		if seg.Discontinuity {
+			n++
+		}
+	}
+	return n
+}
+
+// playlistContains reports whether p satisfies an _HLS_msn / _HLS_part
+// directive: segment msn is listed, or (with part) the given part of msn is.
+func playlistContains(p MediaPlaylist, msn int64, part *int) bool {
+	if n := len(p.Segments); n > 0 && p.Segments[n-1].Sequence >= msn {
+		return true
+	}
+	if part == nil {
+		return false
+	}
+	for _, pp := range p.PendingParts {
+		if pp.Sequence == msn && pp.Index >= *part {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterPart records an LL-HLS partial segment for the given stream and rendition.
+func (s *Service) RegisterPart(streamID StreamID, renditionID RenditionID, part PartialSegment) error {
+	return s.repo.RegisterPart(streamID, renditionID, part)
+}
+
+// RegisterRendition records variant metadata for the given stream and rendition.
+func (s *Service) RegisterRendition(streamID StreamID, renditionID RenditionID, info RenditionInfo) error {
+	return s.repo.RegisterRendition(streamID, renditionID, info)
+}
+
+// GetRendition returns the metadata of a rendition. The ok return is false if
+// the stream or rendition does not exist; err wraps ErrStoreUnavailable if
+// the state could not be read.
+func (s *Service) GetRendition(streamID StreamID, renditionID RenditionID) (rendition RenditionSummary, ok bool, err error) {
+	renditions, _, err := s.repo.LoadRenditions(streamID)
+	if err != nil {
+		return RenditionSummary{}, false, err
+	}
+	for _, r := range renditions {
+		if r.ID == renditionID {
+			return r, true, nil
+		}
+	}
+	return RenditionSummary{}, false, nil
+}
+
+// GetMasterPlaylist returns the multivariant playlist for the given stream,
+// listing every rendition that has registered variant metadata and has not
+// been ended.
+func (s *Service) GetMasterPlaylist(streamID StreamID) (m3u8 string, ok bool) {
+	m3u8, err := s.GetMasterPlaylistWithToken(streamID, "")
+	return m3u8, err == nil
 }
 
-// EndStream marks the stream as ended; new segments will be rejected.
+// GetMasterPlaylistWithToken is GetMasterPlaylist with token added to the
+// media playlist URIs (see BuildMasterPlaylistWithToken). It returns
+// ErrPlaylistNotFound if the stream does not exist, and an error wrapping
+// ErrStoreUnavailable if the state could not be read.
+func (s *Service) GetMasterPlaylistWithToken(streamID StreamID, token string) (string, error) {
+	renditions, ok, err := s.repo.LoadRenditions(streamID)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrPlaylistNotFound
+	}
+	return BuildMasterPlaylistWithToken(renditions, token), nil
+}
+
+// EndRendition marks a single rendition as ended; new segments for it will be
+// rejected and it is dropped from the multivariant playlist. If a VOD output
+// directory is configured, the rendition's VOD playlist is written to it.
+func (s *Service) EndRendition(streamID StreamID, renditionID RenditionID) error {
+	if err := s.repo.EndRendition(streamID, renditionID); err != nil {
+		return err
+	}
+	s.archiveVOD(streamID, renditionID)
+	return nil
+}
+
+// DeleteStream removes the stream and all its renditions.
+func (s *Service) DeleteStream(streamID StreamID) error {
+	return s.repo.DeleteStream(streamID)
+}
+
+// SetWindowSize sets the window size of the given stream, or of one of its
+// renditions if renditionID is not empty, without touching other settings.
+func (s *Service) SetWindowSize(streamID StreamID, renditionID RenditionID, windowSize int) error {
+	return s.repo.SetWindowSize(streamID, renditionID, windowSize)
+}
+
+// UpdateStreamSettings replaces the settings of the given stream.
+func (s *Service) UpdateStreamSettings(streamID StreamID, settings StreamSettings) error {
+	return s.repo.UpdateStreamSettings(streamID, settings)
+}
+
+// RegisterCue attaches an ad break signal to a stream.
+func (s *Service) RegisterCue(streamID StreamID, cue Cue) error {
+	return s.repo.RegisterCue(streamID, cue)
+}
+
+// EndStream marks the stream as ended; new segments will be rejected. If a VOD
+// output directory is configured, the VOD playlist of every rendition is
+// written to it.
 func (s *Service) EndStream(streamID StreamID) error {
-	return s.repo.EndStream(streamID)
+	if err := s.repo.EndStream(streamID); err != nil {
+		return err
+	}
+	s.archiveVOD(streamID, "")
+	return nil
+}
+
+// windowSizeFor returns the number of segments in the live playlist of the
+// rendition of snap: its own window size, else its stream's, else the
+// service's default.
+func (s *Service) windowSizeFor(snap RenditionSnapshot) int {
+	switch {
+	case snap.WindowSize > 0:
+		return snap.WindowSize
+	case snap.Settings.WindowSize > 0:
+		return snap.Settings.WindowSize
+	}
+	return s.windowSize
+}
+
+// pendingParts returns the parts of the in-progress segment: the one directly
+// after the visible window, or the oldest partially received segment when no
+// segment is visible yet. Ended renditions have no in-progress segment.
+func pendingParts(snap RenditionSnapshot, window []Segment) []PartialSegment {
+	if snap.Ended || len(snap.Parts) == 0 {
+		return nil
+	}
+	if len(window) > 0 {
+		return snap.Parts[window[len(window)-1].Sequence+1]
+	}
+	first := true
+	var next int64
+	for seq := range snap.Parts {
+		if first || seq < next {
+			next, first = seq, false
+		}
+	}
+	return snap.Parts[next]
 }
 
 // contiguousSlidingWindow returns at most windowSize segments
@@ -100,3 +476,77 @@ func contiguousVisibleSegments(segs []Segment, windowSize int) []Segment {
 
 	return visible
 }
+
+// gapTolerantSegments returns at most windowSize segments for the skip and gap
+// policies. A missing sequence number whose following segment was received
+// more than timeout before now is skipped: the window restarts after the hole,
+// or, with fill, the hole is listed as #EXT-X-GAP placeholders when it is
+// shorter than the window. The first missing sequence still within its timeout
+// truncates the window like contiguousVisibleSegments, and refreshAt reports
+// when it expires.
+// segs must be sorted by Sequence ascending.
+func gapTolerantSegments(segs []Segment, windowSize int, fill bool, timeout time.Duration, now time.Time) (window []Segment, refreshAt time.Time) {
+	out := make([]Segment, 0, len(segs))
+	for i, seg := range segs {
+		if i > 0 && seg.Sequence != segs[i-1].Sequence+1 {
+			if deadline := seg.ReceivedAt.Add(timeout); now.Before(deadline) {
+				refreshAt = deadline
+				break
+			}
+			prev := segs[i-1]
+			if missing := seg.Sequence - prev.Sequence - 1; !fill || missing >= int64(windowSize) {
+				out = out[:0]
+			} else {
+				for seq := prev.Sequence + 1; seq < seg.Sequence; seq++ {
+					out = append(out, gapPlaceholder(prev, seq))
+				}
+			}
+		}
+		out = append(out, seg)
+	}
+	if len(out) > windowSize {
+		out = out[len(out)-windowSize:]
+	}
+	return out, refreshAt
+}
+
+// eventSegments returns the segments of an EVENT playlist, which must only
+// grow: holes are never skipped. A hole whose following segment was received
+// more than timeout before now is listed as #EXT-X-GAP placeholders, unless
+// it is longer than the number of segments (e.g. a sequence number jump),
+// which bounds the number of placeholders. The first hole not filled
+// truncates the playlist; refreshAt reports when it will be filled, or is
+// zero if only more segments can fill it.
+// segs must be sorted by Sequence ascending.
+func eventSegments(segs []Segment, timeout time.Duration, now time.Time) (window []Segment, refreshAt time.Time) {
+	out := make([]Segment, 0, len(segs))
+	for i, seg := range segs {
+		if i > 0 && seg.Sequence != segs[i-1].Sequence+1 {
+			prev := segs[i-1]
+			if deadline := seg.ReceivedAt.Add(timeout); now.Before(deadline) {
+				return out, deadline
+			}
+			if seg.Sequence-prev.Sequence-1 > int64(len(segs)) {
+				return out, time.Time{}
+			}
+			for seq := prev.Sequence + 1; seq < seg.Sequence; seq++ {
+				out = append(out, gapPlaceholder(prev, seq))
+			}
+		}
+		out = append(out, seg)
+	}
+	return out, time.Time{}
+}
+
+// gapPlaceholder returns the #EXT-X-GAP placeholder for missing sequence seq
+// after prev. Placeholders repeat prev so that players without EXT-X-GAP
+// support replay it instead of failing.
+func gapPlaceholder(prev Segment, seq int64) Segment {
+	gap := Segment{Sequence: seq, Duration: prev.Duration, Path: prev.Path, Gap: true, Map: prev.Map,
+		ByteRangeLength: prev.ByteRangeLength, ByteRangeOffset: prev.ByteRangeOffset}
+	if prev.ProgramDateTime != nil {
+		pdt := prev.ProgramDateTime.Add(time.Duration(seq-prev.Sequence) * seconds(prev.Duration))
+		gap.ProgramDateTime = &pdt
+	}
+	return gap
+}
@@ -1,9 +1,12 @@
 package orchestrator
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewService_defaultWindowSize(t *testing.T) {
@@ -79,6 +82,9 @@ func TestService_GetPlaylist_contiguous_window(t *testing.T) {
 	if !strings.Contains(m3u8, "/1.ts") || !strings.Contains(m3u8, "/3.ts") {
 		t.Errorf("expected segments 1..3 in playlist: %s", m3u8)
 	}
+	if !strings.Contains(m3u8, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES\n") {
+		t.Errorf("expected blocking reload advertised without parts: %s", m3u8)
+	}
 }
 
 func TestService_GetPlaylist_hide_segments_after_gap(t *testing.T) {
@@ -157,3 +163,390 @@ func TestService_EndStream(t *testing.T) {
 		t.Error("rendition should be ended")
 	}
 }
+
+func TestService_GetMasterPlaylist(t *testing.T) {
+	repo := NewInMemoryRepository()
+	svc := NewService(repo, 6)
+
+	if _, ok := svc.GetMasterPlaylist("s1"); ok {
+		t.Error("expected ok false for missing stream")
+	}
+
+	_ = svc.RegisterRendition("s1", "720p", RenditionInfo{Bandwidth: 2800000, Resolution: "1280x720"})
+	_ = svc.RegisterRendition("s1", "480p", RenditionInfo{Bandwidth: 1400000, Resolution: "854x480"})
+
+	m3u8, ok := svc.GetMasterPlaylist("s1")
+	if !ok {
+		t.Fatal("GetMasterPlaylist: ok false")
+	}
+	if strings.Count(m3u8, "#EXT-X-STREAM-INF") != 2 {
+		t.Errorf("expected 2 variants: %s", m3u8)
+	}
+}
+
+func TestService_GetPlaylist_pending_parts(t *testing.T) {
+	repo := NewInMemoryRepository()
+	svc := NewService(repo, 6)
+
+	_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+	_ = svc.RegisterPart("s1", "720p", PartialSegment{Sequence: 2, Index: 0, Duration: 0.5, URI: "/2.0.ts", Independent: true})
+	// Parts of a later segment are not in progress yet and must not be shown.
+	_ = svc.RegisterPart("s1", "720p", PartialSegment{Sequence: 4, Index: 0, Duration: 0.5, URI: "/4.0.ts"})
+
+	m3u8, ok := svc.GetPlaylist("s1", "720p")
+	if !ok {
+		t.Fatal("GetPlaylist: ok false")
+	}
+	if !strings.Contains(m3u8, "/1.ts\n#EXT-X-PART:DURATION=0.500,URI=\"/2.0.ts\",INDEPENDENT=YES\n") {
+		t.Errorf("expected pending part of sequence 2 after /1.ts: %s", m3u8)
+	}
+	if strings.Contains(m3u8, "/4.0.ts") {
+		t.Errorf("parts of sequence 4 should not be visible: %s", m3u8)
+	}
+
+	_ = svc.EndStream("s1")
+	m3u8, _ = svc.GetPlaylist("s1", "720p")
+	if strings.Contains(m3u8, "/2.0.ts") {
+		t.Errorf("ended playlist should not list pending parts: %s", m3u8)
+	}
+}
+
+func TestService_WaitForPlaylist_blocks_until_segment(t *testing.T) {
+	repo := NewInMemoryRepository()
+	svc := NewServiceWithConfig(repo, ServiceConfig{WindowSize: 6, BlockingReloadTimeout: 2 * time.Second})
+	_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+
+	msn := int64(2)
+	done := make(chan string, 1)
+	go func() {
+		m3u8, err := svc.WaitForPlaylist(context.Background(), "s1", "720p", PlaylistRequest{MSN: &msn})
+		if err != nil {
+			t.Errorf("WaitForPlaylist: %v", err)
+		}
+		done <- m3u8
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("WaitForPlaylist returned before segment 2 was registered")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: 2, Duration: 2.0, Path: "/2.ts"})
+	select {
+	case m3u8 := <-done:
+		if !strings.Contains(m3u8, "/2.ts") {
+			t.Errorf("expected segment 2 in playlist: %s", m3u8)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitForPlaylist not woken by RegisterSegment")
+	}
+}
+
+func TestService_WaitForPlaylist_part(t *testing.T) {
+	repo := NewInMemoryRepository()
+	svc := NewServiceWithConfig(repo, ServiceConfig{BlockingReloadTimeout: 2 * time.Second})
+	_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+
+	msn, part := int64(2), 1
+	done := make(chan error, 1)
+	go func() {
+		_, err := svc.WaitForPlaylist(context.Background(), "s1", "720p", PlaylistRequest{MSN: &msn, Part: &part})
+		done <- err
+	}()
+
+	_ = svc.RegisterPart("s1", "720p", PartialSegment{Sequence: 2, Index: 0, Duration: 0.5, URI: "/2.0.ts"})
+	select {
+	case <-done:
+		t.Fatal("WaitForPlaylist returned before part 1 was registered")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_ = svc.RegisterPart("s1", "720p", PartialSegment{Sequence: 2, Index: 1, Duration: 0.5, URI: "/2.1.ts"})
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("WaitForPlaylist: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitForPlaylist not woken by RegisterPart")
+	}
+}
+
+func TestService_WaitForPlaylist_errors(t *testing.T) {
+	repo := NewInMemoryRepository()
+	svc := NewServiceWithConfig(repo, ServiceConfig{BlockingReloadTimeout: 20 * time.Millisecond})
+	_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+
+	msn, far, part := int64(2), int64(10), 0
+	tests := []struct {
+		name     string
+		streamID StreamID
+		req      PlaylistRequest
+		want     error
+	}{
+		{"timeout", "s1", PlaylistRequest{MSN: &msn}, ErrPlaylistTimeout},
+		{"msn_too_far_ahead", "s1", PlaylistRequest{MSN: &far}, ErrInvalidDirective},
+		{"part_without_msn", "s1", PlaylistRequest{Part: &part}, ErrInvalidDirective},
+		{"not_found", "missing", PlaylistRequest{MSN: &msn}, ErrPlaylistNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := svc.WaitForPlaylist(context.Background(), tt.streamID, "720p", tt.req)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestService_EndRendition(t *testing.T) {
+	repo := NewInMemoryRepository()
+	svc := NewService(repo, 6)
+	_ = svc.RegisterRendition("s1", "1080p", RenditionInfo{Bandwidth: 5000000})
+	_ = svc.RegisterRendition("s1", "720p", RenditionInfo{Bandwidth: 2800000})
+	_ = svc.RegisterSegment("s1", "1080p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+	_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+
+	if err := svc.EndRendition("s1", "1080p"); err != nil {
+		t.Fatalf("EndRendition: %v", err)
+	}
+
+	m3u8, _ := svc.GetPlaylist("s1", "1080p")
+	if !strings.Contains(m3u8, "#EXT-X-ENDLIST") {
+		t.Errorf("ended rendition should include #EXT-X-ENDLIST: %s", m3u8)
+	}
+	m3u8, _ = svc.GetPlaylist("s1", "720p")
+	if strings.Contains(m3u8, "#EXT-X-ENDLIST") {
+		t.Errorf("other renditions should not include #EXT-X-ENDLIST: %s", m3u8)
+	}
+	master, _ := svc.GetMasterPlaylist("s1")
+	if strings.Contains(master, "1080p") || !strings.Contains(master, "720p") {
+		t.Errorf("master playlist should drop only the ended rendition: %s", master)
+	}
+}
+
+func TestService_GetPlaylist_discontinuity_sequence(t *testing.T) {
+	repo := NewInMemoryRepositoryWithConfig(NewInMemoryStore(), RepositoryConfig{
+		Retention: RetentionPolicy{MaxSegments: 4},
+	})
+	svc := NewService(repo, 2)
+	for i := int64(1); i <= 6; i++ {
+		seg := Segment{Sequence: i, Duration: 2.0, Path: "/x.ts", Discontinuity: i == 2 || i == 4}
+		if err := svc.RegisterSegment("s1", "720p", seg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Segment 2 was evicted and segment 4 slid out of the 5..6 window.
+	m3u8, _ := svc.GetPlaylist("s1", "720p")
+	if !strings.Contains(m3u8, "#EXT-X-DISCONTINUITY-SEQUENCE:2\n") {
+		t.Errorf("expected DISCONTINUITY-SEQUENCE 2: %s", m3u8)
+	}
+	if strings.Contains(m3u8, "#EXT-X-DISCONTINUITY\n") {
+		t.Errorf("expected no discontinuity inside the window: %s", m3u8)
+	}
+}
+
+func TestService_GetPlaylist_gap_policies(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	newSvc := func(policy GapPolicy) *Service {
+		repo := NewInMemoryRepository()
+		repo.now = func() time.Time { return start }
+		svc := NewServiceWithConfig(repo, ServiceConfig{WindowSize: 6, GapTimeout: 3 * time.Second})
+		_ = svc.UpdateStreamSettings("s1", StreamSettings{GapPolicy: policy})
+		for _, seq := range []int64{1, 2, 4, 5} {
+			_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: seq, Duration: 2.0, Path: fmt.Sprintf("/%d.ts", seq)})
+		}
+		return svc
+	}
+
+	for _, policy := range []GapPolicy{GapPolicySkip, GapPolicyGap} {
+		svc := newSvc(policy)
+		svc.now = func() time.Time { return start.Add(time.Second) }
+		m3u8, _ := svc.GetPlaylist("s1", "720p")
+		if strings.Contains(m3u8, "/4.ts") {
+			t.Errorf("%s: expected truncation before the gap timeout: %s", policy, m3u8)
+		}
+	}
+
+	svc := newSvc(GapPolicySkip)
+	svc.now = func() time.Time { return start.Add(5 * time.Second) }
+	m3u8, _ := svc.GetPlaylist("s1", "720p")
+	if !strings.Contains(m3u8, "#EXT-X-MEDIA-SEQUENCE:4\n") || strings.Contains(m3u8, "/2.ts") {
+		t.Errorf("skip: expected the window to restart after the gap: %s", m3u8)
+	}
+
+	svc = newSvc(GapPolicyGap)
+	svc.now = func() time.Time { return start.Add(5 * time.Second) }
+	m3u8, _ = svc.GetPlaylist("s1", "720p")
+	if !strings.Contains(m3u8, "#EXT-X-MEDIA-SEQUENCE:1\n") || !strings.Contains(m3u8, "#EXT-X-GAP\n") || !strings.Contains(m3u8, "/5.ts") {
+		t.Errorf("gap: expected a GAP placeholder for sequence 3: %s", m3u8)
+	}
+}
+
+func TestService_WaitForPlaylist_wakes_when_gap_expires(t *testing.T) {
+	svc := NewServiceWithConfig(NewInMemoryRepository(), ServiceConfig{WindowSize: 6, BlockingReloadTimeout: 2 * time.Second})
+	_ = svc.UpdateStreamSettings("s1", StreamSettings{GapPolicy: GapPolicySkip, GapTimeout: 0.05})
+	_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+	_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: 3, Duration: 2.0, Path: "/3.ts"})
+
+	msn := int64(3)
+	m3u8, err := svc.WaitForPlaylist(context.Background(), "s1", "720p", PlaylistRequest{MSN: &msn})
+	if err != nil || !strings.Contains(m3u8, "/3.ts") {
+		t.Errorf("expected segment 3 once the gap expired: err=%v %s", err, m3u8)
+	}
+}
+
+func TestService_GetPlaylist_playlist_types(t *testing.T) {
+	svc := NewService(NewInMemoryRepository(), 3)
+	_ = svc.UpdateStreamSettings("s1", StreamSettings{PlaylistType: PlaylistTypeEvent})
+	_ = svc.UpdateStreamSettings("s2", StreamSettings{PlaylistType: PlaylistTypeDVR, DVRWindow: 20})
+	for i := int64(1); i <= 20; i++ {
+		_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: i, Duration: 2.0, Path: "/x.ts"})
+		_ = svc.RegisterSegment("s2", "720p", Segment{Sequence: i, Duration: 2.0, Path: "/x.ts"})
+	}
+
+	m3u8, _ := svc.GetPlaylist("s1", "720p")
+	if !strings.Contains(m3u8, "#EXT-X-PLAYLIST-TYPE:EVENT\n") || !strings.Contains(m3u8, "#EXT-X-MEDIA-SEQUENCE:1\n") {
+		t.Errorf("event: expected every segment since the start: %s", m3u8)
+	}
+
+	m3u8, _ = svc.GetPlaylist("s2", "720p")
+	if strings.Contains(m3u8, "PLAYLIST-TYPE") || !strings.Contains(m3u8, "#EXT-X-MEDIA-SEQUENCE:11\n") {
+		t.Errorf("dvr: expected the last 20s (sequences 11..20): %s", m3u8)
+	}
+
+	m3u8, err := svc.WaitForPlaylist(context.Background(), "s1", "720p", PlaylistRequest{Type: PlaylistTypeLive})
+	if err != nil || strings.Contains(m3u8, "PLAYLIST-TYPE") || !strings.Contains(m3u8, "#EXT-X-MEDIA-SEQUENCE:18\n") {
+		t.Errorf("live override: expected a 3 segment window: err=%v %s", err, m3u8)
+	}
+}
+
+func TestService_GetPlaylist_playlist_types_with_hole(t *testing.T) {
+	repo := NewInMemoryRepository()
+	svc := NewService(repo, 3)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	repo.now = func() time.Time { return now }
+	svc.now = repo.now
+	_ = svc.UpdateStreamSettings("event", StreamSettings{PlaylistType: PlaylistTypeEvent})
+	_ = svc.UpdateStreamSettings("dvr", StreamSettings{PlaylistType: PlaylistTypeDVR, DVRWindow: 40})
+	_ = svc.UpdateStreamSettings("dvr-skip", StreamSettings{PlaylistType: PlaylistTypeDVR, DVRWindow: 40, GapPolicy: GapPolicySkip})
+	for i := int64(0); i < 20; i++ {
+		if i == 2 {
+			continue
+		}
+		for _, id := range []StreamID{"event", "dvr", "dvr-skip"} {
+			_ = svc.RegisterSegment(id, "720p", Segment{Sequence: i, Duration: 2.0, Path: fmt.Sprintf("/%d.ts", i)})
+		}
+	}
+
+	m3u8, _ := svc.GetPlaylist("event", "720p")
+	if strings.Count(m3u8, "#EXTINF") != 2 {
+		t.Errorf("event: expected the playlist truncated at the fresh hole: %s", m3u8)
+	}
+
+	now = now.Add(DefaultGapTimeout + time.Second)
+	m3u8, _ = svc.GetPlaylist("event", "720p")
+	if strings.Count(m3u8, "#EXTINF") != 20 || strings.Count(m3u8, "#EXT-X-GAP") != 1 || !strings.Contains(m3u8, "#EXT-X-MEDIA-SEQUENCE:0\n") {
+		t.Errorf("event: expected the old hole filled with a gap: %s", m3u8)
+	}
+
+	m3u8, _ = svc.GetPlaylist("dvr", "720p")
+	if !strings.Contains(m3u8, "#EXT-X-GAP") || !strings.HasSuffix(m3u8, "/19.ts\n") {
+		t.Errorf("dvr: expected the old hole filled with a gap up to the live edge: %s", m3u8)
+	}
+
+	m3u8, _ = svc.GetPlaylist("dvr-skip", "720p")
+	if strings.Contains(m3u8, "#EXT-X-GAP") || !strings.Contains(m3u8, "#EXT-X-MEDIA-SEQUENCE:3\n") || !strings.HasSuffix(m3u8, "/19.ts\n") {
+		t.Errorf("dvr skip: expected the playlist to restart after the hole: %s", m3u8)
+	}
+}
+
+func TestService_GetPlaylist_stream_window_size(t *testing.T) {
+	svc := NewService(NewInMemoryRepository(), 6)
+	_, _ = svc.CreateStream("s1", StreamSettings{WindowSize: 3})
+	for seq := int64(1); seq <= 8; seq++ {
+		_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: seq, Duration: 2.0, Path: fmt.Sprintf("/%d.ts", seq)})
+	}
+
+	m3u8, _ := svc.GetPlaylist("s1", "720p")
+	if strings.Count(m3u8, "#EXTINF") != 3 || !strings.Contains(m3u8, "#EXT-X-MEDIA-SEQUENCE:6") {
+		t.Errorf("expected the stream's window of 3 segments: %s", m3u8)
+	}
+}
+
+func TestService_GetPlaylist_rendition_window_size(t *testing.T) {
+	svc := NewService(NewInMemoryRepository(), 6)
+	_, _ = svc.CreateStream("s1", StreamSettings{WindowSize: 3})
+	_ = svc.RegisterRendition("s1", "1080p", RenditionInfo{Bandwidth: 5000000, WindowSize: 5})
+	for seq := int64(1); seq <= 8; seq++ {
+		for _, id := range []RenditionID{"1080p", "720p"} {
+			_ = svc.RegisterSegment("s1", id, Segment{Sequence: seq, Duration: 2.0, Path: fmt.Sprintf("/%s/%d.ts", id, seq)})
+		}
+	}
+
+	m3u8, _ := svc.GetPlaylist("s1", "1080p")
+	if strings.Count(m3u8, "#EXTINF") != 5 {
+		t.Errorf("expected the rendition's window of 5 segments: %s", m3u8)
+	}
+	m3u8, _ = svc.GetPlaylist("s1", "720p")
+	if strings.Count(m3u8, "#EXTINF") != 3 {
+		t.Errorf("expected the stream's window of 3 segments: %s", m3u8)
+	}
+
+	_ = svc.UpdateStreamSettings("s1", StreamSettings{})
+	m3u8, _ = svc.GetPlaylist("s1", "720p")
+	if strings.Count(m3u8, "#EXTINF") != 6 {
+		t.Errorf("expected the default window of 6 segments: %s", m3u8)
+	}
+}
+
+func TestService_ListStreams(t *testing.T) {
+	svc := NewService(NewInMemoryRepository(), 6)
+	for _, id := range []StreamID{"a", "b", "c", "d"} {
+		if _, err := svc.CreateStream(id, StreamSettings{}); err != nil {
+			t.Fatalf("CreateStream: %v", err)
+		}
+	}
+	_ = svc.EndStream("b")
+
+	page := svc.ListStreams(StreamFilter{Limit: 2})
+	if len(page.Streams) != 2 || page.Streams[0].ID != "a" || page.Next != "b" {
+		t.Errorf("unexpected first page %+v", page)
+	}
+	page = svc.ListStreams(StreamFilter{Limit: 2, After: page.Next})
+	if len(page.Streams) != 2 || page.Streams[0].ID != "c" || page.Next != "" {
+		t.Errorf("unexpected last page %+v", page)
+	}
+
+	live := false
+	page = svc.ListStreams(StreamFilter{Ended: &live})
+	if len(page.Streams) != 3 {
+		t.Errorf("expected 3 live streams, got %+v", page.Streams)
+	}
+
+	stream, err := svc.CreateStream("", StreamSettings{})
+	if err != nil || !validStreamID(stream.ID) {
+		t.Errorf("expected a generated stream ID, got %q, %v", stream.ID, err)
+	}
+}
+
+func TestService_GetPlaylist_target_duration_stable(t *testing.T) {
+	svc := NewService(NewInMemoryRepository(), 6)
+
+	var published []string
+	for i, d := range []float64{1.2, 2.8, 5.6} {
+		seq := int64(i + 1)
+		_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: seq, Duration: d, Path: fmt.Sprintf("/%d.ts", seq)})
+		m3u8, _ := svc.GetPlaylist("s1", "720p")
+		for _, line := range strings.Split(m3u8, "\n") {
+			if strings.HasPrefix(line, "#EXT-X-TARGETDURATION:") {
+				published = append(published, line)
+			}
+		}
+	}
+	if len(published) != 3 || published[0] != "#EXT-X-TARGETDURATION:2" || published[1] != published[0] || published[2] != published[0] {
+		t.Errorf("expected TARGETDURATION 2 on every reload, got %v", published)
+	}
+}
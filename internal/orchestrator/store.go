@@ -7,9 +7,33 @@ package orchestrator
 type Store interface {
 	GetStream(id StreamID) (*StreamState, bool)
 	SetStream(s *StreamState)
+	DeleteStream(id StreamID)
 	ListStreamIDs() []StreamID
 }
 
+// SharedStore is implemented by Stores whose state is shared by several
+// orchestrator replicas. The repository's own mutex only serialises requests
+// within one process, so for a SharedStore every mutation runs as
+// lock → load → modify → save under a cross-replica lock on the stream, and
+// backend errors are reported instead of being treated as "not found".
+type SharedStore interface {
+	Store
+
+	// LockStream acquires an exclusive lock on the stream across all
+	// replicas. The returned function releases it.
+	LockStream(id StreamID) (unlock func(), err error)
+
+	// LoadStream is GetStream that reports backend errors. The returned state
+	// is a private copy that the caller may modify.
+	LoadStream(id StreamID) (*StreamState, bool, error)
+
+	// SaveStream is SetStream that reports backend errors.
+	SaveStream(s *StreamState) error
+
+	// RemoveStream is DeleteStream that reports backend errors.
+	RemoveStream(id StreamID) error
+}
+
 // InMemoryStore is an in-memory implementation of Store.
 type InMemoryStore struct {
 	streams map[StreamID]*StreamState
@@ -33,6 +57,11 @@ func (s *InMemoryStore) SetStream(st *StreamState) {
 	s.streams[st.ID] = st
 }
 
+// DeleteStream implements Store.DeleteStream.
+func (s *InMemoryStore) DeleteStream(id StreamID) {
+	delete(s.streams, id)
+}
+
 // ListStreamIDs implements Store.ListStreamIDs.
 func (s *InMemoryStore) ListStreamIDs() []StreamID {
 	ids := make([]StreamID, 0, len(s.streams))
@@ -41,3 +70,19 @@ func (s *InMemoryStore) ListStreamIDs() []StreamID {
 	}
 	return ids
 }
+
+// initStreamMaps replaces nil maps in a decoded stream state with empty ones.
+// Encoders such as gob do not distinguish empty maps from nil maps.
+func initStreamMaps(st *StreamState) {
+	if st.Renditions == nil {
+		st.Renditions = make(map[RenditionID]*RenditionState)
+	}
+	for _, rendition := range st.Renditions {
+		if rendition.Segments == nil {
+			rendition.Segments = make(map[int64]Segment)
+		}
+		if rendition.Parts == nil {
+			rendition.Parts = make(map[int64][]PartialSegment)
+		}
+	}
+}
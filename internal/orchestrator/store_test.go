@@ -58,3 +58,16 @@ func TestNewInMemoryRepositoryWithStore(t *testing.T) {
 		t.Error("injected store should contain stream after RegisterSegment")
 	}
 }
+
+func TestInMemoryStore_DeleteStream(t *testing.T) {
+	store := NewInMemoryStore()
+	store.SetStream(&StreamState{ID: StreamID("s1"), Renditions: make(map[RenditionID]*RenditionState)})
+	store.DeleteStream(StreamID("s1"))
+
+	if _, ok := store.GetStream(StreamID("s1")); ok {
+		t.Error("expected not found after DeleteStream")
+	}
+	if ids := store.ListStreamIDs(); len(ids) != 0 {
+		t.Errorf("ListStreamIDs: got %v", ids)
+	}
+}
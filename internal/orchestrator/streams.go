@@ -0,0 +1,85 @@
+package orchestrator
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	// DefaultStreamPageSize is the number of streams ListStreams returns
+	// when the filter sets no limit.
+	DefaultStreamPageSize = 50
+
+	// MaxStreamPageSize is the largest limit ListStreams accepts.
+	MaxStreamPageSize = 500
+)
+
+// StreamFilter selects the streams returned by ListStreams.
+type StreamFilter struct {
+	Ended *bool    // if set, only streams whose ended flag matches
+	After StreamID // only streams sorted after this ID (the previous page's Next)
+	Limit int      // at most this many streams; 0 uses DefaultStreamPageSize
+}
+
+// StreamPage is one page of ListStreams results.
+// This also matches the JSON response of the stream list endpoint.
+type StreamPage struct {
+	Streams []StreamSummary `json:"streams"`
+	Next    StreamID        `json:"next,omitempty"` // After for the next page; omitted on the last page
+}
+
+// CreateStream creates an empty stream with the given settings and returns its
+// summary. An empty streamID is replaced by a random one. It returns
+// ErrStreamExists if the stream already exists.
+func (s *Service) CreateStream(streamID StreamID, settings StreamSettings) (StreamSummary, error) {
+	if streamID == "" {
+		token, err := randomToken()
+		if err != nil {
+			return StreamSummary{}, fmt.Errorf("generate stream id: %w", err)
+		}
+		streamID = StreamID(token)
+	}
+	if err := s.repo.CreateStream(streamID, settings); err != nil {
+		return StreamSummary{}, err
+	}
+	stream, _ := s.repo.GetStream(streamID)
+	return stream, nil
+}
+
+// GetStream returns a summary of the given stream. The ok return is false if
+// the stream does not exist.
+func (s *Service) GetStream(streamID StreamID) (StreamSummary, bool) {
+	return s.repo.GetStream(streamID)
+}
+
+// ListStreams returns the page of streams, sorted by stream ID, selected by
+// filter.
+func (s *Service) ListStreams(filter StreamFilter) StreamPage {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultStreamPageSize
+	}
+	limit = min(limit, MaxStreamPageSize)
+
+	page := StreamPage{Streams: []StreamSummary{}}
+	for _, stream := range s.repo.ListStreams() {
+		if stream.ID <= filter.After || (filter.Ended != nil && stream.Ended != *filter.Ended) {
+			continue
+		}
+		if len(page.Streams) == limit {
+			page.Next = page.Streams[limit-1].ID
+			break
+		}
+		page.Streams = append(page.Streams, stream)
+	}
+	return page
+}
+
+// validStreamID reports whether id can be used as a stream ID: a single URL
+// path segment that is also safe as a file name (see archiveVOD).
+func validStreamID(id StreamID) bool {
+	return safePathElement(string(id)) && !strings.ContainsFunc(string(id), func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r) || strings.ContainsRune("?#%", r)
+	})
+}
@@ -0,0 +1,117 @@
+package orchestrator
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrRenditionNotEnded is returned when a VOD playlist is requested for a
+// rendition that is still live.
+var ErrRenditionNotEnded = errors.New("rendition has not ended")
+
+// GetVODPlaylist returns the complete #EXT-X-PLAYLIST-TYPE:VOD playlist of an
+// ended rendition: every retained segment, with missing sequence numbers
+// listed as #EXT-X-GAP placeholders. It returns ErrPlaylistNotFound if the
+// rendition does not exist and ErrRenditionNotEnded if it is still live.
+func (s *Service) GetVODPlaylist(streamID StreamID, renditionID RenditionID) (string, error) {
+	snap, ok, err := s.repo.LoadRendition(streamID, renditionID)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrPlaylistNotFound
+	}
+	if !snap.Ended {
+		return "", ErrRenditionNotEnded
+	}
+	return BuildMediaPlaylist(vodPlaylist(snap)), nil
+}
+
+// vodPlaylist computes the VOD playlist of an ended rendition snapshot. Holes
+// are listed as #EXT-X-GAP placeholders; a hole longer than the number of
+// retained segments is collapsed into a discontinuity instead, so that a
+// sequence number jump cannot blow up the playlist. Sequence numbers are not
+// reloaded by VOD players, so the renumbering that implies is harmless.
+func vodPlaylist(snap RenditionSnapshot) MediaPlaylist {
+	segs := make([]Segment, 0, len(snap.Segments))
+	for i, seg := range snap.Segments {
+		seg.Parts = nil // parts are only useful at the live edge
+		if i > 0 {
+			prev := snap.Segments[i-1]
+			switch missing := seg.Sequence - prev.Sequence - 1; {
+			case missing > int64(len(snap.Segments)):
+				seg.Discontinuity = true
+			case missing > 0:
+				for seq := prev.Sequence + 1; seq < seg.Sequence; seq++ {
+					segs = append(segs, gapPlaceholder(prev, seq))
+				}
+			}
+		}
+		segs = append(segs, seg)
+	}
+	p := MediaPlaylist{
+		Segments:              segs,
+		Ended:                 true,
+		Type:                  "VOD",
+		TargetDuration:        max(snap.TargetDuration, targetDurationFromSegments(segs)),
+		DiscontinuitySequence: snap.EvictedDiscontinuities,
+		Cues:                  cueMarkers(snap, segs),
+		CueFormat:             snap.Settings.CueFormat,
+		Keys:                  snap.Keys,
+	}
+	return p
+}
+
+// archiveVOD writes the VOD playlist of every ended rendition of streamID (or
+// only renditionID, if set) to s.vodOutputDir. It is a no-op when no output
+// directory is configured.
+func (s *Service) archiveVOD(streamID StreamID, renditionID RenditionID) {
+	if s.vodOutputDir == "" {
+		return
+	}
+	renditions, ok := s.repo.ListRenditions(streamID)
+	if !ok {
+		return
+	}
+	for _, r := range renditions {
+		if !r.Ended || (renditionID != "" && r.ID != renditionID) {
+			continue
+		}
+		if err := s.writeVOD(streamID, r.ID); err != nil && s.onVODError != nil {
+			s.onVODError(fmt.Errorf("archive vod %s/%s: %w", streamID, r.ID, err))
+		}
+	}
+}
+
+// writeVOD atomically writes the VOD playlist of a rendition to
+// {vodOutputDir}/{stream_id}/{rendition}.m3u8.
+func (s *Service) writeVOD(streamID StreamID, renditionID RenditionID) error {
+	if !safePathElement(string(streamID)) || !safePathElement(string(renditionID)) {
+		return fmt.Errorf("unsafe file name")
+	}
+	m3u8, err := s.GetVODPlaylist(streamID, renditionID)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(s.vodOutputDir, string(streamID))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, string(renditionID)+".m3u8")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(m3u8), 0o644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// safePathElement reports whether name can be used as a single file name
+// without escaping its directory.
+func safePathElement(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
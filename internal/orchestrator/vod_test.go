@@ -0,0 +1,85 @@
+package orchestrator
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestService_GetVODPlaylist(t *testing.T) {
+	svc := NewService(NewInMemoryRepository(), 3)
+
+	if _, err := svc.GetVODPlaylist("s1", "720p"); !errors.Is(err, ErrPlaylistNotFound) {
+		t.Errorf("expected ErrPlaylistNotFound, got %v", err)
+	}
+
+	_ = svc.RegisterPart("s1", "720p", PartialSegment{Sequence: 1, Index: 0, Duration: 1.0, URI: "/1.0.ts"})
+	for i := int64(1); i <= 10; i++ {
+		if i == 7 {
+			continue
+		}
+		_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: i, Duration: 2.0, Path: "/x.ts"})
+	}
+	if _, err := svc.GetVODPlaylist("s1", "720p"); !errors.Is(err, ErrRenditionNotEnded) {
+		t.Errorf("expected ErrRenditionNotEnded, got %v", err)
+	}
+
+	_ = svc.EndStream("s1")
+	m3u8, err := svc.GetVODPlaylist("s1", "720p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(m3u8, "#EXT-X-PLAYLIST-TYPE:VOD\n") || !strings.HasSuffix(m3u8, "#EXT-X-ENDLIST\n") {
+		t.Errorf("expected a VOD playlist with ENDLIST: %s", m3u8)
+	}
+	if n := strings.Count(m3u8, "#EXTINF:"); n != 10 || !strings.Contains(m3u8, "#EXT-X-MEDIA-SEQUENCE:1\n") {
+		t.Errorf("expected all 10 sequences listed, got %d: %s", n, m3u8)
+	}
+	if strings.Count(m3u8, "#EXT-X-GAP\n") != 1 || strings.Contains(m3u8, "#EXT-X-PART:") || strings.Contains(m3u8, "#EXT-X-SERVER-CONTROL") {
+		t.Errorf("expected one GAP for sequence 7 and no parts: %s", m3u8)
+	}
+}
+
+func TestService_GetVODPlaylist_sequence_jump(t *testing.T) {
+	svc := NewService(NewInMemoryRepository(), 3)
+	_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+	_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: 1000000, Duration: 2.0, Path: "/1000000.ts"})
+	_ = svc.EndStream("s1")
+
+	m3u8, _ := svc.GetVODPlaylist("s1", "720p")
+	if strings.Count(m3u8, "#EXTINF:") != 2 || !strings.Contains(m3u8, "#EXT-X-DISCONTINUITY\n") {
+		t.Errorf("expected the jump collapsed into a discontinuity: %s", m3u8)
+	}
+}
+
+func TestService_EndStream_archives_vod(t *testing.T) {
+	dir := t.TempDir()
+	var archiveErrs []error
+	svc := NewServiceWithConfig(NewInMemoryRepository(), ServiceConfig{
+		VODOutputDir: dir,
+		OnVODError:   func(err error) { archiveErrs = append(archiveErrs, err) },
+	})
+	_ = svc.RegisterSegment("s1", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/720/1.ts"})
+	_ = svc.RegisterSegment("s1", "480p", Segment{Sequence: 1, Duration: 2.0, Path: "/480/1.ts"})
+
+	_ = svc.EndRendition("s1", "720p")
+	if _, err := os.Stat(filepath.Join(dir, "s1", "480p.m3u8")); !os.IsNotExist(err) {
+		t.Errorf("expected no archive for the live 480p rendition, got %v", err)
+	}
+
+	_ = svc.EndStream("s1")
+	for _, r := range []string{"720p", "480p"} {
+		b, err := os.ReadFile(filepath.Join(dir, "s1", r+".m3u8"))
+		if err != nil || !strings.Contains(string(b), "/"+strings.TrimSuffix(r, "p")+"/1.ts") {
+			t.Errorf("%s: expected archived VOD playlist, got err=%v %s", r, err, b)
+		}
+	}
+
+	_ = svc.RegisterSegment("..", "720p", Segment{Sequence: 1, Duration: 2.0, Path: "/1.ts"})
+	_ = svc.EndStream("..")
+	if len(archiveErrs) != 1 {
+		t.Errorf("expected an archive error for an unsafe stream ID, got %v", archiveErrs)
+	}
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -37,3 +38,15 @@ func GetEnvInt(key string, fallback int) int {
 	}
 	return fallback
 }
+
+// GetEnvDuration returns the duration value of the environment variable named
+// by key (e.g. "6s", "500ms"), or fallback if the variable is unset, empty, or
+// not a valid duration.
+func GetEnvDuration(key string, fallback time.Duration) time.Duration {
+	if s := os.Getenv(key); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			return d
+		}
+	}
+	return fallback
+}
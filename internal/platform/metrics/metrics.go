@@ -9,12 +9,18 @@ import (
 
 // Metrics holds Prometheus counters and gauges for the HLS orchestrator.
 type Metrics struct {
-	registry                *prometheus.Registry
-	requestsTotal           prometheus.Counter
-	segmentsRegisteredTotal prometheus.Counter
-	streamsEndedTotal       prometheus.Counter
-	activeStreams           prometheus.Gauge
-	errorsTotal             prometheus.Counter
+	registry                      *prometheus.Registry
+	requestsTotal                 prometheus.Counter
+	segmentsRegisteredTotal       prometheus.Counter
+	segmentConflictsTotal         prometheus.Counter
+	targetDurationViolationsTotal prometheus.Counter
+	partsRegisteredTotal          prometheus.Counter
+	segmentsEvictedTotal          prometheus.Counter
+	streamsEndedTotal             prometheus.Counter
+	renditionsEndedTotal          prometheus.Counter
+	streamsPurgedTotal            prometheus.Counter
+	activeStreams                 prometheus.Gauge
+	errorsTotal                   prometheus.Counter
 }
 
 // New creates and registers Prometheus metrics for the orchestrator.
@@ -29,10 +35,34 @@ func New() *Metrics {
 		Name: "hls_segments_registered_total",
 		Help: "Total number of segments successfully registered",
 	})
+	segmentConflictsTotal := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "hls_segment_conflicts_total",
+		Help: "Total number of sequence numbers registered again with a different payload",
+	})
+	targetDurationViolationsTotal := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "hls_target_duration_violations_total",
+		Help: "Total number of segments longer than their rendition's target duration",
+	})
+	partsRegisteredTotal := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "hls_parts_registered_total",
+		Help: "Total number of LL-HLS partial segments successfully registered",
+	})
+	segmentsEvictedTotal := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "hls_segments_evicted_total",
+		Help: "Total number of segments evicted by the retention policy",
+	})
 	streamsEndedTotal := prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "hls_streams_ended_total",
 		Help: "Total number of streams ended",
 	})
+	renditionsEndedTotal := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "hls_renditions_ended_total",
+		Help: "Total number of individual renditions ended",
+	})
+	streamsPurgedTotal := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "hls_streams_purged_total",
+		Help: "Total number of expired streams purged by the janitor",
+	})
 	activeStreams := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "hls_active_streams",
 		Help: "Number of streams that are not ended",
@@ -45,18 +75,30 @@ func New() *Metrics {
 	registry.MustRegister(
 		requestsTotal,
 		segmentsRegisteredTotal,
+		segmentConflictsTotal,
+		targetDurationViolationsTotal,
+		partsRegisteredTotal,
+		segmentsEvictedTotal,
 		streamsEndedTotal,
+		renditionsEndedTotal,
+		streamsPurgedTotal,
 		activeStreams,
 		errorsTotal,
 	)
 
 	return &Metrics{
-		registry:                registry,
-		requestsTotal:           requestsTotal,
-		segmentsRegisteredTotal: segmentsRegisteredTotal,
-		streamsEndedTotal:       streamsEndedTotal,
-		activeStreams:           activeStreams,
-		errorsTotal:             errorsTotal,
+		registry:                      registry,
+		requestsTotal:                 requestsTotal,
+		segmentsRegisteredTotal:       segmentsRegisteredTotal,
+		segmentConflictsTotal:         segmentConflictsTotal,
+		targetDurationViolationsTotal: targetDurationViolationsTotal,
+		partsRegisteredTotal:          partsRegisteredTotal,
+		segmentsEvictedTotal:          segmentsEvictedTotal,
+		streamsEndedTotal:             streamsEndedTotal,
+		renditionsEndedTotal:          renditionsEndedTotal,
+		streamsPurgedTotal:            streamsPurgedTotal,
+		activeStreams:                 activeStreams,
+		errorsTotal:                   errorsTotal,
 	}
 }
 
@@ -70,11 +112,41 @@ func (m *Metrics) IncSegmentsRegistered() {
 	m.segmentsRegisteredTotal.Inc()
 }
 
+// IncSegmentConflicts increments the conflicting segment registrations counter.
+func (m *Metrics) IncSegmentConflicts() {
+	m.segmentConflictsTotal.Inc()
+}
+
+// IncTargetDurationViolations increments the target duration violations counter.
+func (m *Metrics) IncTargetDurationViolations() {
+	m.targetDurationViolationsTotal.Inc()
+}
+
+// IncPartsRegistered increments the partial segments registered counter.
+func (m *Metrics) IncPartsRegistered() {
+	m.partsRegisteredTotal.Inc()
+}
+
+// AddSegmentsEvicted adds n to the segments evicted counter.
+func (m *Metrics) AddSegmentsEvicted(n int) {
+	m.segmentsEvictedTotal.Add(float64(n))
+}
+
 // IncStreamsEnded increments the streams ended counter.
 func (m *Metrics) IncStreamsEnded() {
 	m.streamsEndedTotal.Inc()
 }
 
+// IncRenditionsEnded increments the renditions ended counter.
+func (m *Metrics) IncRenditionsEnded() {
+	m.renditionsEndedTotal.Inc()
+}
+
+// AddStreamsPurged adds n to the streams purged counter.
+func (m *Metrics) AddStreamsPurged(n int) {
+	m.streamsPurgedTotal.Add(float64(n))
+}
+
 // SetActiveStreams sets the active streams gauge.
 func (m *Metrics) SetActiveStreams(n int) {
 	m.activeStreams.Set(float64(n))